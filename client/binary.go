@@ -0,0 +1,478 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	magicRequest  = 0x80
+	magicResponse = 0x81
+
+	headerLen = 24
+)
+
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opFlush     = 0x08
+	opGetQ      = 0x09
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetK      = 0x0c
+	opGetKQ     = 0x0d
+	opAppend    = 0x0e
+	opPrepend   = 0x0f
+	opStat      = 0x10
+	opTouch     = 0x1c
+	opGAT       = 0x1d
+	opSASLAuth  = 0x21
+)
+
+const (
+	statusOK             = 0x00
+	statusKeyNotFound    = 0x01
+	statusKeyExists      = 0x02
+	statusValueTooLarge  = 0x03
+	statusInvalidArgs    = 0x04
+	statusNotStored      = 0x05
+	statusNonNumeric     = 0x06
+	statusAuthError      = 0x20
+	statusAuthContinue   = 0x21
+	statusUnknownCommand = 0x81
+	statusOutOfMemory    = 0x82
+)
+
+// packet is single request or response of the binary protocol.
+type packet struct {
+	opcode uint8
+	// status is vbucket id for requests.
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func writePacket(w *bufio.Writer, p *packet) error {
+	var h [headerLen]byte
+
+	bodyLen := len(p.extras) + len(p.key) + len(p.value)
+
+	h[0] = magicRequest
+	h[1] = p.opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(p.key)))
+	h[4] = uint8(len(p.extras))
+	binary.BigEndian.PutUint16(h[6:], p.status)
+	binary.BigEndian.PutUint32(h[8:], uint32(bodyLen))
+	binary.BigEndian.PutUint32(h[12:], p.opaque)
+	binary.BigEndian.PutUint64(h[16:], p.cas)
+
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.extras); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.key); err != nil {
+		return err
+	}
+	_, err := w.Write(p.value)
+	return err
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	var h [headerLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+
+	if h[0] != magicResponse {
+		return nil, fmt.Errorf("%w: bad magic 0x%02x", ErrProtocol, h[0])
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(h[2:]))
+	extrasLen := int(h[4])
+	bodyLen := int(binary.BigEndian.Uint32(h[8:]))
+	if keyLen+extrasLen > bodyLen {
+		return nil, fmt.Errorf("%w: bad body length", ErrProtocol)
+	}
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &packet{
+		opcode: h[1],
+		status: binary.BigEndian.Uint16(h[6:]),
+		opaque: binary.BigEndian.Uint32(h[12:]),
+		cas:    binary.BigEndian.Uint64(h[16:]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : extrasLen+keyLen],
+		value:  body[extrasLen+keyLen:],
+	}, nil
+}
+
+// binaryRoundTrip sends single request and reads its response.
+func binaryRoundTrip(rw *bufio.ReadWriter, req *packet) (*packet, error) {
+	if err := writePacket(rw.Writer, req); err != nil {
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	resp, err := readPacket(rw.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if resp.opcode != req.opcode || resp.opaque != req.opaque {
+		return nil, fmt.Errorf("%w: response 0x%02x/%d to request 0x%02x/%d",
+			ErrProtocol, resp.opcode, resp.opaque, req.opcode, req.opaque)
+	}
+	return resp, nil
+}
+
+// statusError turns status not handled by the command itself into error.
+func statusError(p *packet) error {
+	msg := string(p.value)
+
+	switch p.status {
+	case statusOK:
+		return nil
+	case statusKeyNotFound:
+		return ErrCacheMiss
+	case statusKeyExists:
+		return ErrCASConflict
+	case statusNotStored:
+		return ErrNotStored
+	case statusValueTooLarge, statusOutOfMemory:
+		return fmt.Errorf("%w: %s", ErrServerError, msg)
+	case statusInvalidArgs, statusNonNumeric, statusUnknownCommand:
+		return fmt.Errorf("%w: %s", ErrClientError, msg)
+	case statusAuthError, statusAuthContinue:
+		return fmt.Errorf("%w: %s", ErrAuthFailed, msg)
+	}
+	return fmt.Errorf("%w: unknown status 0x%04x: %s",
+		ErrServerError, p.status, msg)
+}
+
+func uint32Extras(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.BigEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+// itemFromPacket fills item from get response.
+func itemFromPacket(key string, p *packet) (*Item, error) {
+	if len(p.extras) < 4 {
+		return nil, fmt.Errorf("%w: missing flags", ErrProtocol)
+	}
+
+	return &Item{
+		Key:   key,
+		Value: p.value,
+		Flags: binary.BigEndian.Uint32(p.extras),
+		CAS:   p.cas,
+	}, nil
+}
+
+// binaryProtocol implements protocol using the binary protocol.
+type binaryProtocol struct{}
+
+func (binaryProtocol) get(
+	rw *bufio.ReadWriter,
+	keys []string,
+	cb func(*Item),
+) error {
+	if len(keys) == 1 {
+		resp, err := binaryRoundTrip(rw, &packet{
+			opcode: opGetK,
+			key:    []byte(keys[0]),
+		})
+		if err != nil {
+			return err
+		}
+		if resp.status == statusKeyNotFound {
+			return nil
+		}
+		if err := statusError(resp); err != nil {
+			return err
+		}
+
+		it, err := itemFromPacket(string(resp.key), resp)
+		if err != nil {
+			return err
+		}
+		cb(it)
+		return nil
+	}
+
+	// Quiet gets answer only hits, noop marks the end of the batch.
+	for i, key := range keys {
+		err := writePacket(rw.Writer, &packet{
+			opcode: opGetKQ,
+			opaque: uint32(i),
+			key:    []byte(key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	noop := &packet{opcode: opNoop, opaque: uint32(len(keys))}
+	if err := writePacket(rw.Writer, noop); err != nil {
+		return err
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	var firstErr error
+	for {
+		resp, err := readPacket(rw.Reader)
+		if err != nil {
+			return err
+		}
+
+		if resp.opcode == opNoop {
+			return firstErr
+		}
+		if resp.opcode != opGetKQ || int(resp.opaque) >= len(keys) {
+			return fmt.Errorf("%w: unexpected response 0x%02x",
+				ErrProtocol, resp.opcode)
+		}
+
+		// Keep reading till the noop even on error, so the
+		// connection stays usable.
+		if err := statusError(resp); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		it, err := itemFromPacket(keys[resp.opaque], resp)
+		if err != nil {
+			return err
+		}
+		cb(it)
+	}
+}
+
+func (binaryProtocol) getAndTouch(
+	rw *bufio.ReadWriter,
+	key string,
+	expiration int32,
+	cb func(*Item),
+) error {
+	resp, err := binaryRoundTrip(rw, &packet{
+		opcode: opGAT,
+		extras: uint32Extras(uint32(expiration)),
+		key:    []byte(key),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.status == statusKeyNotFound {
+		return nil
+	}
+	if err := statusError(resp); err != nil {
+		return err
+	}
+
+	it, err := itemFromPacket(key, resp)
+	if err != nil {
+		return err
+	}
+	cb(it)
+	return nil
+}
+
+var storeOpcodes = map[string]uint8{
+	"set":     opSet,
+	"add":     opAdd,
+	"replace": opReplace,
+	"append":  opAppend,
+	"prepend": opPrepend,
+	"cas":     opSet,
+}
+
+func (binaryProtocol) store(rw *bufio.ReadWriter, verb string, item *Item) error {
+	// Binary set with zero CAS is unconditional, text cas with zero never
+	// matches a stored item.
+	if verb == "cas" && item.CAS == 0 {
+		return ErrCASConflict
+	}
+
+	req := &packet{
+		opcode: storeOpcodes[verb],
+		key:    []byte(item.Key),
+		value:  item.Value,
+	}
+	switch verb {
+	case "append", "prepend":
+	default:
+		req.extras = uint32Extras(item.Flags, uint32(item.Expiration))
+	}
+	if verb == "cas" {
+		req.cas = item.CAS
+	}
+
+	resp, err := binaryRoundTrip(rw, req)
+	if err != nil {
+		return err
+	}
+
+	// Map the statuses to the errors text protocol would return.
+	switch {
+	case resp.status == statusKeyExists && verb == "add":
+		return ErrNotStored
+	case resp.status == statusKeyNotFound && verb != "cas":
+		return ErrNotStored
+	}
+	return statusError(resp)
+}
+
+func (binaryProtocol) delete(rw *bufio.ReadWriter, key string) error {
+	resp, err := binaryRoundTrip(rw, &packet{
+		opcode: opDelete,
+		key:    []byte(key),
+	})
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+func (binaryProtocol) touch(
+	rw *bufio.ReadWriter,
+	key string,
+	expiration int32,
+) error {
+	resp, err := binaryRoundTrip(rw, &packet{
+		opcode: opTouch,
+		extras: uint32Extras(uint32(expiration)),
+		key:    []byte(key),
+	})
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+func (binaryProtocol) incrDecr(
+	rw *bufio.ReadWriter,
+	verb string,
+	key string,
+	delta uint64,
+) (uint64, error) {
+	op := uint8(opIncrement)
+	if verb == "decr" {
+		op = opDecrement
+	}
+
+	// Expiration of all ones tells the server not to create missing
+	// keys, matching text protocol's behaviour.
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras, delta)
+	binary.BigEndian.PutUint32(extras[16:], 0xffffffff)
+
+	resp, err := binaryRoundTrip(rw, &packet{
+		opcode: op,
+		extras: extras,
+		key:    []byte(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := statusError(resp); err != nil {
+		return 0, err
+	}
+	if len(resp.value) != 8 {
+		return 0, fmt.Errorf("%w: bad %s response", ErrProtocol, verb)
+	}
+	return binary.BigEndian.Uint64(resp.value), nil
+}
+
+func (binaryProtocol) flushAll(rw *bufio.ReadWriter) error {
+	resp, err := binaryRoundTrip(rw, &packet{opcode: opFlush})
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+func (binaryProtocol) version(rw *bufio.ReadWriter) (string, error) {
+	resp, err := binaryRoundTrip(rw, &packet{opcode: opVersion})
+	if err != nil {
+		return "", err
+	}
+	if err := statusError(resp); err != nil {
+		return "", err
+	}
+	return string(resp.value), nil
+}
+
+func (binaryProtocol) stats(
+	rw *bufio.ReadWriter,
+	args ...string,
+) (map[string]string, error) {
+	req := &packet{
+		opcode: opStat,
+		key:    []byte(strings.Join(args, " ")),
+	}
+	if err := writePacket(rw.Writer, req); err != nil {
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]string)
+	for {
+		resp, err := readPacket(rw.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if resp.opcode != opStat {
+			return nil, fmt.Errorf("%w: unexpected response 0x%02x",
+				ErrProtocol, resp.opcode)
+		}
+		if err := statusError(resp); err != nil {
+			return nil, err
+		}
+		if len(resp.key) == 0 {
+			return stats, nil
+		}
+		stats[string(resp.key)] = string(resp.value)
+	}
+}
+
+// binarySASLPlain authenticates the connection using SASL PLAIN mechanism.
+func binarySASLPlain(
+	rw *bufio.ReadWriter,
+	username string,
+	password string,
+) error {
+	resp, err := binaryRoundTrip(rw, &packet{
+		opcode: opSASLAuth,
+		key:    []byte("PLAIN"),
+		value:  []byte("\x00" + username + "\x00" + password),
+	})
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func newBinaryTestClient(t *testing.T, n int) *Client {
+	c, _ := newTestClient(t, n)
+	c.Protocol = Binary
+	return c
+}
+
+func TestBinarySetGet(t *testing.T) {
+	c := newBinaryTestClient(t, 1)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Get of missing key = %v, want %v", err, ErrCacheMiss)
+	}
+
+	err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar"), Flags: 42})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if it.Key != "foo" || string(it.Value) != "bar" || it.Flags != 42 {
+		t.Errorf("Get returned wrong item: %+v", it)
+	}
+	if it.CAS == 0 {
+		t.Errorf("Get did not return CAS")
+	}
+
+	it, err = c.GetAndTouch(ctx, "foo", 100)
+	if err != nil {
+		t.Fatalf("GetAndTouch: %s", err)
+	}
+	if it.Key != "foo" || string(it.Value) != "bar" {
+		t.Errorf("GetAndTouch returned wrong item: %+v", it)
+	}
+	if _, err := c.GetAndTouch(ctx, "missing", 100); err != ErrCacheMiss {
+		t.Errorf("GetAndTouch of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+}
+
+func TestBinaryStorageCommands(t *testing.T) {
+	c := newBinaryTestClient(t, 1)
+	ctx := context.Background()
+
+	item := &Item{Key: "foo", Value: []byte("b")}
+
+	if err := c.Replace(ctx, item); err != ErrNotStored {
+		t.Errorf("Replace of missing key = %v, want %v",
+			err, ErrNotStored)
+	}
+	if err := c.Append(ctx, item); err != ErrNotStored {
+		t.Errorf("Append to missing key = %v, want %v",
+			err, ErrNotStored)
+	}
+	if err := c.Add(ctx, item); err != nil {
+		t.Errorf("Add: %s", err)
+	}
+	if err := c.Add(ctx, item); err != ErrNotStored {
+		t.Errorf("Add of existing key = %v, want %v", err, ErrNotStored)
+	}
+	if err := c.Append(ctx, &Item{Key: "foo", Value: []byte("c")}); err != nil {
+		t.Errorf("Append: %s", err)
+	}
+	if err := c.Prepend(ctx, &Item{Key: "foo", Value: []byte("a")}); err != nil {
+		t.Errorf("Prepend: %s", err)
+	}
+
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(it.Value) != "abc" {
+		t.Errorf("Value is %q, want abc", it.Value)
+	}
+
+	it.Value = []byte("cas")
+	if err := c.CompareAndSwap(ctx, it); err != nil {
+		t.Errorf("CompareAndSwap: %s", err)
+	}
+	if err := c.CompareAndSwap(ctx, it); err != ErrCASConflict {
+		t.Errorf("Second CompareAndSwap = %v, want %v",
+			err, ErrCASConflict)
+	}
+
+	if err := c.Touch(ctx, "foo", 100); err != nil {
+		t.Errorf("Touch: %s", err)
+	}
+	if err := c.Delete(ctx, "foo"); err != nil {
+		t.Errorf("Delete: %s", err)
+	}
+	if err := c.Delete(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Delete of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+	if err := c.CompareAndSwap(ctx, it); err != ErrCacheMiss {
+		t.Errorf("CompareAndSwap of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+}
+
+func TestBinaryIncrDecr(t *testing.T) {
+	c := newBinaryTestClient(t, 1)
+	ctx := context.Background()
+
+	if _, err := c.Increment(ctx, "n", 1); err != ErrCacheMiss {
+		t.Errorf("Increment of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+
+	if err := c.Set(ctx, &Item{Key: "n", Value: []byte("10")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	if v, err := c.Increment(ctx, "n", 5); err != nil || v != 15 {
+		t.Errorf("Increment = %d, %v, want 15", v, err)
+	}
+	if v, err := c.Decrement(ctx, "n", 20); err != nil || v != 0 {
+		t.Errorf("Decrement = %d, %v, want 0", v, err)
+	}
+
+	if err := c.Set(ctx, &Item{Key: "s", Value: []byte("x")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if _, err := c.Increment(ctx, "s", 1); !errors.Is(err, ErrClientError) {
+		t.Errorf("Increment of non-number = %v, want %v",
+			err, ErrClientError)
+	}
+}
+
+func TestCompareAndSwapWithoutCAS(t *testing.T) {
+	protocols := map[string]Protocol{"Text": Text, "Binary": Binary}
+	for name, protocol := range protocols {
+		c, servers := newTestClient(t, 1)
+		c.Protocol = protocol
+		ctx := context.Background()
+
+		c.Set(ctx, &Item{Key: "foo", Value: []byte("old")})
+		err := c.CompareAndSwap(ctx, &Item{Key: "foo", Value: []byte("new")})
+		if err != ErrCASConflict {
+			t.Errorf("%s: CompareAndSwap = %v, want %v",
+				name, err, ErrCASConflict)
+		}
+		if it, _ := servers[0].Item("foo"); string(it.Value) != "old" {
+			t.Errorf("%s: CompareAndSwap without CAS stored %q",
+				name, it.Value)
+		}
+	}
+}
+
+func TestBinaryGetMultiPipelined(t *testing.T) {
+	c, servers := newTestClient(t, 3)
+	c.Protocol = Binary
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+
+		if i%3 == 0 {
+			continue
+		}
+
+		err := c.Set(ctx, &Item{Key: key, Value: []byte(key)})
+		if err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+
+	items, err := c.GetMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("GetMulti: %s", err)
+	}
+	if len(items) != 40 {
+		t.Errorf("GetMulti returned %d items, want 40", len(items))
+	}
+	for key, it := range items {
+		if it.Key != key || string(it.Value) != key {
+			t.Errorf("%s holds %+v", key, it)
+		}
+	}
+
+	getkq := 0
+	for i, s := range servers {
+		getkq += s.Commands("getkq")
+		if n := s.Commands("noop"); n != 1 {
+			t.Errorf("Server %d got %d noops, want 1", i, n)
+		}
+	}
+	if getkq != 60 {
+		t.Errorf("Servers got %d getkq, want 60", getkq)
+	}
+
+	// The connections must be usable after the pipeline.
+	if _, err := c.Get(ctx, "key-1"); err != nil {
+		t.Errorf("Get after GetMulti: %s", err)
+	}
+}
+
+func TestBinaryServerCommands(t *testing.T) {
+	c := newBinaryTestClient(t, 2)
+	ctx := context.Background()
+
+	versions, err := c.Version(ctx)
+	if err != nil {
+		t.Fatalf("Version: %s", err)
+	}
+	for addr, v := range versions {
+		if v == "" {
+			t.Errorf("Empty version of %s", addr)
+		}
+	}
+
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("x")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %s", err)
+	}
+	if len(stats) != 2 {
+		t.Errorf("Got stats of %d servers, want 2", len(stats))
+	}
+
+	if err := c.FlushAll(ctx); err != nil {
+		t.Fatalf("FlushAll: %s", err)
+	}
+	if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Get after FlushAll = %v, want %v", err, ErrCacheMiss)
+	}
+}
+
+func TestBinarySASL(t *testing.T) {
+	c, servers := newTestClient(t, 1)
+	c.Protocol = Binary
+	servers[0].RequireAuth("user", "secret")
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "foo"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Unauthenticated Get = %v, want %v", err, ErrAuthFailed)
+	}
+
+	c.Username = "user"
+	c.Password = "wrong"
+	if _, err := c.Get(ctx, "foo"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Get with wrong password = %v, want %v",
+			err, ErrAuthFailed)
+	}
+
+	c.Password = "secret"
+	if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Authenticated Get = %v, want %v", err, ErrCacheMiss)
+	}
+	if n := servers[0].Commands("sasl_auth"); n != 2 {
+		t.Errorf("Server got %d sasl_auth, want 2", n)
+	}
+
+	c.Protocol = Text
+	c.Close()
+	if _, err := c.Get(ctx, "foo"); err != ErrAuthUnsupported {
+		t.Errorf("Text protocol with credentials = %v, want %v",
+			err, ErrAuthUnsupported)
+	}
+}
+
+func TestBinarySASLPerServer(t *testing.T) {
+	servers := newTestServers(t, 2)
+	servers[0].RequireAuth("user0", "secret0")
+	servers[1].RequireAuth("user1", "secret1")
+
+	k := &ketama.Ketama{}
+	list := []ketama.Server{
+		{Addr: servers[0].Addr(), Username: "user0", Password: "secret0"},
+		{Addr: servers[1].Addr(), Username: "user1", Password: "secret1"},
+	}
+	if err := k.SetServers(list); err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+
+	c := New(k)
+	c.Protocol = Binary
+	c.Timeout = time.Second
+	// Per-server credentials take precedence.
+	c.Username = "nobody"
+	t.Cleanup(func() { c.Close() })
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := c.Get(ctx, key); err != ErrCacheMiss {
+			t.Fatalf("Get(%q) = %v, want %v", key, err, ErrCacheMiss)
+		}
+	}
+	for i, s := range servers {
+		if s.Commands("sasl_auth") == 0 {
+			t.Errorf("Server %d did not authenticate", i)
+		}
+	}
+
+	list[1].Password = "wrong"
+	if err := k.SetServers(list); err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+	c.Close()
+
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key-%d", i)
+		if addr, _ := k.PickServer(key); addr == servers[1].Addr() {
+			break
+		}
+	}
+
+	_, err := c.Get(ctx, key)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("Get with wrong password = %v, want AuthError", err)
+	}
+	if authErr.Addr != servers[1].Addr() || authErr.Username != "user1" {
+		t.Errorf("Wrong AuthError: %+v", authErr)
+	}
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("AuthError does not wrap %v", ErrAuthFailed)
+	}
+
+	h := c.Health(servers[1].Addr())
+	if h.AuthFailures != 1 || h.Healthy() {
+		t.Errorf("Wrong health after auth failure: %+v", h)
+	}
+	if h := c.Health(servers[0].Addr()); !h.Healthy() || h.Requests == 0 {
+		t.Errorf("Wrong health of the other server: %+v", h)
+	}
+}
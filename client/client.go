@@ -0,0 +1,900 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Errors are shared with github.com/bradfitz/gomemcache/memcache, so code
+// comparing against them keeps working after switching to this package.
+var (
+	// ErrCacheMiss means that a Get failed because the item wasn't present.
+	ErrCacheMiss = memcache.ErrCacheMiss
+	// ErrCASConflict means that a CompareAndSwap call failed due to the
+	// cached value being modified between the Get and the CompareAndSwap.
+	ErrCASConflict = memcache.ErrCASConflict
+	// ErrNotStored means that a conditional write operation (i.e. Add or
+	// CompareAndSwap) failed because the condition was not satisfied.
+	ErrNotStored = memcache.ErrNotStored
+	// ErrServerError means that a server error occurred.
+	ErrServerError = memcache.ErrServerError
+	// ErrMalformedKey is returned when an invalid key is used. Keys must
+	// be at maximum 250 bytes long and not contain whitespace or control
+	// characters.
+	ErrMalformedKey = memcache.ErrMalformedKey
+	// ErrNoServers is returned when no servers are configured or
+	// available.
+	ErrNoServers = memcache.ErrNoServers
+	// ErrClientError means that server rejected the request as malformed.
+	ErrClientError = errors.New("memcache: client error")
+	// ErrProtocol means that server's response could not be understood.
+	ErrProtocol = errors.New("memcache: protocol error")
+	// ErrAuthFailed means that server rejected the credentials.
+	ErrAuthFailed = errors.New("memcache: authentication failed")
+	// ErrAuthUnsupported is returned when credentials are configured
+	// but the protocol does not support authentication.
+	ErrAuthUnsupported = errors.New(
+		"memcache: authentication requires binary protocol",
+	)
+	// ErrMetaUnsupported is returned by the meta commands when the client
+	// uses the binary protocol.
+	ErrMetaUnsupported = errors.New(
+		"memcache: meta commands require text protocol",
+	)
+	// ErrReplicated is returned by the operations which cannot be applied
+	// to all replicas of the key consistently, like CompareAndSwap, when
+	// the selector stores keys on several servers.
+	ErrReplicated = errors.New(
+		"memcache: operation not supported with replicated keys",
+	)
+)
+
+const (
+	// DefaultTimeout is the default timeout of single operation, used when
+	// the context passed to it has no deadline.
+	DefaultTimeout = 100 * time.Millisecond
+	// DefaultMaxIdleConns is the default maximum number of idle
+	// connections kept for any single server.
+	DefaultMaxIdleConns = 2
+)
+
+// Selector picks server for keys. It is the same interface as
+// memcache.ServerSelector, *ketama.Ketama implements it.
+type Selector interface {
+	PickServer(key string) (net.Addr, error)
+	Each(func(net.Addr) error) error
+}
+
+// keyGrouper is implemented by selectors able to group keys under single
+// snapshot of the server list, like *ketama.Ketama.
+type keyGrouper interface {
+	GroupKeys(keys []string) (map[net.Addr][]string, error)
+}
+
+// serverLookup is implemented by selectors carrying per-server settings, like
+// *ketama.Ketama.
+type serverLookup interface {
+	LookupServer(addr net.Addr) (ketama.Server, bool)
+}
+
+// loadReporter is implemented by selectors taking load of the servers into
+// account, like *ketama.BoundedLoad. Acquire is called before every request to
+// addr, Release after it finished.
+type loadReporter interface {
+	Acquire(addr net.Addr)
+	Release(addr net.Addr)
+}
+
+// replicaPicker is implemented by selectors storing keys on several servers,
+// like *ketama.ZoneAware. Writes go to all addresses returned by PickReplicas.
+type replicaPicker interface {
+	PickReplicas(key string) ([]net.Addr, error)
+}
+
+// topologySubscriber is implemented by selectors announcing changes of the
+// server list, like *ketama.Ketama and *router.Router. Pools of removed and
+// changed servers are closed.
+type topologySubscriber interface {
+	Subscribe(fn func(ketama.TopologyChange)) (unsubscribe func())
+}
+
+// AuthError is returned when server addr rejects the credentials. It wraps
+// ErrAuthFailed.
+type AuthError struct {
+	Addr     net.Addr
+	Username string
+	Err      error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: authentication as %q: %v",
+		e.Addr, e.Username, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Item is an item to be got or stored in a memcached server.
+type Item struct {
+	// Key is the Item's key (250 bytes maximum).
+	Key string
+	// Value is the Item's value.
+	Value []byte
+	// Flags are server-opaque flags whose semantics are entirely up to
+	// the app.
+	Flags uint32
+	// Expiration is the cache expiration time, in seconds: either
+	// a relative time from now (up to 1 month), or an absolute Unix epoch
+	// time. Zero means the Item has no expiration time.
+	Expiration int32
+	// CAS is compare and swap ID. It is filled by Get and used by
+	// CompareAndSwap.
+	CAS uint64
+}
+
+// Client is a memcached client. It is safe to use from multiple goroutines at
+// once. Exported fields must not be modified after first use.
+type Client struct {
+	// Timeout of single operation, used when the context passed to the
+	// operation has no deadline. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+	// DialTimeout limits how long dialing new connection can take, in
+	// addition to the context's deadline. If zero, only the context
+	// limits it.
+	DialTimeout time.Duration
+	// MaxIdleConns is the maximum number of idle connections kept for
+	// any single server. If zero, DefaultMaxIdleConns is used.
+	MaxIdleConns int
+	// MaxConns is the maximum number of open connections to any single
+	// server. Operations wait for free connection when the limit is
+	// reached. If zero, the number is not limited.
+	MaxConns int
+	// Protocol used to talk to the servers. Text by default.
+	Protocol Protocol
+	// Username and Password, when Username is not empty, are used for
+	// SASL PLAIN authentication of every new connection. Credentials of
+	// the server itself (ketama.Server's Username and Password), if the
+	// selector provides them, take precedence. Authentication is
+	// supported only by the Binary protocol.
+	Username string
+	Password string
+	// TLSConfig, when not nil, makes the client connect to the servers
+	// over TLS. TLS configuration of the server itself (ketama.Server's
+	// TLS), if the selector provides it, takes precedence.
+	TLSConfig *tls.Config
+	// Metrics, when not nil, receives latency and result of every
+	// operation on every server.
+	Metrics Metrics
+	// CopyForward makes reads copy items found on the previous owner
+	// of the key during a transition window of the selector (see
+	// ketama.Ketama.SetTransitionWindow) to the new owner, with their
+	// remaining TTL (GetAndTouch with the new expiration). It needs
+	// the Text protocol and memcached 1.6 or newer, the TTL is read
+	// using meta get. Items on older servers are returned but not
+	// copied, MetaGet and MetaGetMulti with NoValue copy nothing.
+	CopyForward bool
+	// Dial is used to open new connections. It must honour cancellation
+	// of ctx. If nil, net.Dialer is used. TLS, if configured, is
+	// established over the returned connection.
+	Dial func(ctx context.Context, addr net.Addr) (net.Conn, error)
+
+	selector    Selector
+	pools       pools
+	health      healths
+	unsubscribe func()
+}
+
+// New returns client using selector for picking the servers. If the selector
+// announces changes of the server list (like *ketama.Ketama and
+// *router.Router do), connections to removed servers are closed.
+func New(selector Selector) *Client {
+	c := &Client{selector: selector}
+	if s, ok := selector.(topologySubscriber); ok {
+		c.unsubscribe = s.Subscribe(c.topologyChanged)
+	}
+	return c
+}
+
+// Close closes all idle connections and stops following changes of the server
+// list. Client can still be used afterwards.
+func (c *Client) Close() error {
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+	}
+	c.pools.close()
+	return nil
+}
+
+// topologyChanged closes pools of servers removed by change and of servers
+// whose settings changed, so that new connections use the new credentials and
+// TLS configuration.
+func (c *Client) topologyChanged(change ketama.TopologyChange) {
+	current := make(map[string]bool, len(change.New))
+	for _, addr := range change.New {
+		current[poolKey(addr)] = true
+	}
+
+	var removed []net.Addr
+	for _, addr := range change.Old {
+		if !current[poolKey(addr)] {
+			removed = append(removed, addr)
+		}
+	}
+	c.pools.remove(append(removed, change.Changed...))
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout != 0 {
+		return c.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (c *Client) maxIdleConns() int {
+	if c.MaxIdleConns != 0 {
+		return c.MaxIdleConns
+	}
+	return DefaultMaxIdleConns
+}
+
+// resumableError returns true if err is only a protocol-level cache error,
+// meaning the connection can be reused.
+func resumableError(err error) bool {
+	switch err {
+	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey:
+		return true
+	}
+
+	var ie *incompleteError
+	if errors.As(err, &ie) {
+		return false
+	}
+	return errors.Is(err, ErrServerError)
+}
+
+func legalKey(key string) bool {
+	if len(key) > 250 || len(key) == 0 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// withContext returns ctx limited by Timeout when it has no deadline.
+func (c *Client) withContext(
+	ctx context.Context,
+) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout())
+}
+
+func (c *Client) dial(ctx context.Context, addr net.Addr) (net.Conn, error) {
+	if c.DialTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+
+	var nc net.Conn
+	var err error
+	if c.Dial != nil {
+		nc, err = c.Dial(ctx, addr)
+	} else {
+		d := net.Dialer{}
+		nc, err = d.DialContext(ctx, addr.Network(), addr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg := c.tlsConfig(addr); cfg != nil {
+		return tlsClient(ctx, nc, addr, cfg)
+	}
+	return nc, nil
+}
+
+func (c *Client) getConn(ctx context.Context, addr net.Addr) (*conn, error) {
+	p := c.pools.get(addr, c.MaxConns, c.maxIdleConns())
+
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if cn := p.popIdle(); cn != nil {
+		return cn, nil
+	}
+
+	cn, err := c.newConn(ctx, addr)
+	if err != nil {
+		p.free()
+		return nil, err
+	}
+
+	cn.pool = p
+	return cn, nil
+}
+
+// credentials returns username and password for server addr.
+func (c *Client) credentials(addr net.Addr) (string, string) {
+	if l, ok := c.selector.(serverLookup); ok {
+		if s, ok := l.LookupServer(addr); ok && s.Username != "" {
+			return s.Username, s.Password
+		}
+	}
+	return c.Username, c.Password
+}
+
+// newConn dials addr and authenticates the connection, if configured.
+func (c *Client) newConn(ctx context.Context, addr net.Addr) (*conn, error) {
+	username, password := c.credentials(addr)
+	if username != "" && c.Protocol != Binary {
+		return nil, ErrAuthUnsupported
+	}
+
+	nc, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{
+		nc:   nc,
+		rw:   bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+		addr: addr,
+	}
+
+	if username != "" {
+		deadline, _ := ctx.Deadline()
+		nc.SetDeadline(deadline)
+
+		stop := interruptOnDone(ctx, nc)
+		err = binarySASLPlain(cn.rw, username, password)
+		stop()
+
+		if errors.Is(err, ErrAuthFailed) {
+			err = &AuthError{Addr: addr, Username: username, Err: err}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+// withAddr runs fn with connection to addr. op names the operation for
+// Metrics.
+func (c *Client) withAddr(
+	ctx context.Context,
+	op string,
+	addr net.Addr,
+	fn func(*conn) error,
+) (err error) {
+	start := time.Now()
+
+	if l, ok := c.selector.(loadReporter); ok {
+		l.Acquire(addr)
+		defer l.Release(addr)
+	}
+
+	ctx, cancel := c.withContext(ctx)
+	defer cancel()
+
+	defer func() {
+		err = contextError(ctx, err)
+		c.health.record(addr, err)
+		if c.Metrics != nil {
+			c.Metrics.ObserveRequest(addr, op, time.Since(start), err)
+		}
+	}()
+
+	cn, err := c.getConn(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cn.pool.put(cn, resumableError(err))
+	}()
+
+	deadline, _ := ctx.Deadline()
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	stop := interruptOnDone(ctx, cn.nc)
+	err = fn(cn)
+	stop()
+
+	return err
+}
+
+// contextError returns ctx's error when err was caused by ctx being done.
+// Whatever failed (dial, write or read), cancellation of the context is the
+// real reason.
+func contextError(ctx context.Context, err error) error {
+	if resumableError(err) {
+		return err
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	// Connection's deadline can fire before the context notices.
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate
+// cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptOnDone makes pending and future I/O on nc fail once ctx is done.
+// Returned function stops the watching. After it returns, nc is no longer
+// touched.
+func interruptOnDone(ctx context.Context, nc net.Conn) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+func (c *Client) withKey(
+	ctx context.Context,
+	op string,
+	key string,
+	fn func(*conn) error,
+) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+
+	return c.withAddr(ctx, op, addr, fn)
+}
+
+// withReplicas calls fn for every replica of key in parallel, if the selector
+// provides replicas, and returns error of the first replica (in the order of
+// PickReplicas) which failed. fn gets index of the replica in that order.
+// Without replicas it is the same as withKey, with index 0.
+func (c *Client) withReplicas(
+	ctx context.Context,
+	op string,
+	key string,
+	fn func(i int, cn *conn) error,
+) error {
+	r, ok := c.selector.(replicaPicker)
+	if !ok {
+		return c.withKey(ctx, op, key, func(cn *conn) error {
+			return fn(0, cn)
+		})
+	}
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+
+	addrs, err := r.PickReplicas(key)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]chan error, len(addrs))
+	for i, addr := range addrs {
+		errs[i] = make(chan error, 1)
+		go func(i int, addr net.Addr) {
+			errs[i] <- c.withAddr(ctx, op, addr, func(cn *conn) error {
+				return fn(i, cn)
+			})
+		}(i, addr)
+	}
+
+	for _, errc := range errs {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// replicated reports whether the selector stores keys on several servers.
+func (c *Client) replicated() bool {
+	_, ok := c.selector.(replicaPicker)
+	return ok
+}
+
+// each calls fn for every server in parallel and returns first error.
+func (c *Client) each(
+	ctx context.Context,
+	op string,
+	fn func(*conn) error,
+) error {
+	var addrs []net.Addr
+	c.selector.Each(func(addr net.Addr) error {
+		addrs = append(addrs, addr)
+		return nil
+	})
+
+	errs := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr net.Addr) {
+			errs <- c.withAddr(ctx, op, addr, fn)
+		}(addr)
+	}
+
+	var err error
+	for range addrs {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Get gets the item for the given key. ErrCacheMiss is returned for a memcache
+// cache miss.
+//
+// During a transition window of the selector (see
+// ketama.Ketama.SetTransitionWindow) a miss on the owner of the key is
+// retried on its previous owner, and the item found there is copied to the
+// owner if CopyForward is set.
+func (c *Client) Get(ctx context.Context, key string) (*Item, error) {
+	if !legalKey(key) {
+		return nil, ErrMalformedKey
+	}
+
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var item *Item
+	err = c.withAddr(ctx, "get", addr, func(cn *conn) error {
+		return c.proto().get(cn.rw, []string{key}, func(it *Item) {
+			item = it
+		})
+	})
+	if err == nil && item == nil {
+		err = ErrCacheMiss
+	}
+	if tp, ok := c.selector.(transitionPicker); ok && err == ErrCacheMiss {
+		from := map[string]net.Addr{key: addr}
+		if item := c.getPrevious(ctx, tp, from)[key]; item != nil {
+			return item, nil
+		}
+	}
+	return item, err
+}
+
+// GetAndTouch gets the item for the given key and updates its expiration
+// time. ErrCacheMiss is returned for a memcache cache miss. With replicas, all
+// of them are touched and the item of the first one holding it is returned.
+// During a transition window a miss is retried on the previous owner, like
+// in Get, the item is touched there and copied with the new expiration.
+func (c *Client) GetAndTouch(
+	ctx context.Context,
+	key string,
+	expiration int32,
+) (*Item, error) {
+	var m sync.Mutex
+	var item *Item
+	var addr net.Addr
+	first := -1
+	err := c.withReplicas(ctx, "get_and_touch", key,
+		func(i int, cn *conn) error {
+			if i == 0 {
+				addr = cn.addr
+			}
+			return c.proto().getAndTouch(cn.rw, key, expiration,
+				func(it *Item) {
+					m.Lock()
+					if first < 0 || i < first {
+						item, first = it, i
+					}
+					m.Unlock()
+				})
+		})
+	tp, ok := c.selector.(transitionPicker)
+	if err == nil && item == nil && ok {
+		item = c.getAndTouchPrevious(ctx, tp, key, addr, expiration)
+	}
+	if err == nil && item == nil {
+		err = ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// GetMulti is a batch version of Get. The returned map from keys to items may
+// have fewer elements than the input slice, due to memcache cache misses.
+// Keys are sent to their servers in parallel. The returned map is non-nil
+// unless the keys could not be sent at all: when some servers fail, it holds
+// the items of the others, together with the first error. During a transition
+// window keys missing on servers which answered are retried on their previous
+// owners, like in Get.
+func (c *Client) GetMulti(
+	ctx context.Context,
+	keys []string,
+) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, ErrMalformedKey
+		}
+	}
+
+	groups, err := c.groupKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var m sync.Mutex
+	items := make(map[string]*Item)
+	missed := make(map[string]net.Addr)
+	add := func(it *Item) {
+		m.Lock()
+		items[it.Key] = it
+		m.Unlock()
+	}
+
+	errs := make(chan error, len(groups))
+	for addr, keys := range groups {
+		go func(addr net.Addr, keys []string) {
+			get := func(cn *conn) error {
+				return c.proto().get(cn.rw, keys, add)
+			}
+			e := c.withAddr(ctx, "get_multi", addr, get)
+			if e == nil {
+				m.Lock()
+				for _, key := range keys {
+					if items[key] == nil {
+						missed[key] = addr
+					}
+				}
+				m.Unlock()
+			}
+			errs <- e
+		}(addr, keys)
+	}
+
+	for range groups {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if tp, ok := c.selector.(transitionPicker); ok && len(missed) > 0 {
+		for key, it := range c.getPrevious(ctx, tp, missed) {
+			items[key] = it
+		}
+	}
+	return items, err
+}
+
+func (c *Client) groupKeys(keys []string) (map[net.Addr][]string, error) {
+	if g, ok := c.selector.(keyGrouper); ok {
+		return g.GroupKeys(keys)
+	}
+
+	groups := make(map[net.Addr][]string)
+	for _, key := range keys {
+		addr, err := c.selector.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		groups[addr] = append(groups[addr], key)
+	}
+	return groups, nil
+}
+
+// store writes item to all replicas of its key. cas is not supported with
+// replicas, CAS values of the replicas differ.
+func (c *Client) store(ctx context.Context, verb string, item *Item) error {
+	if verb == "cas" && c.replicated() {
+		return ErrReplicated
+	}
+
+	return c.withReplicas(ctx, verb, item.Key, func(_ int, cn *conn) error {
+		return c.proto().store(cn.rw, verb, item)
+	})
+}
+
+// Set writes the given item, unconditionally.
+func (c *Client) Set(ctx context.Context, item *Item) error {
+	return c.store(ctx, "set", item)
+}
+
+// Add writes the given item, if no value already exists for its key.
+// ErrNotStored is returned if that condition is not met.
+func (c *Client) Add(ctx context.Context, item *Item) error {
+	return c.store(ctx, "add", item)
+}
+
+// Replace writes the given item, but only if the server *does* already hold
+// data for this key. ErrNotStored is returned if that condition is not met.
+func (c *Client) Replace(ctx context.Context, item *Item) error {
+	return c.store(ctx, "replace", item)
+}
+
+// Append appends item's value to the value already stored under its key.
+// Flags and expiration of item are ignored. ErrNotStored is returned if there
+// is no such value.
+func (c *Client) Append(ctx context.Context, item *Item) error {
+	return c.store(ctx, "append", item)
+}
+
+// Prepend prepends item's value to the value already stored under its key.
+// Flags and expiration of item are ignored. ErrNotStored is returned if there
+// is no such value.
+func (c *Client) Prepend(ctx context.Context, item *Item) error {
+	return c.store(ctx, "prepend", item)
+}
+
+// CompareAndSwap writes the given item that was previously returned by Get, if
+// the value was neither modified or evicted between the Get and the
+// CompareAndSwap calls. ErrCASConflict is returned if the value was modified
+// in between the calls, ErrCacheMiss if it was evicted. ErrReplicated is
+// returned when the selector stores keys on several servers.
+func (c *Client) CompareAndSwap(ctx context.Context, item *Item) error {
+	return c.store(ctx, "cas", item)
+}
+
+// Delete deletes the item with the provided key. ErrCacheMiss is returned if
+// the item didn't already exist in the cache.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.withReplicas(ctx, "delete", key, func(_ int, cn *conn) error {
+		return c.proto().delete(cn.rw, key)
+	})
+}
+
+// Touch updates the expiry for the given key. ErrCacheMiss is returned if the
+// key is not in the cache.
+func (c *Client) Touch(
+	ctx context.Context,
+	key string,
+	expiration int32,
+) error {
+	return c.withReplicas(ctx, "touch", key, func(_ int, cn *conn) error {
+		return c.proto().touch(cn.rw, key, expiration)
+	})
+}
+
+// Increment atomically increments key by delta. The return value is the new
+// value after being incremented. If the value didn't exist in memcached the
+// error is ErrCacheMiss. On 64-bit overflow, the new value wraps around.
+func (c *Client) Increment(
+	ctx context.Context,
+	key string,
+	delta uint64,
+) (uint64, error) {
+	return c.incrDecr(ctx, "incr", key, delta)
+}
+
+// Decrement atomically decrements key by delta. The return value is the new
+// value after being decremented. If the value didn't exist in memcached the
+// error is ErrCacheMiss. On underflow, the new value is capped at zero.
+func (c *Client) Decrement(
+	ctx context.Context,
+	key string,
+	delta uint64,
+) (uint64, error) {
+	return c.incrDecr(ctx, "decr", key, delta)
+}
+
+// incrDecr applies verb to all replicas of key and returns the value of the
+// first one.
+func (c *Client) incrDecr(
+	ctx context.Context,
+	verb string,
+	key string,
+	delta uint64,
+) (uint64, error) {
+	var val uint64
+	err := c.withReplicas(ctx, verb, key, func(i int, cn *conn) error {
+		v, err := c.proto().incrDecr(cn.rw, verb, key, delta)
+		if i == 0 {
+			val = v
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return val, nil
+}
+
+// FlushAll invalidates all items on all servers.
+func (c *Client) FlushAll(ctx context.Context) error {
+	return c.each(ctx, "flush_all", func(cn *conn) error {
+		return c.proto().flushAll(cn.rw)
+	})
+}
+
+// Ping checks all servers are alive. Returns error if any of them is down.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.each(ctx, "ping", func(cn *conn) error {
+		_, err := c.proto().version(cn.rw)
+		return err
+	})
+}
+
+// Version returns version of each server.
+func (c *Client) Version(ctx context.Context) (map[net.Addr]string, error) {
+	var m sync.Mutex
+	versions := make(map[net.Addr]string)
+
+	err := c.each(ctx, "version", func(cn *conn) error {
+		v, err := c.proto().version(cn.rw)
+		if err != nil {
+			return err
+		}
+
+		m.Lock()
+		versions[cn.addr] = v
+		m.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Stats returns statistics of each server. args are passed to the stats
+// command, for example "slabs" or "items".
+func (c *Client) Stats(
+	ctx context.Context,
+	args ...string,
+) (map[net.Addr]map[string]string, error) {
+	var m sync.Mutex
+	stats := make(map[net.Addr]map[string]string)
+
+	err := c.each(ctx, "stats", func(cn *conn) error {
+		s, err := c.proto().stats(cn.rw, args...)
+		if err != nil {
+			return err
+		}
+
+		m.Lock()
+		stats[cn.addr] = s
+		m.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
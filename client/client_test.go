@@ -0,0 +1,636 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/memcachetest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/router"
+)
+
+func newTestServers(t *testing.T, n int) []*memcachetest.Server {
+	servers := make([]*memcachetest.Server, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := memcachetest.NewServer()
+		if err != nil {
+			t.Fatalf("Cannot start server: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func newTestClient(t *testing.T, n int) (*Client, []*memcachetest.Server) {
+	servers := newTestServers(t, n)
+
+	addrs := make([]net.Addr, 0, n)
+	for _, s := range servers {
+		addrs = append(addrs, s.Addr())
+	}
+
+	k := &ketama.Ketama{}
+	if err := k.SetServersAddr(addrs); err != nil {
+		t.Fatalf("Cannot set servers: %s", err)
+	}
+
+	c := New(k)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+
+	return c, servers
+}
+
+func TestSetGet(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Get of missing key = %v, want %v", err, ErrCacheMiss)
+	}
+
+	err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar"), Flags: 42})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if it.Key != "foo" || string(it.Value) != "bar" || it.Flags != 42 {
+		t.Errorf("Get returned wrong item: %+v", it)
+	}
+	if it.CAS == 0 {
+		t.Errorf("Get did not return CAS")
+	}
+
+	it, err = c.GetAndTouch(ctx, "foo", 100)
+	if err != nil {
+		t.Fatalf("GetAndTouch: %s", err)
+	}
+	if string(it.Value) != "bar" {
+		t.Errorf("GetAndTouch returned wrong item: %+v", it)
+	}
+}
+
+func TestStorageCommands(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	item := &Item{Key: "foo", Value: []byte("b")}
+
+	if err := c.Replace(ctx, item); err != ErrNotStored {
+		t.Errorf("Replace of missing key = %v, want %v",
+			err, ErrNotStored)
+	}
+	if err := c.Append(ctx, item); err != ErrNotStored {
+		t.Errorf("Append to missing key = %v, want %v",
+			err, ErrNotStored)
+	}
+	if err := c.Add(ctx, item); err != nil {
+		t.Errorf("Add: %s", err)
+	}
+	if err := c.Add(ctx, item); err != ErrNotStored {
+		t.Errorf("Add of existing key = %v, want %v", err, ErrNotStored)
+	}
+	if err := c.Append(ctx, &Item{Key: "foo", Value: []byte("c")}); err != nil {
+		t.Errorf("Append: %s", err)
+	}
+	if err := c.Prepend(ctx, &Item{Key: "foo", Value: []byte("a")}); err != nil {
+		t.Errorf("Prepend: %s", err)
+	}
+
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(it.Value) != "abc" {
+		t.Errorf("Value is %q, want abc", it.Value)
+	}
+
+	it.Value = []byte("cas")
+	if err := c.CompareAndSwap(ctx, it); err != nil {
+		t.Errorf("CompareAndSwap: %s", err)
+	}
+	if err := c.CompareAndSwap(ctx, it); err != ErrCASConflict {
+		t.Errorf("Second CompareAndSwap = %v, want %v",
+			err, ErrCASConflict)
+	}
+
+	if err := c.Touch(ctx, "foo", 100); err != nil {
+		t.Errorf("Touch: %s", err)
+	}
+	if err := c.Delete(ctx, "foo"); err != nil {
+		t.Errorf("Delete: %s", err)
+	}
+	if err := c.Delete(ctx, "foo"); err != ErrCacheMiss {
+		t.Errorf("Delete of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+	if err := c.Touch(ctx, "foo", 100); err != ErrCacheMiss {
+		t.Errorf("Touch of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	if _, err := c.Increment(ctx, "n", 1); err != ErrCacheMiss {
+		t.Errorf("Increment of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+
+	if err := c.Set(ctx, &Item{Key: "n", Value: []byte("10")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	if v, err := c.Increment(ctx, "n", 5); err != nil || v != 15 {
+		t.Errorf("Increment = %d, %v, want 15", v, err)
+	}
+	if v, err := c.Decrement(ctx, "n", 20); err != nil || v != 0 {
+		t.Errorf("Decrement = %d, %v, want 0", v, err)
+	}
+
+	if err := c.Set(ctx, &Item{Key: "s", Value: []byte("x")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if _, err := c.Increment(ctx, "s", 1); !errors.Is(err, ErrClientError) {
+		t.Errorf("Increment of non-number = %v, want %v",
+			err, ErrClientError)
+	}
+}
+
+func TestMalformedKey(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	for _, key := range []string{"", "with space", "new\nline"} {
+		if _, err := c.Get(ctx, key); err != ErrMalformedKey {
+			t.Errorf("Get(%q) = %v, want %v",
+				key, err, ErrMalformedKey)
+		}
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c, servers := newTestClient(t, 4)
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+
+		if i%2 == 0 {
+			continue
+		}
+
+		err := c.Set(ctx, &Item{Key: key, Value: []byte(key)})
+		if err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+
+	for i, s := range servers {
+		if s.Len() == 0 {
+			t.Errorf("Server %d holds no items", i)
+		}
+	}
+
+	items, err := c.GetMulti(ctx, keys)
+	if err != nil {
+		t.Fatalf("GetMulti: %s", err)
+	}
+	if len(items) != 50 {
+		t.Errorf("GetMulti returned %d items, want 50", len(items))
+	}
+	for key, it := range items {
+		if string(it.Value) != key {
+			t.Errorf("%s holds %q", key, it.Value)
+		}
+	}
+
+	for i, s := range servers {
+		if n := s.Commands("gets"); n != 1 {
+			t.Errorf("Server %d got %d gets, want 1", i, n)
+		}
+	}
+}
+
+func TestGetMultiPartial(t *testing.T) {
+	c, servers := newTestClient(t, 2)
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		c.Set(ctx, &Item{Key: key, Value: []byte(key)})
+	}
+	servers[1].Close()
+
+	items, err := c.GetMulti(ctx, keys)
+	if err == nil {
+		t.Fatalf("GetMulti succeeded with dead server")
+	}
+	if n := servers[0].Len(); len(items) != n || n == 0 {
+		t.Errorf("GetMulti returned %d items, want %d of the live server",
+			len(items), n)
+	}
+	for key := range items {
+		if _, ok := servers[0].Item(key); !ok {
+			t.Errorf("GetMulti returned %q not held by the live server",
+				key)
+		}
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	c, servers := newTestClient(t, 3)
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("Ping: %s", err)
+	}
+
+	versions, err := c.Version(ctx)
+	if err != nil {
+		t.Fatalf("Version: %s", err)
+	}
+	if len(versions) != 3 {
+		t.Errorf("Got %d versions, want 3", len(versions))
+	}
+
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("x")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %s", err)
+	}
+	items := 0
+	for _, s := range stats {
+		if s["curr_items"] == "1" {
+			items++
+		}
+	}
+	if items != 1 {
+		t.Errorf("Item found on %d servers, want 1", items)
+	}
+
+	if err := c.FlushAll(ctx); err != nil {
+		t.Fatalf("FlushAll: %s", err)
+	}
+	for i, s := range servers {
+		if s.Len() != 0 {
+			t.Errorf("Server %d is not empty after FlushAll", i)
+		}
+	}
+}
+
+func TestIncompleteResponse(t *testing.T) {
+	cb := func(*Item) {}
+
+	err := textGet(replay("SERVER_ERROR out of memory\r\n"),
+		"gets", "", []string{"a"}, cb)
+	if !errors.Is(err, ErrServerError) || !resumableError(err) {
+		t.Errorf("Single key get = %v, want resumable server error", err)
+	}
+
+	err = textGet(replay("SERVER_ERROR out of memory\r\n"),
+		"gets", "", []string{"a", "b"}, cb)
+	if !errors.Is(err, ErrServerError) || resumableError(err) {
+		t.Errorf("Multi key get = %v, want incomplete server error", err)
+	}
+
+	_, err = textStats(replay("STAT pid 1\r\nSERVER_ERROR failed\r\n"))
+	if !errors.Is(err, ErrServerError) || resumableError(err) {
+		t.Errorf("stats = %v, want incomplete server error", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	c.MaxConns = 2
+	ctx := context.Background()
+
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("x")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	addr, _ := c.selector.PickServer("foo")
+	p := c.pools.get(addr, c.MaxConns, c.maxIdleConns())
+
+	var max int
+	var m sync.Mutex
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				if _, err := c.Get(ctx, "foo"); err != nil {
+					t.Errorf("Get: %s", err)
+				}
+
+				m.Lock()
+				if n := len(p.slots); n > max {
+					max = n
+				}
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max > 2 {
+		t.Errorf("%d connections were open at once", max)
+	}
+}
+
+func TestPoolsOfRemovedServersClosed(t *testing.T) {
+	c, servers := newTestClient(t, 2)
+	k := c.selector.(*ketama.Ketama)
+
+	var pools []*pool
+	for _, s := range servers {
+		pools = append(pools, c.pools.get(s.Addr(), 0, 1))
+	}
+
+	k.SetServersAddr([]net.Addr{servers[0].Addr()})
+	if n := len(c.pools.pools); n != 1 {
+		t.Errorf("Client holds %d pools, want 1", n)
+	}
+	if pools[0].closed || !pools[1].closed {
+		t.Errorf("Wrong pool was closed")
+	}
+
+	// New credentials need new connections.
+	k.SetServers([]ketama.Server{{Addr: servers[0].Addr(), Username: "u"}})
+	if !pools[0].closed {
+		t.Errorf("Pool of changed server was not closed")
+	}
+
+	c.Close()
+	c.pools.get(servers[0].Addr(), 0, 1)
+	k.SetServersAddr([]net.Addr{servers[1].Addr()})
+	if n := len(c.pools.pools); n != 1 {
+		t.Errorf("Closed client still follows the server list")
+	}
+}
+
+func TestRouterPoolsOfRemovedServersClosed(t *testing.T) {
+	servers := newTestServers(t, 2)
+	pool := func(s *memcachetest.Server) router.Pool {
+		return router.Pool{
+			Name:    s.Addr().String(),
+			Servers: []ketama.Server{{Addr: s.Addr()}},
+		}
+	}
+
+	r := &router.Router{}
+	r.SetPools([]router.Pool{pool(servers[0]), pool(servers[1])}, "")
+	c := New(r)
+	t.Cleanup(func() { c.Close() })
+
+	removed := c.pools.get(servers[1].Addr(), 0, 1)
+	r.SetPools([]router.Pool{pool(servers[0])}, "")
+	if !removed.closed {
+		t.Errorf("Pool of server removed from the router was not closed")
+	}
+}
+
+func TestMaxConnsWaitHonoursContext(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	c.MaxConns = 1
+
+	addr, _ := c.selector.PickServer("foo")
+	p := c.pools.get(addr, c.MaxConns, c.maxIdleConns())
+
+	// Take the only slot.
+	if err := p.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire: %s", err)
+	}
+	defer p.free()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		50*time.Millisecond,
+	)
+	defer cancel()
+
+	_, err := c.Get(ctx, "foo")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Get = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// Accept connections but never answer.
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	k := &ketama.Ketama{}
+	k.SetServersAddr([]net.Addr{ln.Addr()})
+	c := New(k)
+	c.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err = c.Get(context.Background(), "foo")
+	if err == nil {
+		t.Fatalf("Get from stalled server succeeded")
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("Get = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Get took %s", d)
+	}
+}
+
+// metricsFunc calls itself for every observed request.
+type metricsFunc func(addr net.Addr, op string)
+
+func (f metricsFunc) ObserveRequest(
+	addr net.Addr,
+	op string,
+	d time.Duration,
+	err error,
+) {
+	f(addr, op)
+}
+
+func TestLoadReporting(t *testing.T) {
+	servers := newTestServers(t, 1)
+
+	k := &ketama.Ketama{}
+	k.SetServersAddr([]net.Addr{servers[0].Addr()})
+	b, err := ketama.NewBoundedLoad(k, 0.25)
+	if err != nil {
+		t.Fatalf("NewBoundedLoad: %s", err)
+	}
+
+	c := New(b)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+
+	var load int64
+	c.Metrics = metricsFunc(func(addr net.Addr, op string) {
+		load = b.Load(addr)
+	})
+
+	c.Set(context.Background(), &Item{Key: "foo", Value: []byte("bar")})
+	if load != 1 {
+		t.Errorf("Load during request = %d, want 1", load)
+	}
+	if n := b.Load(servers[0].Addr()); n != 0 {
+		t.Errorf("Load after request = %d, want 0", n)
+	}
+}
+
+func TestReplicatedMutations(t *testing.T) {
+	servers := newTestServers(t, 3)
+
+	zones := []string{"a", "b", "c"}
+	list := make([]ketama.Server, len(servers))
+	for i, s := range servers {
+		list[i] = ketama.Server{Addr: s.Addr(), Zone: zones[i]}
+	}
+
+	k := &ketama.Ketama{}
+	if err := k.SetServers(list); err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+	z := ketama.NewZoneAware(k, "b", 3)
+
+	c := New(z)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+	ctx := context.Background()
+
+	err := c.Set(ctx, &Item{Key: "counter", Value: []byte("1")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if v, err := c.Increment(ctx, "counter", 2); err != nil || v != 3 {
+		t.Errorf("Increment = %d, %v, want 3", v, err)
+	}
+	for i, s := range servers {
+		if it, _ := s.Item("counter"); string(it.Value) != "3" {
+			t.Errorf("Server %d has %q, want 3", i, it.Value)
+		}
+	}
+
+	it, err := c.GetAndTouch(ctx, "counter", 100)
+	if err != nil || string(it.Value) != "3" {
+		t.Fatalf("GetAndTouch = %v, %v, want the item", it, err)
+	}
+	for i, s := range servers {
+		if it, _ := s.Item("counter"); it.Expires.IsZero() {
+			t.Errorf("Server %d did not touch the item", i)
+		}
+	}
+
+	it.Value = []byte("4")
+	if err := c.CompareAndSwap(ctx, it); err != ErrReplicated {
+		t.Errorf("CompareAndSwap = %v, want %v", err, ErrReplicated)
+	}
+	_, err = c.MetaSet(ctx, &Item{Key: "counter"}, MetaSetOptions{})
+	if err != ErrReplicated {
+		t.Errorf("MetaSet = %v, want %v", err, ErrReplicated)
+	}
+	_, err = c.MetaGet(ctx, "counter", MetaGetOptions{})
+	if err != nil {
+		t.Errorf("MetaGet = %v, want read to succeed", err)
+	}
+}
+
+func TestReplicatedWrites(t *testing.T) {
+	servers := newTestServers(t, 3)
+
+	zones := []string{"a", "b", "c"}
+	list := make([]ketama.Server, len(servers))
+	for i, s := range servers {
+		list[i] = ketama.Server{Addr: s.Addr(), Zone: zones[i]}
+	}
+
+	k := &ketama.Ketama{}
+	if err := k.SetServers(list); err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+	z := ketama.NewZoneAware(k, "b", 2)
+
+	c := New(z)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		err := c.Set(ctx, &Item{Key: key, Value: []byte("x")})
+		if err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+
+		replicas, _ := z.PickReplicas(key)
+		stored := 0
+		for _, s := range servers {
+			if _, ok := s.Item(key); ok {
+				stored++
+			}
+		}
+		if stored != len(replicas) {
+			t.Errorf("%q stored on %d servers, want %d",
+				key, stored, len(replicas))
+		}
+
+		read, _ := z.PickServer(key)
+		before := make([]int, len(servers))
+		for i, s := range servers {
+			before[i] = s.Commands("gets")
+		}
+		if _, err := c.Get(ctx, key); err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		for i, s := range servers {
+			asked := s.Commands("gets") - before[i]
+			if want := s.Addr() == read; (asked == 1) != want {
+				t.Errorf("Server %d asked %d times for %q", i, asked, key)
+			}
+		}
+
+		if err := c.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		for i, s := range servers {
+			if _, ok := s.Item(key); ok {
+				t.Errorf("%q not deleted from server %d", key, i)
+			}
+		}
+	}
+}
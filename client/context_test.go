@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// stalledServer accepts connections, reads (and discards) the requests if
+// read is true, and never answers.
+type stalledServer struct {
+	ln     net.Listener
+	closed chan struct{}
+}
+
+func newStalledServer(t *testing.T, read bool) *stalledServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+
+	s := &stalledServer{
+		ln:     ln,
+		closed: make(chan struct{}, 16),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+
+			go func() {
+				buf := make([]byte, 4096)
+				for read {
+					if _, err := c.Read(buf); err != nil {
+						s.closed <- struct{}{}
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return s
+}
+
+func newStalledClient(t *testing.T, s *stalledServer) *Client {
+	k := &ketama.Ketama{}
+	k.SetServersAddr([]net.Addr{s.ln.Addr()})
+
+	c := New(k)
+	c.Timeout = 10 * time.Second
+	return c
+}
+
+// cancelAfter returns context cancelled after d.
+func cancelAfter(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	time.AfterFunc(d, cancel)
+	return ctx
+}
+
+func expectCancelled(t *testing.T, start time.Time, err error) {
+	if err != context.Canceled {
+		t.Errorf("Got %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Cancellation took %s", d)
+	}
+}
+
+func TestCancelDuringRead(t *testing.T) {
+	s := newStalledServer(t, true)
+	c := newStalledClient(t, s)
+
+	start := time.Now()
+	_, err := c.Get(cancelAfter(t, 50*time.Millisecond), "foo")
+	expectCancelled(t, start, err)
+
+	select {
+	case <-s.closed:
+	case <-time.After(time.Second):
+		t.Errorf("Interrupted connection was not closed")
+	}
+}
+
+func TestCancelDuringWrite(t *testing.T) {
+	s := newStalledServer(t, false)
+	c := newStalledClient(t, s)
+
+	// Large enough to fill socket buffers of both sides.
+	item := &Item{Key: "foo", Value: make([]byte, 64<<20)}
+
+	start := time.Now()
+	err := c.Set(cancelAfter(t, 50*time.Millisecond), item)
+	expectCancelled(t, start, err)
+}
+
+func TestCancelDuringDial(t *testing.T) {
+	s := newStalledServer(t, true)
+	c := newStalledClient(t, s)
+
+	dialing := make(chan struct{})
+	c.Dial = func(ctx context.Context, addr net.Addr) (net.Conn, error) {
+		close(dialing)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-dialing
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := c.Get(ctx, "foo")
+	expectCancelled(t, start, err)
+}
+
+func TestCancelGetMulti(t *testing.T) {
+	s := newStalledServer(t, true)
+	c := newStalledClient(t, s)
+
+	start := time.Now()
+	_, err := c.GetMulti(
+		cancelAfter(t, 50*time.Millisecond),
+		[]string{"foo", "bar", "baz"},
+	)
+	expectCancelled(t, start, err)
+}
+
+func TestCancelledBeforeStart(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	err := c.Delete(ctx, "foo")
+	expectCancelled(t, start, err)
+}
+
+func TestConnReusableAfterRequest(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		if _, err := c.Get(ctx, "foo"); err != ErrCacheMiss {
+			t.Fatalf("Get = %v, want %v", err, ErrCacheMiss)
+		}
+	}
+
+	addr, _ := c.selector.PickServer("foo")
+	p := c.pools.get(addr, c.MaxConns, c.maxIdleConns())
+	if n := len(p.idle); n != 1 {
+		t.Errorf("%d idle connections, want 1", n)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Package client provides memcached client speaking the text or the binary
+protocol, designed to be used with ketama.Ketama (or any other Selector) for
+server selection.
+
+Compared to github.com/bradfitz/gomemcache/memcache it keeps bounded pool of
+connections per server and every operation takes context.Context, which limits
+how long the operation (including dialing and waiting for free connection) can
+take. Cancelling the context interrupts the operation in whatever phase it is
+(waiting for connection, dialing, writing the request or reading the response)
+and the operation returns ctx.Err(). Connection interrupted in the middle of
+a request is closed, not returned to the pool. Pools of servers removed from
+the selector's list or with changed settings are closed, if the selector
+announces the changes (see ketama.Ketama.Subscribe and
+router.Router.Subscribe).
+
+The binary protocol (see Client.Protocol) additionally supports SASL PLAIN
+authentication, with credentials set either on the Client or per server in
+ketama.Server. Rejected credentials are reported as *AuthError and, as other
+failures, are reflected in the server's Health. GetMulti pipelines quiet gets
+terminated by noop, so each server is asked in a single round trip.
+
+Connections can use TLS, configured either on the Client (TLSConfig) or per
+server in ketama.Server.
+
+Latency and result of every operation on every server can be observed through
+the Metrics interface. ExpvarMetrics implements it using expvar, with request
+counts, errors by kind, timeouts and latency histograms of each server.
+
+Selectors balancing by load, like ketama.BoundedLoad, are told about every
+request to a server in flight through their Acquire and Release methods.
+With selectors keeping replicas, like ketama.ZoneAware, Set, Add, Replace,
+Append, Prepend, Delete, Touch, GetAndTouch, Increment and Decrement go to
+all replicas of the key, reads to the one replica picked by PickServer.
+CompareAndSwap and the meta commands changing the item return ErrReplicated,
+CAS values differ between the replicas.
+
+When the selector remembers the previous server list for a while after
+a change (see ketama.Ketama.SetTransitionWindow), Get, GetMulti,
+GetAndTouch, MetaGet and MetaGetMulti retry misses on the previous owner of
+the key and, with CopyForward, copy the item found there to the new owner.
+Meta gets changing the item are not retried, the previous owner only serves
+reads.
+
+With the text protocol the meta commands of memcached 1.6 are available as
+MetaGet, MetaGetMulti, MetaSet, MetaDelete and MetaArithmetic. They return
+item's metadata (remaining TTL, last access, CAS) and implement
+stale-while-revalidate: a client which gets Won set in MetaItem is the only
+one expected to recompute the value, others keep using the stale one.
+
+Usage could look something like this:
+
+	k := &ketama.Ketama{}
+	k.SetServersAddr([]net.Addr{&net.TCPAddr{
+		IP: net.ParseIP("127.0.0.1"),
+		Port: 11211,
+	}})
+
+	c := client.New(k)
+	c.MaxConns = 16
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fmt.Println(c.Get(ctx, "some-key"))
+*/
+package client
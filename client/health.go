@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Health describes health of single server as seen by the client.
+type Health struct {
+	// Requests is the number of operations sent to the server.
+	Requests uint64
+	// Failures is the number of operations which failed on network,
+	// protocol, server, authentication or timeout errors. Cache misses,
+	// CAS conflicts and items not stored are not failures, neither are
+	// operations cancelled by the caller.
+	Failures uint64
+	// AuthFailures is the number of failures caused by the server
+	// rejecting the credentials.
+	AuthFailures uint64
+	// ConsecutiveFailures is the number of failures since the last
+	// successful operation.
+	ConsecutiveFailures uint64
+	// LastError is the error of the last failure.
+	LastError error
+}
+
+// Healthy reports whether the last operation with the server succeeded.
+func (h Health) Healthy() bool {
+	return h.ConsecutiveFailures == 0
+}
+
+// healths holds Health of each server.
+type healths struct {
+	servers map[string]*Health
+	m       sync.Mutex
+}
+
+func (hs *healths) record(addr net.Addr, err error) {
+	if err == context.Canceled {
+		return
+	}
+
+	hs.m.Lock()
+	defer hs.m.Unlock()
+
+	if hs.servers == nil {
+		hs.servers = make(map[string]*Health)
+	}
+
+	h, ok := hs.servers[poolKey(addr)]
+	if !ok {
+		h = &Health{}
+		hs.servers[poolKey(addr)] = h
+	}
+
+	h.Requests++
+	if succeeded(err) {
+		h.ConsecutiveFailures = 0
+		return
+	}
+
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastError = err
+	if errors.Is(err, ErrAuthFailed) {
+		h.AuthFailures++
+	}
+}
+
+// succeeded reports whether err, returned by an operation, means the server
+// works. Unlike resumableError, SERVER_ERROR is a failure: the connection is
+// fine, the server is not.
+func succeeded(err error) bool {
+	switch err {
+	case nil, ErrCacheMiss, ErrCASConflict, ErrNotStored:
+		return true
+	}
+	return false
+}
+
+func (hs *healths) get(addr net.Addr) Health {
+	hs.m.Lock()
+	defer hs.m.Unlock()
+
+	if h, ok := hs.servers[poolKey(addr)]; ok {
+		return *h
+	}
+	return Health{}
+}
+
+// Health returns health of server addr. Safe to call from multiple goroutines
+// at once.
+func (c *Client) Health(addr net.Addr) Health {
+	return c.health.get(addr)
+}
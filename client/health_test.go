@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	c, servers := newTestClient(t, 1)
+	addr := servers[0].Addr()
+	ctx := context.Background()
+
+	if h := c.Health(addr); h.Requests != 0 || !h.Healthy() {
+		t.Errorf("Health of unused server: %+v", h)
+	}
+
+	// Cache misses are not failures.
+	c.Get(ctx, "foo")
+	c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")})
+	if h := c.Health(addr); h.Requests != 2 || h.Failures != 0 {
+		t.Errorf("Health after successful requests: %+v", h)
+	}
+
+	servers[0].Close()
+	c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(ctx, "foo"); err == nil {
+			t.Fatalf("Get from closed server succeeded")
+		}
+	}
+
+	h := c.Health(addr)
+	if h.Failures != 2 || h.ConsecutiveFailures != 2 || h.Healthy() {
+		t.Errorf("Health after failures: %+v", h)
+	}
+	if h.LastError == nil || h.AuthFailures != 0 {
+		t.Errorf("Health after failures: %+v", h)
+	}
+}
+
+func TestHealthIgnoresCancellation(t *testing.T) {
+	s := newStalledServer(t, true)
+	c := newStalledClient(t, s)
+
+	c.Get(cancelAfter(t, 10*time.Millisecond), "foo")
+
+	if h := c.Health(s.ln.Addr()); h.Requests != 0 || h.Failures != 0 {
+		t.Errorf("Cancelled request changed health: %+v", h)
+	}
+}
+
+func TestHealthServerError(t *testing.T) {
+	var hs healths
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11211}
+	err := fmt.Errorf("%w: out of memory", ErrServerError)
+
+	hs.record(addr, err)
+	hs.record(addr, ErrCacheMiss)
+	hs.record(addr, err)
+
+	h := hs.get(addr)
+	if h.Requests != 3 || h.Failures != 2 || h.ConsecutiveFailures != 1 {
+		t.Errorf("Health after server errors: %+v", h)
+	}
+	if h.LastError != err {
+		t.Errorf("LastError = %v, want %v", h.LastError, err)
+	}
+}
@@ -0,0 +1,674 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetaItem is an item returned by the meta commands, together with its
+// metadata.
+type MetaItem struct {
+	Item
+
+	// TTL is the remaining time to live in seconds, -1 if the item does
+	// not expire.
+	TTL int32
+	// LastAccess is the number of seconds since the item was last
+	// accessed.
+	LastAccess int32
+	// Hit is true if the item was fetched before.
+	Hit bool
+
+	// Won is true if this client got the right to recompute the value
+	// (the item was just vivified, is stale or its TTL dropped under
+	// Recache). Other clients get WinPending until the item is set again.
+	Won bool
+	// WinPending is true if some other client already won the right to
+	// recompute the value.
+	WinPending bool
+	// Stale is true if the item was invalidated (see MetaDeleteOptions).
+	Stale bool
+}
+
+// maxRelativeExpiration is the longest expiration, in seconds, memcached takes
+// as relative to now. Longer ones are absolute Unix times.
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+// TTLExpiration returns Expiration storing the item again with its remaining
+// TTL: 0 for items which do not expire, absolute Unix time for TTLs longer
+// than 30 days, which memcached would take as such.
+func (it *MetaItem) TTLExpiration() int32 {
+	switch {
+	case it.TTL < 0:
+		return 0
+	case it.TTL > maxRelativeExpiration:
+		return int32(time.Now().Unix()) + it.TTL
+	}
+	return it.TTL
+}
+
+// MetaGetOptions are options of MetaGet and MetaGetMulti.
+type MetaGetOptions struct {
+	// NoValue makes the server send only the metadata, not the value.
+	NoValue bool
+	// Vivify, when not zero, makes the server create an empty item with
+	// this TTL on miss (the N flag). The client gets Won set and is
+	// expected to set the real value, others see WinPending meanwhile.
+	Vivify int32
+	// Recache, when not zero, makes the client win recache when
+	// remaining TTL of the item is lower than Recache seconds (the R
+	// flag).
+	Recache int32
+	// UpdateTTL makes the server update the TTL of the item to TTL (the
+	// T flag).
+	UpdateTTL bool
+	TTL       int32
+	// Base64Key makes the key binary. It is sent base64 encoded (the b
+	// flag), server selection still uses the key itself.
+	Base64Key bool
+}
+
+// mutates reports whether mg with the options changes the item.
+func (o *MetaGetOptions) mutates() bool {
+	return o.Vivify != 0 || o.Recache != 0 || o.UpdateTTL
+}
+
+func (o *MetaGetOptions) flags() []string {
+	// Metadata is always requested, it costs few bytes only.
+	flags := []string{"f", "c", "t", "l", "h"}
+	if !o.NoValue {
+		flags = append(flags, "v")
+	}
+	if o.Vivify != 0 {
+		flags = append(flags, "N"+formatInt(int64(o.Vivify)))
+	}
+	if o.Recache != 0 {
+		flags = append(flags, "R"+formatInt(int64(o.Recache)))
+	}
+	if o.UpdateTTL {
+		flags = append(flags, "T"+formatInt(int64(o.TTL)))
+	}
+	if o.Base64Key {
+		flags = append(flags, "b")
+	}
+	return flags
+}
+
+// MetaSetMode is the mode of MetaSet.
+type MetaSetMode byte
+
+const (
+	// MetaSetModeSet stores the item unconditionally. It is the default.
+	MetaSetModeSet MetaSetMode = 'S'
+	// MetaSetModeAdd stores the item only if it does not exist.
+	MetaSetModeAdd MetaSetMode = 'E'
+	// MetaSetModeReplace stores the item only if it exists.
+	MetaSetModeReplace MetaSetMode = 'R'
+	// MetaSetModeAppend appends the value to the existing item.
+	MetaSetModeAppend MetaSetMode = 'A'
+	// MetaSetModePrepend prepends the value to the existing item.
+	MetaSetModePrepend MetaSetMode = 'P'
+)
+
+// MetaSetOptions are options of MetaSet.
+type MetaSetOptions struct {
+	Mode MetaSetMode
+	// Invalidate, together with non-zero CAS of the item, makes the
+	// server store the item even when the CAS is older than the stored
+	// one, but mark it stale (the I flag).
+	Invalidate bool
+	// Base64Key, see MetaGetOptions.
+	Base64Key bool
+}
+
+// MetaDeleteOptions are options of MetaDelete.
+type MetaDeleteOptions struct {
+	// CAS, when not zero, makes the delete conditional.
+	CAS uint64
+	// Invalidate makes the server mark the item stale instead of
+	// deleting it (the I flag). Next MetaGet wins the recache while
+	// others keep getting the stale value.
+	Invalidate bool
+	// UpdateTTL makes the server update the TTL of the invalidated item
+	// to TTL.
+	UpdateTTL bool
+	TTL       int32
+	// Base64Key, see MetaGetOptions.
+	Base64Key bool
+}
+
+// MetaArithmeticOptions are options of MetaArithmetic.
+type MetaArithmeticOptions struct {
+	// Decrement decrements the value instead of incrementing it.
+	Decrement bool
+	// Delta is the amount to add or subtract. Zero means one.
+	Delta uint64
+	// Vivify, when not zero, makes the server create missing item with
+	// value Initial and this TTL (the N flag).
+	Vivify  int32
+	Initial uint64
+	// CAS, when not zero, makes the operation conditional.
+	CAS uint64
+	// UpdateTTL makes the server update the TTL of the item to TTL.
+	UpdateTTL bool
+	TTL       int32
+	// Base64Key, see MetaGetOptions.
+	Base64Key bool
+}
+
+// metaKey returns key as sent to the server.
+func metaKey(key string, b64 bool) (string, error) {
+	if !b64 {
+		if !legalKey(key) {
+			return "", ErrMalformedKey
+		}
+		return key, nil
+	}
+
+	if len(key) == 0 {
+		return "", ErrMalformedKey
+	}
+	enc := base64.StdEncoding.EncodeToString([]byte(key))
+	if len(enc) > 250 {
+		return "", ErrMalformedKey
+	}
+	return enc, nil
+}
+
+// withMetaKey calls fn with connection to the server of key and the key as
+// sent over the wire. Commands which change the item are not supported with
+// replicas, ErrReplicated is returned for them.
+func (c *Client) withMetaKey(
+	ctx context.Context,
+	op string,
+	key string,
+	b64 bool,
+	mutates bool,
+	fn func(cn *conn, key string) error,
+) error {
+	if c.Protocol != Text {
+		return ErrMetaUnsupported
+	}
+	if mutates && c.replicated() {
+		return ErrReplicated
+	}
+
+	wireKey, err := metaKey(key, b64)
+	if err != nil {
+		return err
+	}
+
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+
+	return c.withAddr(ctx, op, addr, func(cn *conn) error {
+		return fn(cn, wireKey)
+	})
+}
+
+// metaReply is parsed response of meta command.
+type metaReply struct {
+	code  string
+	flags []string
+	value []byte
+}
+
+// flag returns token of flag.
+func (r *metaReply) flag(flag byte) (string, bool) {
+	for _, f := range r.flags {
+		if f[0] == flag {
+			return f[1:], true
+		}
+	}
+	return "", false
+}
+
+// readMetaReply reads single response of meta command verb.
+func readMetaReply(r *bufio.Reader, verb string) (*metaReply, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f := strings.Fields(string(line))
+	if len(f) == 0 || len(f[0]) != 2 {
+		return nil, unexpected(verb, line)
+	}
+	reply := &metaReply{code: f[0], flags: f[1:]}
+
+	if reply.code == "VA" {
+		if len(f) < 2 {
+			return nil, unexpected(verb, line)
+		}
+		size, err := strconv.Atoi(f[1])
+		if err != nil || size < 0 {
+			return nil, unexpected(verb, line)
+		}
+		reply.flags = f[2:]
+
+		reply.value = make([]byte, size+2)
+		if _, err := io.ReadFull(r, reply.value); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(reply.value, crlf) {
+			return nil, fmt.Errorf("%w: corrupt %s result read",
+				ErrProtocol, verb)
+		}
+		reply.value = reply.value[:size]
+	}
+
+	for _, flag := range reply.flags {
+		if flag == "" {
+			return nil, unexpected(verb, line)
+		}
+	}
+	return reply, nil
+}
+
+// err maps negative response codes to errors.
+func (r *metaReply) err(verb string) error {
+	switch r.code {
+	case "HD", "VA", "MN":
+		return nil
+	case "EN", "NF":
+		return ErrCacheMiss
+	case "NS":
+		return ErrNotStored
+	case "EX":
+		return ErrCASConflict
+	}
+	return fmt.Errorf("%w: unexpected response code from %s: %q",
+		ErrProtocol, verb, r.code)
+}
+
+// item returns MetaItem built from response of mg.
+func (r *metaReply) item(key string) (*MetaItem, error) {
+	it := &MetaItem{Item: Item{Key: key, Value: r.value}}
+
+	for _, f := range r.flags {
+		var err error
+		var v int64
+		switch f[0] {
+		case 'f':
+			v, err = strconv.ParseInt(f[1:], 10, 64)
+			it.Flags = uint32(v)
+		case 'c':
+			it.CAS, err = strconv.ParseUint(f[1:], 10, 64)
+		case 't':
+			v, err = strconv.ParseInt(f[1:], 10, 32)
+			it.TTL = int32(v)
+		case 'l':
+			v, err = strconv.ParseInt(f[1:], 10, 32)
+			it.LastAccess = int32(v)
+		case 'h':
+			it.Hit = f[1:] == "1"
+		case 'W':
+			it.Won = true
+		case 'Z':
+			it.WinPending = true
+		case 'X':
+			it.Stale = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid mg flag %q",
+				ErrProtocol, f)
+		}
+	}
+	return it, nil
+}
+
+// MetaGet gets the item for the given key together with its metadata.
+// ErrCacheMiss is returned for a memcache cache miss (unless the item is
+// vivified). During a transition window a miss is retried on the previous
+// owner, like in Get, unless opts change the item.
+func (c *Client) MetaGet(
+	ctx context.Context,
+	key string,
+	opts MetaGetOptions,
+) (*MetaItem, error) {
+	var item *MetaItem
+	var addr net.Addr
+	var wireKey string
+	err := c.withMetaKey(ctx, "meta_get", key, opts.Base64Key, opts.mutates(),
+		func(cn *conn, wk string) (err error) {
+			addr, wireKey = cn.addr, wk
+			item, err = metaGet(cn, key, wireKey, opts)
+			return err
+		})
+	if tp, ok := c.selector.(transitionPicker); ok && err == ErrCacheMiss {
+		from := map[string]net.Addr{key: addr}
+		wireKeys := map[string]string{key: wireKey}
+		found := c.metaGetPrevious(ctx, tp, from, wireKeys, opts)
+		if it := found[key]; it != nil {
+			return it, nil
+		}
+	}
+	return item, err
+}
+
+// metaGet gets key, sent as wireKey, over cn.
+func metaGet(
+	cn *conn,
+	key string,
+	wireKey string,
+	opts MetaGetOptions,
+) (*MetaItem, error) {
+	words := append([]string{"mg", wireKey}, opts.flags()...)
+	if err := writeCommand(cn.rw, words...); err != nil {
+		return nil, err
+	}
+
+	reply, err := readMetaReply(cn.rw.Reader, "mg")
+	if err != nil {
+		return nil, err
+	}
+	if err := reply.err("mg"); err != nil {
+		return nil, err
+	}
+
+	return reply.item(key)
+}
+
+// MetaGetMulti is a batch version of MetaGet. The returned map from keys to
+// items may have fewer elements than the input slice, due to memcache cache
+// misses. Requests for each server are pipelined: quiet mg commands tagged by
+// opaques, terminated by mn. As with GetMulti, when some servers fail the map
+// holds the items of the others, together with the first error, and misses
+// are retried on previous owners during a transition window, unless opts
+// change the items.
+func (c *Client) MetaGetMulti(
+	ctx context.Context,
+	keys []string,
+	opts MetaGetOptions,
+) (map[string]*MetaItem, error) {
+	if c.Protocol != Text {
+		return nil, ErrMetaUnsupported
+	}
+	if opts.mutates() && c.replicated() {
+		return nil, ErrReplicated
+	}
+
+	wireKeys := make(map[string]string, len(keys))
+	for _, key := range keys {
+		wireKey, err := metaKey(key, opts.Base64Key)
+		if err != nil {
+			return nil, err
+		}
+		wireKeys[key] = wireKey
+	}
+
+	groups, err := c.groupKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var m sync.Mutex
+	items := make(map[string]*MetaItem)
+	missed := make(map[string]net.Addr)
+	add := func(it *MetaItem) {
+		m.Lock()
+		items[it.Key] = it
+		m.Unlock()
+	}
+	flags := append(opts.flags(), "q")
+
+	errs := make(chan error, len(groups))
+	for addr, keys := range groups {
+		go func(addr net.Addr, keys []string) {
+			get := func(cn *conn) error {
+				return metaGetPipeline(cn.rw, keys, wireKeys, flags, add)
+			}
+			e := c.withAddr(ctx, "meta_get_multi", addr, get)
+			if e == nil {
+				m.Lock()
+				for _, key := range keys {
+					if items[key] == nil {
+						missed[key] = addr
+					}
+				}
+				m.Unlock()
+			}
+			errs <- e
+		}(addr, keys)
+	}
+
+	for range groups {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if tp, ok := c.selector.(transitionPicker); ok && len(missed) > 0 {
+		found := c.metaGetPrevious(ctx, tp, missed, wireKeys, opts)
+		for key, it := range found {
+			items[key] = it
+		}
+	}
+	return items, err
+}
+
+// metaGetPipeline sends mg with flags for each of keys, tagged by opaque
+// holding index of the key, terminated by mn. cb is called with every item
+// found.
+func metaGetPipeline(
+	rw *bufio.ReadWriter,
+	keys []string,
+	wireKeys map[string]string,
+	flags []string,
+	cb func(*MetaItem),
+) error {
+	for i, key := range keys {
+		words := append([]string{"mg", wireKeys[key]}, flags...)
+		words = append(words, "O"+strconv.Itoa(i))
+		if err := writeLine(rw.Writer, words...); err != nil {
+			return err
+		}
+	}
+	if err := writeCommand(rw, "mn"); err != nil {
+		return err
+	}
+
+	var serverErr error
+	for {
+		reply, err := readMetaReply(rw.Reader, "mg")
+		if errors.Is(err, ErrServerError) {
+			// Responses to the other keys follow, read them up to MN
+			// so the connection can be reused.
+			if serverErr == nil {
+				serverErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if reply.code == "MN" {
+			return serverErr
+		}
+		if err := reply.err("mg"); err != nil {
+			return err
+		}
+
+		opaque, _ := reply.flag('O')
+		i, err := strconv.Atoi(opaque)
+		if err != nil || i < 0 || i >= len(keys) {
+			return fmt.Errorf("%w: invalid opaque %q", ErrProtocol, opaque)
+		}
+
+		it, err := reply.item(keys[i])
+		if err != nil {
+			return err
+		}
+		cb(it)
+	}
+}
+
+// MetaSet stores the item according to opts and returns its new CAS. Item's
+// CAS, when not zero, makes the store conditional.
+func (c *Client) MetaSet(
+	ctx context.Context,
+	item *Item,
+	opts MetaSetOptions,
+) (uint64, error) {
+	var cas uint64
+	err := c.withMetaKey(ctx, "meta_set", item.Key, opts.Base64Key, true,
+		func(cn *conn, wireKey string) error {
+			words := []string{
+				"ms",
+				wireKey,
+				strconv.Itoa(len(item.Value)),
+				"c",
+				"F" + strconv.FormatUint(uint64(item.Flags), 10),
+				"T" + formatInt(int64(item.Expiration)),
+			}
+			if opts.Mode != 0 {
+				words = append(words, "M"+string(opts.Mode))
+			}
+			if item.CAS != 0 {
+				words = append(words,
+					"C"+strconv.FormatUint(item.CAS, 10))
+			}
+			if opts.Invalidate {
+				words = append(words, "I")
+			}
+			if opts.Base64Key {
+				words = append(words, "b")
+			}
+
+			// The command line is flushed together with the data.
+			if err := writeLine(cn.rw.Writer, words...); err != nil {
+				return err
+			}
+			if _, err := cn.rw.Write(item.Value); err != nil {
+				return err
+			}
+			if _, err := cn.rw.Write(crlf); err != nil {
+				return err
+			}
+			if err := cn.rw.Flush(); err != nil {
+				return err
+			}
+
+			reply, err := readMetaReply(cn.rw.Reader, "ms")
+			if err != nil {
+				return err
+			}
+			if err := reply.err("ms"); err != nil {
+				return err
+			}
+
+			if token, ok := reply.flag('c'); ok {
+				cas, err = strconv.ParseUint(token, 10, 64)
+				if err != nil {
+					return fmt.Errorf("%w: invalid ms CAS %q",
+						ErrProtocol, token)
+				}
+			}
+			return nil
+		})
+	return cas, err
+}
+
+// MetaDelete deletes or invalidates the item with the provided key.
+// ErrCacheMiss is returned if the item didn't already exist in the cache.
+func (c *Client) MetaDelete(
+	ctx context.Context,
+	key string,
+	opts MetaDeleteOptions,
+) error {
+	return c.withMetaKey(ctx, "meta_delete", key, opts.Base64Key, true,
+		func(cn *conn, wireKey string) error {
+			words := []string{"md", wireKey}
+			if opts.CAS != 0 {
+				words = append(words,
+					"C"+strconv.FormatUint(opts.CAS, 10))
+			}
+			if opts.Invalidate {
+				words = append(words, "I")
+			}
+			if opts.UpdateTTL {
+				words = append(words, "T"+formatInt(int64(opts.TTL)))
+			}
+			if opts.Base64Key {
+				words = append(words, "b")
+			}
+
+			if err := writeCommand(cn.rw, words...); err != nil {
+				return err
+			}
+
+			reply, err := readMetaReply(cn.rw.Reader, "md")
+			if err != nil {
+				return err
+			}
+			return reply.err("md")
+		})
+}
+
+// MetaArithmetic increments or decrements the value of key and returns the
+// new value. ErrCacheMiss is returned for missing item unless it is vivified.
+func (c *Client) MetaArithmetic(
+	ctx context.Context,
+	key string,
+	opts MetaArithmeticOptions,
+) (uint64, error) {
+	var val uint64
+	err := c.withMetaKey(ctx, "meta_arithmetic", key, opts.Base64Key, true,
+		func(cn *conn, wireKey string) error {
+			words := []string{"ma", wireKey, "v"}
+			if opts.Decrement {
+				words = append(words, "MD")
+			}
+			if opts.Delta != 0 {
+				words = append(words,
+					"D"+strconv.FormatUint(opts.Delta, 10))
+			}
+			if opts.Vivify != 0 {
+				words = append(words,
+					"N"+formatInt(int64(opts.Vivify)),
+					"J"+strconv.FormatUint(opts.Initial, 10))
+			}
+			if opts.CAS != 0 {
+				words = append(words,
+					"C"+strconv.FormatUint(opts.CAS, 10))
+			}
+			if opts.UpdateTTL {
+				words = append(words, "T"+formatInt(int64(opts.TTL)))
+			}
+			if opts.Base64Key {
+				words = append(words, "b")
+			}
+
+			if err := writeCommand(cn.rw, words...); err != nil {
+				return err
+			}
+
+			reply, err := readMetaReply(cn.rw.Reader, "ma")
+			if err != nil {
+				return err
+			}
+			if err := reply.err("ma"); err != nil {
+				return err
+			}
+
+			val, err = strconv.ParseUint(string(reply.value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid ma value %q",
+					ErrProtocol, reply.value)
+			}
+			return nil
+		})
+	return val, err
+}
@@ -0,0 +1,447 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replay returns ReadWriter reading response and discarding writes.
+func replay(response string) *bufio.ReadWriter {
+	return bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader(response)),
+		bufio.NewWriter(ioutil.Discard),
+	)
+}
+
+func TestMetaGet(t *testing.T) {
+	c, servers := newTestClient(t, 1)
+	ctx := context.Background()
+
+	if _, err := c.MetaGet(ctx, "foo", MetaGetOptions{}); err != ErrCacheMiss {
+		t.Errorf("MetaGet of missing key = %v, want %v", err, ErrCacheMiss)
+	}
+
+	err := c.Set(ctx, &Item{
+		Key:        "foo",
+		Value:      []byte("bar"),
+		Flags:      42,
+		Expiration: 100,
+	})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	stored, _ := servers[0].Item("foo")
+
+	it, err := c.MetaGet(ctx, "foo", MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if it.Key != "foo" || string(it.Value) != "bar" || it.Flags != 42 {
+		t.Errorf("MetaGet returned wrong item: %+v", it)
+	}
+	if it.CAS != stored.CAS {
+		t.Errorf("CAS is %d, want %d", it.CAS, stored.CAS)
+	}
+	if it.TTL <= 0 || it.TTL > 100 {
+		t.Errorf("TTL is %d, want (0, 100]", it.TTL)
+	}
+	if it.Hit || it.Won || it.WinPending || it.Stale {
+		t.Errorf("First MetaGet has wrong state: %+v", it)
+	}
+
+	it, err = c.MetaGet(ctx, "foo", MetaGetOptions{
+		NoValue:   true,
+		UpdateTTL: true,
+		TTL:       0,
+	})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if it.Value != nil {
+		t.Errorf("NoValue MetaGet returned value %q", it.Value)
+	}
+	if !it.Hit {
+		t.Errorf("Second MetaGet is not a hit")
+	}
+	if it.TTL != -1 {
+		t.Errorf("TTL after update is %d, want -1", it.TTL)
+	}
+	if it.LastAccess != 0 {
+		t.Errorf("LastAccess is %d, want 0", it.LastAccess)
+	}
+}
+
+func TestMetaGetVivify(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+	opts := MetaGetOptions{Vivify: 30}
+
+	it, err := c.MetaGet(ctx, "foo", opts)
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if !it.Won || len(it.Value) != 0 {
+		t.Errorf("Vivifying MetaGet returned %+v, want empty won item", it)
+	}
+
+	it, err = c.MetaGet(ctx, "foo", opts)
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if it.Won || !it.WinPending {
+		t.Errorf("Second MetaGet returned %+v, want win pending", it)
+	}
+
+	_, err = c.MetaSet(ctx, &Item{Key: "foo", Value: []byte("v")},
+		MetaSetOptions{})
+	if err != nil {
+		t.Fatalf("MetaSet: %s", err)
+	}
+
+	it, err = c.MetaGet(ctx, "foo", opts)
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if it.Won || it.WinPending || string(it.Value) != "v" {
+		t.Errorf("MetaGet after set returned %+v", it)
+	}
+}
+
+func TestMetaGetRecache(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	err := c.Set(ctx, &Item{Key: "foo", Value: []byte("v"), Expiration: 10})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	it, err := c.MetaGet(ctx, "foo", MetaGetOptions{Recache: 5})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if it.Won {
+		t.Errorf("Won recache with TTL above the threshold")
+	}
+
+	it, err = c.MetaGet(ctx, "foo", MetaGetOptions{Recache: 30})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if !it.Won || string(it.Value) != "v" {
+		t.Errorf("MetaGet returned %+v, want won recache", it)
+	}
+}
+
+func TestMetaDeleteInvalidate(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	if err := c.MetaDelete(ctx, "foo", MetaDeleteOptions{}); err != ErrCacheMiss {
+		t.Errorf("MetaDelete of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+
+	cas, err := c.MetaSet(ctx, &Item{Key: "foo", Value: []byte("old")},
+		MetaSetOptions{})
+	if err != nil {
+		t.Fatalf("MetaSet: %s", err)
+	}
+
+	err = c.MetaDelete(ctx, "foo", MetaDeleteOptions{CAS: cas + 1})
+	if err != ErrCASConflict {
+		t.Errorf("MetaDelete with wrong CAS = %v, want %v",
+			err, ErrCASConflict)
+	}
+
+	err = c.MetaDelete(ctx, "foo", MetaDeleteOptions{Invalidate: true})
+	if err != nil {
+		t.Fatalf("MetaDelete: %s", err)
+	}
+
+	it, err := c.MetaGet(ctx, "foo", MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if !it.Stale || !it.Won || string(it.Value) != "old" {
+		t.Errorf("First MetaGet of stale item returned %+v", it)
+	}
+
+	it, err = c.MetaGet(ctx, "foo", MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if !it.Stale || it.Won || !it.WinPending {
+		t.Errorf("Second MetaGet of stale item returned %+v", it)
+	}
+
+	err = c.MetaDelete(ctx, "foo", MetaDeleteOptions{})
+	if err != nil {
+		t.Fatalf("MetaDelete: %s", err)
+	}
+	if _, err := c.MetaGet(ctx, "foo", MetaGetOptions{}); err != ErrCacheMiss {
+		t.Errorf("MetaGet after delete = %v, want %v", err, ErrCacheMiss)
+	}
+}
+
+func TestMetaSet(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	item := &Item{Key: "foo", Value: []byte("b")}
+
+	_, err := c.MetaSet(ctx, item, MetaSetOptions{Mode: MetaSetModeReplace})
+	if err != ErrNotStored {
+		t.Errorf("Replace of missing key = %v, want %v", err, ErrNotStored)
+	}
+	if _, err := c.MetaSet(ctx, item, MetaSetOptions{Mode: MetaSetModeAdd}); err != nil {
+		t.Errorf("Add: %s", err)
+	}
+	_, err = c.MetaSet(ctx, item, MetaSetOptions{Mode: MetaSetModeAdd})
+	if err != ErrNotStored {
+		t.Errorf("Add of existing key = %v, want %v", err, ErrNotStored)
+	}
+	_, err = c.MetaSet(ctx, &Item{Key: "foo", Value: []byte("c")},
+		MetaSetOptions{Mode: MetaSetModeAppend})
+	if err != nil {
+		t.Errorf("Append: %s", err)
+	}
+	cas, err := c.MetaSet(ctx, &Item{Key: "foo", Value: []byte("a")},
+		MetaSetOptions{Mode: MetaSetModePrepend})
+	if err != nil {
+		t.Errorf("Prepend: %s", err)
+	}
+
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(it.Value) != "abc" || it.CAS != cas {
+		t.Errorf("Got %+v, want value abc and CAS %d", it, cas)
+	}
+
+	it.Value = []byte("new")
+	newCAS, err := c.MetaSet(ctx, it, MetaSetOptions{})
+	if err != nil {
+		t.Fatalf("MetaSet with CAS: %s", err)
+	}
+	if _, err := c.MetaSet(ctx, it, MetaSetOptions{}); err != ErrCASConflict {
+		t.Errorf("MetaSet with old CAS = %v, want %v", err, ErrCASConflict)
+	}
+
+	// Invalidating set with older CAS stores the item as stale.
+	if _, err := c.MetaSet(ctx, it, MetaSetOptions{Invalidate: true}); err != nil {
+		t.Fatalf("Invalidating MetaSet: %s", err)
+	}
+	mi, err := c.MetaGet(ctx, "foo", MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if !mi.Stale || mi.CAS <= newCAS {
+		t.Errorf("MetaGet after invalidating set returned %+v", mi)
+	}
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	c, _ := newTestClient(t, 1)
+	ctx := context.Background()
+
+	_, err := c.MetaArithmetic(ctx, "n", MetaArithmeticOptions{})
+	if err != ErrCacheMiss {
+		t.Errorf("MetaArithmetic of missing key = %v, want %v",
+			err, ErrCacheMiss)
+	}
+
+	v, err := c.MetaArithmetic(ctx, "n", MetaArithmeticOptions{
+		Vivify:  30,
+		Initial: 10,
+	})
+	if err != nil || v != 10 {
+		t.Errorf("Vivifying MetaArithmetic = %d, %v, want 10", v, err)
+	}
+
+	v, err = c.MetaArithmetic(ctx, "n", MetaArithmeticOptions{})
+	if err != nil || v != 11 {
+		t.Errorf("MetaArithmetic = %d, %v, want 11", v, err)
+	}
+
+	v, err = c.MetaArithmetic(ctx, "n", MetaArithmeticOptions{
+		Decrement: true,
+		Delta:     20,
+	})
+	if err != nil || v != 0 {
+		t.Errorf("Decrementing MetaArithmetic = %d, %v, want 0", v, err)
+	}
+}
+
+func TestMetaBase64Key(t *testing.T) {
+	c, servers := newTestClient(t, 1)
+	ctx := context.Background()
+
+	key := "binary key\x00\n"
+	if _, err := c.MetaGet(ctx, key, MetaGetOptions{}); err != ErrMalformedKey {
+		t.Errorf("MetaGet of binary key = %v, want %v", err, ErrMalformedKey)
+	}
+
+	_, err := c.MetaSet(ctx, &Item{Key: key, Value: []byte("v")},
+		MetaSetOptions{Base64Key: true})
+	if err != nil {
+		t.Fatalf("MetaSet: %s", err)
+	}
+	if _, ok := servers[0].Item(key); !ok {
+		t.Errorf("Server does not hold decoded key")
+	}
+
+	it, err := c.MetaGet(ctx, key, MetaGetOptions{Base64Key: true})
+	if err != nil {
+		t.Fatalf("MetaGet: %s", err)
+	}
+	if it.Key != key || string(it.Value) != "v" {
+		t.Errorf("MetaGet returned %+v", it)
+	}
+
+	items, err := c.MetaGetMulti(ctx, []string{key},
+		MetaGetOptions{Base64Key: true})
+	if err != nil {
+		t.Fatalf("MetaGetMulti: %s", err)
+	}
+	if it := items[key]; it == nil || string(it.Value) != "v" {
+		t.Errorf("MetaGetMulti returned %+v", items)
+	}
+}
+
+func TestMetaGetMultiPipelined(t *testing.T) {
+	c, servers := newTestClient(t, 3)
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+
+		if i%3 == 0 {
+			continue
+		}
+
+		err := c.Set(ctx, &Item{Key: key, Value: []byte(key)})
+		if err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+
+	items, err := c.MetaGetMulti(ctx, keys, MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGetMulti: %s", err)
+	}
+	if len(items) != 40 {
+		t.Errorf("MetaGetMulti returned %d items, want 40", len(items))
+	}
+	for key, it := range items {
+		if it.Key != key || string(it.Value) != key || it.CAS == 0 {
+			t.Errorf("%s holds %+v", key, it)
+		}
+	}
+
+	mg := 0
+	for i, s := range servers {
+		mg += s.Commands("mg")
+		if n := s.Commands("mn"); n != 1 {
+			t.Errorf("Server %d got %d mn, want 1", i, n)
+		}
+	}
+	if mg != 60 {
+		t.Errorf("Servers got %d mg, want 60", mg)
+	}
+
+	// The connections must be usable after the pipeline.
+	if _, err := c.MetaGet(ctx, "key-1", MetaGetOptions{}); err != nil {
+		t.Errorf("MetaGet after MetaGetMulti: %s", err)
+	}
+}
+
+func TestMetaGetMultiPartial(t *testing.T) {
+	c, servers := newTestClient(t, 2)
+	ctx := context.Background()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		c.Set(ctx, &Item{Key: key, Value: []byte(key)})
+	}
+	servers[1].Close()
+
+	items, err := c.MetaGetMulti(ctx, keys, MetaGetOptions{})
+	if err == nil {
+		t.Fatalf("MetaGetMulti succeeded with dead server")
+	}
+	if n := servers[0].Len(); len(items) != n || n == 0 {
+		t.Errorf("MetaGetMulti returned %d items, want %d of the live "+
+			"server", len(items), n)
+	}
+}
+
+func TestMetaGetPipelineServerError(t *testing.T) {
+	rw := replay("SERVER_ERROR out of memory\r\nVA 1 O1\r\nx\r\nMN\r\n")
+	keys := []string{"a", "b"}
+	wireKeys := map[string]string{"a": "a", "b": "b"}
+
+	var got []string
+	err := metaGetPipeline(rw, keys, wireKeys, []string{"v", "q"},
+		func(it *MetaItem) {
+			got = append(got, it.Key)
+		})
+	if !errors.Is(err, ErrServerError) {
+		t.Errorf("metaGetPipeline = %v, want %v", err, ErrServerError)
+	}
+	if len(got) != 1 || got[0] != "b" {
+		t.Errorf("metaGetPipeline returned %q, want [b]", got)
+	}
+	if _, err := rw.ReadByte(); err == nil {
+		t.Errorf("Response was not read up to MN")
+	}
+	if !resumableError(err) {
+		t.Errorf("Connection read up to MN is not reused")
+	}
+}
+
+func TestMetaBinaryUnsupported(t *testing.T) {
+	c := newBinaryTestClient(t, 1)
+	ctx := context.Background()
+
+	if _, err := c.MetaGet(ctx, "foo", MetaGetOptions{}); err != ErrMetaUnsupported {
+		t.Errorf("MetaGet = %v, want %v", err, ErrMetaUnsupported)
+	}
+	_, err := c.MetaGetMulti(ctx, []string{"foo"}, MetaGetOptions{})
+	if err != ErrMetaUnsupported {
+		t.Errorf("MetaGetMulti = %v, want %v", err, ErrMetaUnsupported)
+	}
+}
+
+func TestTTLExpiration(t *testing.T) {
+	const month = 30 * 24 * 60 * 60
+	now := int32(time.Now().Unix())
+
+	tests := []struct {
+		ttl  int32
+		want int32
+	}{
+		{-1, 0},
+		{100, 100},
+		{month, month},
+		{month + 1, now + month + 1},
+	}
+	for _, test := range tests {
+		got := (&MetaItem{TTL: test.ttl}).TTLExpiration()
+		if got < test.want || got > test.want+1 {
+			t.Errorf("TTLExpiration of TTL %d = %d, want %d",
+				test.ttl, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives instrumentation of the Client. Implementations must be safe
+// to call from multiple goroutines at once.
+type Metrics interface {
+	// ObserveRequest is called once for every operation on server addr,
+	// after it finished. op names the operation ("get", "set",
+	// "get_multi", "meta_get", ...), d is how long it took, including
+	// waiting for a connection and dialing, and err is its result. Use
+	// ErrorKind to classify err.
+	ObserveRequest(addr net.Addr, op string, d time.Duration, err error)
+}
+
+// Kinds of errors returned by ErrorKind.
+const (
+	ErrorKindTimeout  = "timeout"
+	ErrorKindCanceled = "canceled"
+	ErrorKindAuth     = "auth"
+	ErrorKindServer   = "server"
+	ErrorKindClient   = "client"
+	ErrorKindProtocol = "protocol"
+	ErrorKindNetwork  = "network"
+)
+
+// ErrorKind classifies err returned by an operation. Empty string is returned
+// for successful operations, including cache misses, CAS conflicts and not
+// stored items, which are valid answers of the server.
+func ErrorKind(err error) string {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrServerError):
+		return ErrorKindServer
+	case resumableError(err):
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorKindTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorKindTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrAuthUnsupported):
+		return ErrorKindAuth
+	case errors.Is(err, ErrClientError):
+		return ErrorKindClient
+	case errors.Is(err, ErrProtocol):
+		return ErrorKindProtocol
+	}
+	return ErrorKindNetwork
+}
+
+// DefaultLatencyBuckets are upper bounds of latency histogram buckets used by
+// ExpvarMetrics.
+var DefaultLatencyBuckets = []time.Duration{
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// Histogram counts durations in buckets. It implements expvar.Var, its JSON
+// form is
+//
+//	{"count": 3, "sum": 0.0042, "buckets": {"0.001": 2, ..., "+Inf": 3}}
+//
+// with the sum in seconds and cumulative bucket counts keyed by the upper
+// bound in seconds, the same way Prometheus does it.
+type Histogram struct {
+	count  uint64
+	sum    int64
+	bounds []time.Duration
+	counts []uint64
+}
+
+// NewHistogram returns histogram with buckets bounded by bounds, which must be
+// sorted.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds d to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *Histogram) String() string {
+	b := strings.Builder{}
+
+	fmt.Fprintf(&b, `{"count": %d, "sum": %s, "buckets": {`,
+		atomic.LoadUint64(&h.count),
+		formatSeconds(time.Duration(atomic.LoadInt64(&h.sum))))
+
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+
+		bound := "+Inf"
+		if i < len(h.bounds) {
+			bound = formatSeconds(h.bounds[i])
+		}
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, `"%s": %d`, bound, cumulative)
+	}
+
+	b.WriteString("}}")
+	return b.String()
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// ExpvarMetrics implements Metrics using expvar. It is an expvar.Var itself,
+// publish it using expvar.Publish. The JSON form holds an object for every
+// server, keyed by "network/address", with:
+//
+//	requests  number of operations by the operation name
+//	errors    number of failed operations by ErrorKind
+//	timeouts  number of timed out operations
+//	latency   Histogram of operations' latencies
+type ExpvarMetrics struct {
+	vars    expvar.Map
+	servers map[string]*serverMetrics
+	buckets []time.Duration
+	m       sync.Mutex
+}
+
+type serverMetrics struct {
+	requests expvar.Map
+	errors   expvar.Map
+	timeouts expvar.Int
+	latency  *Histogram
+}
+
+// NewExpvarMetrics returns ExpvarMetrics using DefaultLatencyBuckets.
+func NewExpvarMetrics() *ExpvarMetrics {
+	return NewExpvarMetricsWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewExpvarMetricsWithBuckets returns ExpvarMetrics with latency histograms
+// bounded by buckets, which must be sorted.
+func NewExpvarMetricsWithBuckets(buckets []time.Duration) *ExpvarMetrics {
+	return &ExpvarMetrics{
+		servers: make(map[string]*serverMetrics),
+		buckets: buckets,
+	}
+}
+
+func (em *ExpvarMetrics) server(addr net.Addr) *serverMetrics {
+	key := poolKey(addr)
+
+	em.m.Lock()
+	defer em.m.Unlock()
+
+	sm, ok := em.servers[key]
+	if !ok {
+		sm = &serverMetrics{latency: NewHistogram(em.buckets)}
+		em.servers[key] = sm
+
+		vars := &expvar.Map{}
+		vars.Set("requests", &sm.requests)
+		vars.Set("errors", &sm.errors)
+		vars.Set("timeouts", &sm.timeouts)
+		vars.Set("latency", sm.latency)
+		em.vars.Set(key, vars)
+	}
+	return sm
+}
+
+// ObserveRequest implements Metrics.
+func (em *ExpvarMetrics) ObserveRequest(
+	addr net.Addr,
+	op string,
+	d time.Duration,
+	err error,
+) {
+	sm := em.server(addr)
+
+	sm.requests.Add(op, 1)
+	sm.latency.Observe(d)
+
+	kind := ErrorKind(err)
+	if kind != "" {
+		sm.errors.Add(kind, 1)
+	}
+	if kind == ErrorKindTimeout {
+		sm.timeouts.Add(1)
+	}
+}
+
+func (em *ExpvarMetrics) String() string {
+	return em.vars.String()
+}
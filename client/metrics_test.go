@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type observation struct {
+	addr net.Addr
+	op   string
+	d    time.Duration
+	err  error
+}
+
+type recordingMetrics struct {
+	observations []observation
+	m            sync.Mutex
+}
+
+func (rm *recordingMetrics) ObserveRequest(
+	addr net.Addr,
+	op string,
+	d time.Duration,
+	err error,
+) {
+	rm.m.Lock()
+	rm.observations = append(rm.observations, observation{addr, op, d, err})
+	rm.m.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	c, servers := newTestClient(t, 2)
+	rm := &recordingMetrics{}
+	c.Metrics = rm
+	ctx := context.Background()
+
+	c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")})
+	c.Get(ctx, "foo")
+	c.Get(ctx, "missing")
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	c.GetMulti(ctx, keys)
+	c.Version(ctx)
+
+	owner, _ := c.selector.PickServer("foo")
+
+	ops := make(map[string]int)
+	for _, o := range rm.observations {
+		ops[o.op]++
+		if o.err != nil && o.err != ErrCacheMiss {
+			t.Errorf("Operation %s failed: %v", o.op, o.err)
+		}
+		if o.d <= 0 {
+			t.Errorf("Operation %s took %s", o.op, o.d)
+		}
+		if o.op == "set" && o.addr != owner {
+			t.Errorf("Operation %s observed on %s, want %s",
+				o.op, o.addr, owner)
+		}
+	}
+
+	// Ports of the servers are random, so are the servers of the keys.
+	groups, _ := c.groupKeys(keys)
+	want := map[string]int{
+		"set":       1,
+		"get":       2,
+		"get_multi": len(groups),
+		"version":   2,
+	}
+	if fmt.Sprint(ops) != fmt.Sprint(want) {
+		t.Errorf("Observed operations %v, want %v", ops, want)
+	}
+
+	servers[0].Close()
+	servers[1].Close()
+	c.Close()
+	rm.observations = nil
+
+	c.Get(ctx, "foo")
+	if len(rm.observations) != 1 || rm.observations[0].err == nil {
+		t.Errorf("Failure not observed: %+v", rm.observations)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{nil, ""},
+		{ErrCacheMiss, ""},
+		{ErrCASConflict, ""},
+		{ErrNotStored, ""},
+		{fmt.Errorf("%w: out of memory", ErrServerError), ErrorKindServer},
+		{context.DeadlineExceeded, ErrorKindTimeout},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, ErrorKindTimeout},
+		{context.Canceled, ErrorKindCanceled},
+		{&AuthError{Err: ErrAuthFailed}, ErrorKindAuth},
+		{ErrAuthUnsupported, ErrorKindAuth},
+		{fmt.Errorf("%w: bad format", ErrClientError), ErrorKindClient},
+		{fmt.Errorf("%w: garbage", ErrProtocol), ErrorKindProtocol},
+		{errors.New("connection reset by peer"), ErrorKindNetwork},
+	}
+
+	for _, test := range tests {
+		if kind := ErrorKind(test.err); kind != test.kind {
+			t.Errorf("ErrorKind(%v) = %q, want %q", test.err, kind, test.kind)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(2 * time.Millisecond)
+	h.Observe(2 * time.Second)
+
+	var v struct {
+		Count   uint64
+		Sum     float64
+		Buckets map[string]uint64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &v); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", h.String(), err)
+	}
+
+	if v.Count != 4 || v.Sum != 2.0035 {
+		t.Errorf("Count %d and sum %g, want 4 and 2.0035", v.Count, v.Sum)
+	}
+	want := map[string]uint64{"0.001": 2, "1": 3, "+Inf": 4}
+	if fmt.Sprint(v.Buckets) != fmt.Sprint(want) {
+		t.Errorf("Buckets %v, want %v", v.Buckets, want)
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	em := NewExpvarMetrics()
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11211}
+
+	em.ObserveRequest(addr, "get", time.Millisecond, nil)
+	em.ObserveRequest(addr, "get", time.Millisecond, ErrCacheMiss)
+	em.ObserveRequest(addr, "set", time.Second, context.DeadlineExceeded)
+	em.ObserveRequest(addr, "set", time.Millisecond, ErrProtocol)
+
+	var v map[string]struct {
+		Requests map[string]int
+		Errors   map[string]int
+		Timeouts int
+		Latency  struct{ Count int }
+	}
+	if err := json.Unmarshal([]byte(em.String()), &v); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", em.String(), err)
+	}
+
+	s, ok := v["tcp/127.0.0.1:11211"]
+	if !ok {
+		t.Fatalf("Server missing in %s", em.String())
+	}
+	if s.Requests["get"] != 2 || s.Requests["set"] != 2 {
+		t.Errorf("Wrong requests: %v", s.Requests)
+	}
+	if len(s.Errors) != 2 || s.Errors[ErrorKindTimeout] != 1 ||
+		s.Errors[ErrorKindProtocol] != 1 {
+
+		t.Errorf("Wrong errors: %v", s.Errors)
+	}
+	if s.Timeouts != 1 || s.Latency.Count != 4 {
+		t.Errorf("Wrong timeouts %d or latency count %d",
+			s.Timeouts, s.Latency.Count)
+	}
+}
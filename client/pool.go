@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+)
+
+// conn is a connection to a server.
+type conn struct {
+	nc   net.Conn
+	rw   *bufio.ReadWriter
+	addr net.Addr
+	pool *pool
+}
+
+// pool of connections to single server. Number of open connections is bounded
+// by MaxConns, number of idle ones by MaxIdleConns.
+type pool struct {
+	addr    net.Addr
+	maxIdle int
+	// slots is nil when the number of connections is not bounded.
+	slots chan struct{}
+
+	idle []*conn
+	// closed pool keeps no idle connections, see close.
+	closed bool
+	m      sync.Mutex
+}
+
+func newPool(addr net.Addr, maxConns int, maxIdle int) *pool {
+	p := &pool{
+		addr:    addr,
+		maxIdle: maxIdle,
+	}
+	if maxConns > 0 {
+		p.slots = make(chan struct{}, maxConns)
+	}
+
+	return p
+}
+
+// acquire reserves slot for one connection, waiting for one to be free if
+// necessary.
+func (p *pool) acquire(ctx context.Context) error {
+	if p.slots == nil {
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// free returns slot reserved by acquire.
+func (p *pool) free() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// popIdle returns idle connection, if any.
+func (p *pool) popIdle() *conn {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	n := len(p.idle)
+	if n == 0 {
+		return nil
+	}
+
+	cn := p.idle[n-1]
+	p.idle[n-1] = nil
+	p.idle = p.idle[:n-1]
+	return cn
+}
+
+// put returns cn to the pool. When reuse is false or there are already enough
+// idle connections, cn is closed instead.
+func (p *pool) put(cn *conn, reuse bool) {
+	defer p.free()
+
+	if reuse {
+		p.m.Lock()
+		if !p.closed && len(p.idle) < p.maxIdle {
+			p.idle = append(p.idle, cn)
+			p.m.Unlock()
+			return
+		}
+		p.m.Unlock()
+	}
+
+	cn.nc.Close()
+}
+
+// close closes all idle connections. Connections in use are closed once
+// returned.
+func (p *pool) close() {
+	p.m.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.m.Unlock()
+
+	for _, cn := range idle {
+		cn.nc.Close()
+	}
+}
+
+// pools holds pool for each server.
+type pools struct {
+	pools map[string]*pool
+	m     sync.Mutex
+}
+
+func poolKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+func (ps *pools) get(addr net.Addr, maxConns int, maxIdle int) *pool {
+	key := poolKey(addr)
+
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	if ps.pools == nil {
+		ps.pools = make(map[string]*pool)
+	}
+
+	p, ok := ps.pools[key]
+	if !ok {
+		p = newPool(addr, maxConns, maxIdle)
+		ps.pools[key] = p
+	}
+
+	return p
+}
+
+// remove closes and forgets pools of addrs.
+func (ps *pools) remove(addrs []net.Addr) {
+	var removed []*pool
+
+	ps.m.Lock()
+	for _, addr := range addrs {
+		if p, ok := ps.pools[poolKey(addr)]; ok {
+			delete(ps.pools, poolKey(addr))
+			removed = append(removed, p)
+		}
+	}
+	ps.m.Unlock()
+
+	for _, p := range removed {
+		p.close()
+	}
+}
+
+func (ps *pools) close() {
+	ps.m.Lock()
+	pools := ps.pools
+	ps.pools = nil
+	ps.m.Unlock()
+
+	for _, p := range pools {
+		p.close()
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bufio"
+)
+
+// Protocol selects wire protocol used to talk to the servers.
+type Protocol int
+
+const (
+	// Text is memcached's text protocol. It is the default.
+	Text Protocol = iota
+	// Binary is memcached's binary protocol, the one libmemcached uses
+	// with MEMCACHED_BEHAVIOR_BINARY_PROTOCOL.
+	Binary
+)
+
+// protocol implements commands in one of the wire protocols.
+type protocol interface {
+	// get calls cb with each of keys found.
+	get(rw *bufio.ReadWriter, keys []string, cb func(*Item)) error
+	// getAndTouch calls cb with key if found and updates its expiration.
+	getAndTouch(
+		rw *bufio.ReadWriter,
+		key string,
+		expiration int32,
+		cb func(*Item),
+	) error
+	// store stores item using verb (set, add, replace, append, prepend
+	// or cas).
+	store(rw *bufio.ReadWriter, verb string, item *Item) error
+	delete(rw *bufio.ReadWriter, key string) error
+	touch(rw *bufio.ReadWriter, key string, expiration int32) error
+	// incrDecr increments or decrements (verb is incr or decr) key.
+	incrDecr(
+		rw *bufio.ReadWriter,
+		verb string,
+		key string,
+		delta uint64,
+	) (uint64, error)
+	flushAll(rw *bufio.ReadWriter) error
+	version(rw *bufio.ReadWriter) (string, error)
+	stats(rw *bufio.ReadWriter, args ...string) (map[string]string, error)
+}
+
+func (c *Client) proto() protocol {
+	if c.Protocol == Binary {
+		return binaryProtocol{}
+	}
+	return textProtocol{}
+}
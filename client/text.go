@@ -0,0 +1,400 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	crlf            = []byte("\r\n")
+	resultOK        = []byte("OK\r\n")
+	resultStored    = []byte("STORED\r\n")
+	resultNotStored = []byte("NOT_STORED\r\n")
+	resultExists    = []byte("EXISTS\r\n")
+	resultNotFound  = []byte("NOT_FOUND\r\n")
+	resultDeleted   = []byte("DELETED\r\n")
+	resultEnd       = []byte("END\r\n")
+	resultTouched   = []byte("TOUCHED\r\n")
+
+	resultClientErrorPrefix = []byte("CLIENT_ERROR ")
+	resultServerErrorPrefix = []byte("SERVER_ERROR ")
+	resultError             = []byte("ERROR\r\n")
+	valuePrefix             = []byte("VALUE ")
+	versionPrefix           = []byte("VERSION ")
+	statPrefix              = []byte("STAT ")
+)
+
+func formatInt(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+// writeLine writes words separated by spaces and terminated by CRLF.
+func writeLine(w *bufio.Writer, words ...string) error {
+	for i, word := range words {
+		if i != 0 {
+			if err := w.WriteByte(' '); err != nil {
+				return err
+			}
+		}
+		if _, err := w.WriteString(word); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(crlf)
+	return err
+}
+
+// writeCommand writes command line and flushes the buffer.
+func writeCommand(rw *bufio.ReadWriter, words ...string) error {
+	if err := writeLine(rw.Writer, words...); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// readLine reads single response line, including the CRLF. Lines carrying
+// generic error responses are turned into errors.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		return nil, fmt.Errorf("%w: line not terminated by CRLF: %q",
+			ErrProtocol, line)
+	}
+
+	switch {
+	case bytes.HasPrefix(line, resultClientErrorPrefix):
+		msg := line[len(resultClientErrorPrefix) : len(line)-2]
+		return nil, fmt.Errorf("%w: %s", ErrClientError, msg)
+	case bytes.HasPrefix(line, resultServerErrorPrefix):
+		msg := line[len(resultServerErrorPrefix) : len(line)-2]
+		return nil, fmt.Errorf("%w: %s", ErrServerError, msg)
+	case bytes.Equal(line, resultError):
+		return nil, fmt.Errorf("%w: unknown command", ErrClientError)
+	}
+
+	return line, nil
+}
+
+// incompleteError is error read in the middle of a response, after which it
+// is not known where the response ends. The connection is not reused.
+type incompleteError struct {
+	err error
+}
+
+func (e *incompleteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *incompleteError) Unwrap() error {
+	return e.err
+}
+
+// incomplete marks err, read in the middle of a response, as incompleteError.
+func incomplete(err error) error {
+	return &incompleteError{err: err}
+}
+
+func unexpected(verb string, line []byte) error {
+	return fmt.Errorf("%w: unexpected response line from %s: %q",
+		ErrProtocol, verb, line)
+}
+
+// textExpect sends command and checks the response is expect. Common negative
+// responses are turned into errors.
+func textExpect(rw *bufio.ReadWriter, expect []byte, words ...string) error {
+	if err := writeCommand(rw, words...); err != nil {
+		return err
+	}
+
+	line, err := readLine(rw.Reader)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.Equal(line, expect):
+		return nil
+	case bytes.Equal(line, resultNotStored):
+		return ErrNotStored
+	case bytes.Equal(line, resultExists):
+		return ErrCASConflict
+	case bytes.Equal(line, resultNotFound):
+		return ErrCacheMiss
+	}
+	return unexpected(words[0], line)
+}
+
+// textGet sends retrieval command verb (get, gets, gat or gats) for keys and
+// calls cb with each item found. exp is passed before the keys when non-empty.
+func textGet(
+	rw *bufio.ReadWriter,
+	verb string,
+	exp string,
+	keys []string,
+	cb func(*Item),
+) error {
+	words := make([]string, 0, len(keys)+2)
+	words = append(words, verb)
+	if exp != "" {
+		words = append(words, exp)
+	}
+	words = append(words, keys...)
+
+	if err := writeCommand(rw, words...); err != nil {
+		return err
+	}
+
+	for n := 0; ; n++ {
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			// Only error in place of the only result is known to be
+			// the whole response.
+			if n > 0 || len(keys) > 1 {
+				return incomplete(err)
+			}
+			return err
+		}
+		if bytes.Equal(line, resultEnd) {
+			return nil
+		}
+
+		it := &Item{}
+		size, err := scanValueLine(line, it)
+		if err != nil {
+			return err
+		}
+
+		it.Value = make([]byte, size+2)
+		if _, err := io.ReadFull(rw, it.Value); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(it.Value, crlf) {
+			return fmt.Errorf("%w: corrupt get result read", ErrProtocol)
+		}
+		it.Value = it.Value[:size]
+
+		cb(it)
+	}
+}
+
+// scanValueLine parses "VALUE <key> <flags> <bytes> [<cas unique>]" line into
+// it and returns the size of the value.
+func scanValueLine(line []byte, it *Item) (int, error) {
+	if !bytes.HasPrefix(line, valuePrefix) {
+		return 0, unexpected("get", line)
+	}
+
+	f := strings.Fields(string(line[len(valuePrefix):]))
+	if len(f) != 3 && len(f) != 4 {
+		return 0, unexpected("get", line)
+	}
+
+	flags, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil {
+		return 0, unexpected("get", line)
+	}
+	size, err := strconv.Atoi(f[2])
+	if err != nil || size < 0 {
+		return 0, unexpected("get", line)
+	}
+	if len(f) == 4 {
+		it.CAS, err = strconv.ParseUint(f[3], 10, 64)
+		if err != nil {
+			return 0, unexpected("get", line)
+		}
+	}
+
+	it.Key = f[0]
+	it.Flags = uint32(flags)
+	return size, nil
+}
+
+// textStore sends storage command verb (set, add, replace, append, prepend or
+// cas) for item.
+func textStore(rw *bufio.ReadWriter, verb string, item *Item) error {
+	words := []string{
+		verb,
+		item.Key,
+		strconv.FormatUint(uint64(item.Flags), 10),
+		formatInt(int64(item.Expiration)),
+		strconv.Itoa(len(item.Value)),
+	}
+	if verb == "cas" {
+		words = append(words, strconv.FormatUint(item.CAS, 10))
+	}
+
+	// The command line is flushed together with the data.
+	if err := writeLine(rw.Writer, words...); err != nil {
+		return err
+	}
+	if _, err := rw.Write(item.Value); err != nil {
+		return err
+	}
+	if _, err := rw.Write(crlf); err != nil {
+		return err
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	line, err := readLine(rw.Reader)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.Equal(line, resultStored):
+		return nil
+	case bytes.Equal(line, resultNotStored):
+		return ErrNotStored
+	case bytes.Equal(line, resultExists):
+		return ErrCASConflict
+	case bytes.Equal(line, resultNotFound):
+		return ErrCacheMiss
+	}
+	return unexpected(verb, line)
+}
+
+// textIncrDecr sends incr or decr command and returns the new value.
+func textIncrDecr(
+	rw *bufio.ReadWriter,
+	verb string,
+	key string,
+	delta uint64,
+) (uint64, error) {
+	err := writeCommand(rw, verb, key, strconv.FormatUint(delta, 10))
+	if err != nil {
+		return 0, err
+	}
+
+	line, err := readLine(rw.Reader)
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Equal(line, resultNotFound) {
+		return 0, ErrCacheMiss
+	}
+
+	val, err := strconv.ParseUint(string(line[:len(line)-2]), 10, 64)
+	if err != nil {
+		return 0, unexpected(verb, line)
+	}
+	return val, nil
+}
+
+// textVersion sends version command and returns the version.
+func textVersion(rw *bufio.ReadWriter) (string, error) {
+	if err := writeCommand(rw, "version"); err != nil {
+		return "", err
+	}
+
+	line, err := readLine(rw.Reader)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(line, versionPrefix) {
+		return "", unexpected("version", line)
+	}
+
+	return string(line[len(versionPrefix) : len(line)-2]), nil
+}
+
+// textStats sends stats command (with optional argument) and returns the
+// statistics.
+func textStats(rw *bufio.ReadWriter, args ...string) (map[string]string, error) {
+	if err := writeCommand(rw, append([]string{"stats"}, args...)...); err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]string)
+	for {
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			if len(stats) > 0 {
+				return nil, incomplete(err)
+			}
+			return nil, err
+		}
+		if bytes.Equal(line, resultEnd) {
+			return stats, nil
+		}
+		if !bytes.HasPrefix(line, statPrefix) {
+			return nil, unexpected("stats", line)
+		}
+
+		f := strings.SplitN(string(line[len(statPrefix):len(line)-2]), " ", 2)
+		if len(f) != 2 {
+			return nil, unexpected("stats", line)
+		}
+		stats[f[0]] = f[1]
+	}
+}
+
+// textProtocol implements protocol using the text protocol.
+type textProtocol struct{}
+
+func (textProtocol) get(
+	rw *bufio.ReadWriter,
+	keys []string,
+	cb func(*Item),
+) error {
+	return textGet(rw, "gets", "", keys, cb)
+}
+
+func (textProtocol) getAndTouch(
+	rw *bufio.ReadWriter,
+	key string,
+	expiration int32,
+	cb func(*Item),
+) error {
+	exp := formatInt(int64(expiration))
+	return textGet(rw, "gats", exp, []string{key}, cb)
+}
+
+func (textProtocol) store(rw *bufio.ReadWriter, verb string, item *Item) error {
+	return textStore(rw, verb, item)
+}
+
+func (textProtocol) delete(rw *bufio.ReadWriter, key string) error {
+	return textExpect(rw, resultDeleted, "delete", key)
+}
+
+func (textProtocol) touch(
+	rw *bufio.ReadWriter,
+	key string,
+	expiration int32,
+) error {
+	return textExpect(rw, resultTouched,
+		"touch", key, formatInt(int64(expiration)))
+}
+
+func (textProtocol) incrDecr(
+	rw *bufio.ReadWriter,
+	verb string,
+	key string,
+	delta uint64,
+) (uint64, error) {
+	return textIncrDecr(rw, verb, key, delta)
+}
+
+func (textProtocol) flushAll(rw *bufio.ReadWriter) error {
+	return textExpect(rw, resultOK, "flush_all")
+}
+
+func (textProtocol) version(rw *bufio.ReadWriter) (string, error) {
+	return textVersion(rw)
+}
+
+func (textProtocol) stats(
+	rw *bufio.ReadWriter,
+	args ...string,
+) (map[string]string, error) {
+	return textStats(rw, args...)
+}
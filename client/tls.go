@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// tlsConfig returns TLS configuration for server addr, nil means plain
+// connection.
+func (c *Client) tlsConfig(addr net.Addr) *tls.Config {
+	if l, ok := c.selector.(serverLookup); ok {
+		if s, ok := l.LookupServer(addr); ok && s.TLS != nil {
+			return s.TLS
+		}
+	}
+	return c.TLSConfig
+}
+
+// tlsClient establishes TLS over nc. The handshake is limited by ctx. nc is
+// closed on failure.
+func tlsClient(
+	ctx context.Context,
+	nc net.Conn,
+	addr net.Addr,
+	cfg *tls.Config,
+) (net.Conn, error) {
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tc := tls.Client(nc, cfg)
+
+	deadline, _ := ctx.Deadline()
+	nc.SetDeadline(deadline)
+
+	stop := interruptOnDone(ctx, nc)
+	err := tc.Handshake()
+	stop()
+
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
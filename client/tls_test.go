@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/memcachetest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// selfSigned returns self-signed certificate valid for 127.0.0.1, usable both
+// by servers and clients, and pool holding it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "memcachetest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, pool
+}
+
+// newTLSServer starts memcachetest.Server behind TLS listener requiring client
+// certificate signed by itself.
+func newTLSServer(t *testing.T) (
+	*memcachetest.Server,
+	tls.Certificate,
+	*x509.CertPool,
+) {
+	cert, pool := selfSigned(t)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+
+	s := memcachetest.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	return s, cert, pool
+}
+
+func newTLSClient(
+	t *testing.T,
+	s *memcachetest.Server,
+	cfg *tls.Config,
+) *Client {
+	k := &ketama.Ketama{}
+	err := k.SetServers([]ketama.Server{{Addr: s.Addr(), TLS: cfg}})
+	if err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+
+	c := New(k)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestTLS(t *testing.T) {
+	s, cert, pool := newTLSServer(t)
+	c := newTLSClient(t, s, &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	})
+	ctx := context.Background()
+
+	err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar")})
+	if err != nil {
+		t.Fatalf("Set over TLS: %s", err)
+	}
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get over TLS: %s", err)
+	}
+	if string(it.Value) != "bar" {
+		t.Errorf("Get returned %q, want bar", it.Value)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	s, cert, pool := newTLSServer(t)
+	c := newTLSClient(t, s, &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		ServerName:   "memcached.example.com",
+	})
+
+	if _, err := c.Get(context.Background(), "foo"); err == nil {
+		t.Errorf("Certificate for wrong server name was accepted")
+	}
+}
+
+func TestTLSUnknownCA(t *testing.T) {
+	s, cert, _ := newTLSServer(t)
+	_, otherPool := selfSigned(t)
+	c := newTLSClient(t, s, &tls.Config{
+		RootCAs:      otherPool,
+		Certificates: []tls.Certificate{cert},
+	})
+
+	if _, err := c.Get(context.Background(), "foo"); err == nil {
+		t.Errorf("Certificate signed by unknown CA was accepted")
+	}
+}
+
+func TestTLSClientCertificateRequired(t *testing.T) {
+	s, _, pool := newTLSServer(t)
+	c := newTLSClient(t, s, &tls.Config{RootCAs: pool})
+
+	if _, err := c.Get(context.Background(), "foo"); err == nil {
+		t.Errorf("Server accepted client without certificate")
+	}
+}
+
+func TestTLSClientDefault(t *testing.T) {
+	s, cert, pool := newTLSServer(t)
+	c := newTLSClient(t, s, nil)
+	c.TLSConfig = &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if _, err := c.Get(context.Background(), "foo"); err != ErrCacheMiss {
+		t.Errorf("Get over TLS = %v, want %v", err, ErrCacheMiss)
+	}
+}
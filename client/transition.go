@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// transitionPicker is implemented by selectors remembering previous owners of
+// keys after the server list changes, like *ketama.Ketama.
+type transitionPicker interface {
+	PickServerTransition(key string) (ketama.Transition, error)
+}
+
+// eachPrevious groups keys, which missed on the servers in from, by their
+// previous owners and calls fn for every group in parallel. Keys without
+// previous owner, or whose previous owner is the server they missed on, are
+// left out.
+func eachPrevious(
+	tp transitionPicker,
+	from map[string]net.Addr,
+	fn func(old net.Addr, keys []string),
+) {
+	groups := make(map[string][]string)
+	olds := make(map[string]net.Addr)
+	for key, addr := range from {
+		t, err := tp.PickServerTransition(key)
+		if err != nil || t.Old == nil || poolKey(t.Old) == poolKey(addr) {
+			continue
+		}
+		old := poolKey(t.Old)
+		groups[old] = append(groups[old], key)
+		olds[old] = t.Old
+	}
+
+	var wg sync.WaitGroup
+	for old, keys := range groups {
+		wg.Add(1)
+		go func(old net.Addr, keys []string) {
+			defer wg.Done()
+			fn(old, keys)
+		}(olds[old], keys)
+	}
+	wg.Wait()
+}
+
+// getPrevious gets keys, which missed on the servers in from, from their
+// previous owners and copies them forward if configured. Keys missing there as
+// well, or whose previous owner fails, are left out, the previous owner is
+// only a fallback.
+func (c *Client) getPrevious(
+	ctx context.Context,
+	tp transitionPicker,
+	from map[string]net.Addr,
+) map[string]*Item {
+	var m sync.Mutex
+	items := make(map[string]*Item)
+	eachPrevious(tp, from, func(old net.Addr, keys []string) {
+		found := c.getFrom(ctx, old, keys, from)
+
+		m.Lock()
+		for _, it := range found {
+			items[it.Key] = it
+		}
+		m.Unlock()
+	})
+	return items
+}
+
+// getFrom gets keys from their previous owner old and copies them forward to
+// the servers in to if configured.
+func (c *Client) getFrom(
+	ctx context.Context,
+	old net.Addr,
+	keys []string,
+	to map[string]net.Addr,
+) []*Item {
+	if c.CopyForward && c.Protocol == Text {
+		found, err := c.metaGetFrom(ctx, old, keys, nil, MetaGetOptions{})
+		switch {
+		case err == nil:
+			items := make([]*Item, 0, len(found))
+			for _, mi := range found {
+				c.copyForward(ctx, to[mi.Key], &mi.Item,
+					mi.TTLExpiration())
+				items = append(items, &mi.Item)
+			}
+			return items
+		case !errors.Is(err, ErrClientError) &&
+			!errors.Is(err, ErrProtocol):
+
+			return nil
+		}
+		// The previous owner does not understand meta get, the items
+		// are read without TTL and not copied.
+	}
+
+	var items []*Item
+	err := c.withAddr(ctx, "get", old, func(cn *conn) error {
+		return c.proto().get(cn.rw, keys, func(it *Item) {
+			items = append(items, it)
+		})
+	})
+	if err != nil {
+		return nil
+	}
+	return items
+}
+
+// metaGetPrevious is getPrevious of the meta commands. Keys are sent as in
+// wireKeys. Items are copied forward only when opts ask for the value.
+// Options changing the item are not applied to the previous owners, nothing
+// is read from them in that case.
+func (c *Client) metaGetPrevious(
+	ctx context.Context,
+	tp transitionPicker,
+	from map[string]net.Addr,
+	wireKeys map[string]string,
+	opts MetaGetOptions,
+) map[string]*MetaItem {
+	if opts.mutates() {
+		return nil
+	}
+
+	var m sync.Mutex
+	items := make(map[string]*MetaItem)
+	eachPrevious(tp, from, func(old net.Addr, keys []string) {
+		found, err := c.metaGetFrom(ctx, old, keys, wireKeys, opts)
+		if err != nil {
+			return
+		}
+
+		for _, mi := range found {
+			if c.CopyForward && !opts.NoValue {
+				c.copyForward(ctx, from[mi.Key], &mi.Item,
+					mi.TTLExpiration())
+			}
+		}
+
+		m.Lock()
+		for _, mi := range found {
+			items[mi.Key] = mi
+		}
+		m.Unlock()
+	})
+	return items
+}
+
+// metaGetFrom gets keys, sent as in wireKeys, from old using pipelined meta
+// get. Nil wireKeys means the keys are sent as they are.
+func (c *Client) metaGetFrom(
+	ctx context.Context,
+	old net.Addr,
+	keys []string,
+	wireKeys map[string]string,
+	opts MetaGetOptions,
+) ([]*MetaItem, error) {
+	if wireKeys == nil {
+		wireKeys = make(map[string]string, len(keys))
+		for _, key := range keys {
+			wireKeys[key] = key
+		}
+	}
+	flags := append(opts.flags(), "q")
+
+	var found []*MetaItem
+	err := c.withAddr(ctx, "meta_get", old, func(cn *conn) error {
+		return metaGetPipeline(cn.rw, keys, wireKeys, flags,
+			func(mi *MetaItem) {
+				found = append(found, mi)
+			})
+	})
+	return found, err
+}
+
+// getAndTouchPrevious is getPrevious of GetAndTouch. The item is touched on
+// the previous owner and copied forward with the new expiration.
+func (c *Client) getAndTouchPrevious(
+	ctx context.Context,
+	tp transitionPicker,
+	key string,
+	addr net.Addr,
+	expiration int32,
+) *Item {
+	var item *Item
+	from := map[string]net.Addr{key: addr}
+	eachPrevious(tp, from, func(old net.Addr, _ []string) {
+		err := c.withAddr(ctx, "get_and_touch", old, func(cn *conn) error {
+			return c.proto().getAndTouch(cn.rw, key, expiration,
+				func(it *Item) {
+					item = it
+				})
+		})
+		if err != nil {
+			item = nil
+		}
+	})
+
+	if item != nil && c.CopyForward && c.Protocol == Text {
+		c.copyForward(ctx, addr, item, expiration)
+	}
+	return item
+}
+
+// copyForward adds item, read from the previous owner of its key, to addr with
+// expiration.
+func (c *Client) copyForward(
+	ctx context.Context,
+	addr net.Addr,
+	item *Item,
+	expiration int32,
+) {
+	// Add does not overwrite item written to the new owner in the
+	// meantime.
+	it := *item
+	it.Expiration = expiration
+	c.withAddr(ctx, "add", addr, func(cn *conn) error {
+		return c.proto().store(cn.rw, "add", &it)
+	})
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/memcachetest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// newTransitionClient returns client of two servers which just got the second
+// server added, with the keys stored on the first one only.
+func newTransitionClient(
+	t *testing.T,
+	keys []string,
+) (*Client, *ketama.Ketama, []*memcachetest.Server) {
+	servers := newTestServers(t, 2)
+
+	k := &ketama.Ketama{}
+	k.SetTransitionWindow(time.Minute)
+	k.SetServersAddr([]net.Addr{servers[0].Addr()})
+
+	c := New(k)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+
+	for _, key := range keys {
+		err := c.Set(context.Background(), &Item{
+			Key:        key,
+			Value:      []byte("x"),
+			Expiration: 100,
+		})
+		if err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+	}
+
+	k.SetServersAddr([]net.Addr{servers[0].Addr(), servers[1].Addr()})
+	return c, k, servers
+}
+
+func transitionKeys() []string {
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestTransitionRetry(t *testing.T) {
+	keys := transitionKeys()
+	c, k, servers := newTransitionClient(t, keys)
+
+	moved := 0
+	for _, key := range keys {
+		if tr, _ := k.PickServerTransition(key); tr.Old != nil {
+			moved++
+		}
+		if _, err := c.Get(context.Background(), key); err != nil {
+			t.Errorf("Get(%q) = %v, want nil", key, err)
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("No key moved")
+	}
+	if n := servers[1].Len(); n != 0 {
+		t.Errorf("%d items copied forward without CopyForward", n)
+	}
+}
+
+func TestTransitionCopyForward(t *testing.T) {
+	keys := transitionKeys()
+	c, k, servers := newTransitionClient(t, keys)
+	c.CopyForward = true
+
+	for _, key := range keys {
+		tr, _ := k.PickServerTransition(key)
+		if _, err := c.Get(context.Background(), key); err != nil {
+			t.Errorf("Get(%q) = %v, want nil", key, err)
+		}
+		if tr.Old == nil {
+			continue
+		}
+
+		it, ok := servers[1].Item(key)
+		if !ok {
+			t.Errorf("%q was not copied forward", key)
+			continue
+		}
+		if ttl := time.Until(it.Expires); ttl < 95*time.Second ||
+			ttl > 100*time.Second {
+
+			t.Errorf("%q copied with TTL %s, want about 100s", key, ttl)
+		}
+	}
+
+	if _, err := c.Get(context.Background(), "missing"); err != ErrCacheMiss {
+		t.Errorf("Get = %v, want %v", err, ErrCacheMiss)
+	}
+}
+
+func TestTransitionPreviousFails(t *testing.T) {
+	keys := transitionKeys()
+	c, k, servers := newTransitionClient(t, keys)
+	servers[0].Close()
+
+	var moved string
+	for _, key := range keys {
+		if tr, _ := k.PickServerTransition(key); tr.Old != nil {
+			moved = key
+			break
+		}
+	}
+	if moved == "" {
+		t.Fatalf("No key moved")
+	}
+
+	for _, copyForward := range []bool{false, true} {
+		c.CopyForward = copyForward
+		_, err := c.Get(context.Background(), moved)
+		if err != ErrCacheMiss {
+			t.Errorf("Get with CopyForward %v = %v, want %v",
+				copyForward, err, ErrCacheMiss)
+		}
+	}
+}
+
+func TestTransitionMulti(t *testing.T) {
+	keys := transitionKeys()
+	c, k, servers := newTransitionClient(t, keys)
+	c.CopyForward = true
+	ctx := context.Background()
+
+	items, err := c.GetMulti(ctx, append(keys, "missing"))
+	if err != nil {
+		t.Fatalf("GetMulti: %s", err)
+	}
+	if len(items) != len(keys) {
+		t.Errorf("GetMulti returned %d items, want %d",
+			len(items), len(keys))
+	}
+	for _, key := range keys {
+		if tr, _ := k.PickServerTransition(key); tr.Old == nil {
+			continue
+		}
+		if _, ok := servers[1].Item(key); !ok {
+			t.Errorf("%q was not copied forward", key)
+		}
+	}
+
+	metaItems, err := c.MetaGetMulti(ctx, keys, MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGetMulti: %s", err)
+	}
+	if len(metaItems) != len(keys) {
+		t.Errorf("MetaGetMulti returned %d items, want %d",
+			len(metaItems), len(keys))
+	}
+}
+
+func TestTransitionMetaGet(t *testing.T) {
+	keys := transitionKeys()
+	c, k, servers := newTransitionClient(t, keys)
+	ctx := context.Background()
+
+	var moved []string
+	for _, key := range keys {
+		if tr, _ := k.PickServerTransition(key); tr.Old != nil {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) < 2 {
+		t.Fatalf("%d keys moved, want at least 2", len(moved))
+	}
+
+	mi, err := c.MetaGet(ctx, moved[0], MetaGetOptions{})
+	if err != nil {
+		t.Fatalf("MetaGet(%q) = %v, want nil", moved[0], err)
+	}
+	if mi.TTL < 95 || mi.TTL > 100 {
+		t.Errorf("MetaGet TTL = %d, want about 100", mi.TTL)
+	}
+
+	// Changing the item on the previous owner is not done.
+	opts := MetaGetOptions{UpdateTTL: true, TTL: 50}
+	if _, err := c.MetaGet(ctx, moved[1], opts); err != ErrCacheMiss {
+		t.Errorf("MetaGet with UpdateTTL = %v, want %v",
+			err, ErrCacheMiss)
+	}
+	if n := servers[1].Len(); n != 0 {
+		t.Errorf("%d items copied forward without CopyForward", n)
+	}
+}
+
+func TestTransitionGetAndTouch(t *testing.T) {
+	keys := transitionKeys()
+	c, k, servers := newTransitionClient(t, keys)
+	c.CopyForward = true
+
+	for _, key := range keys {
+		tr, _ := k.PickServerTransition(key)
+		_, err := c.GetAndTouch(context.Background(), key, 200)
+		if err != nil {
+			t.Errorf("GetAndTouch(%q) = %v, want nil", key, err)
+		}
+		if tr.Old == nil {
+			continue
+		}
+
+		it, ok := servers[1].Item(key)
+		if !ok {
+			t.Errorf("%q was not copied forward", key)
+			continue
+		}
+		if ttl := time.Until(it.Expires); ttl < 195*time.Second ||
+			ttl > 200*time.Second {
+
+			t.Errorf("%q copied with TTL %s, want about 200s", key, ttl)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Command selectorsim compares server selectors of this repository on the same
+// server list and key set, see package serverlist/compare.
+//
+// Usage:
+//
+//	selectorsim [-servers n | -server-file file] [-keys n | -key-file file]
+//	            [-lookups n] [-json]
+//
+// Server file holds one server per line, address optionally followed by
+// weight ("10.0.0.1:11211 2"). Key file holds one key per line.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/compare"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func die(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "selectorsim: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func syntheticServers(n int) []ketama.Server {
+	servers := make([]ketama.Server, n)
+	for i := range servers {
+		servers[i].Addr = &net.TCPAddr{
+			IP:   net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+			Port: 11211,
+		}
+	}
+	return servers
+}
+
+func readLines(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func readServers(path string) ([]ketama.Server, error) {
+	var servers []ketama.Server
+	err := readLines(path, func(line string) error {
+		f := strings.Fields(line)
+
+		addr, err := net.ResolveTCPAddr("tcp", f[0])
+		if err != nil {
+			return err
+		}
+		server := ketama.Server{Addr: addr}
+		if len(f) > 1 {
+			if server.Weight, err = strconv.Atoi(f[1]); err != nil {
+				return fmt.Errorf("weight of %s: %w", f[0], err)
+			}
+		}
+
+		servers = append(servers, server)
+		return nil
+	})
+	return servers, err
+}
+
+func readKeys(path string) ([]string, error) {
+	var keys []string
+	err := readLines(path, func(line string) error {
+		keys = append(keys, line)
+		return nil
+	})
+	return keys, err
+}
+
+func main() {
+	nServers := flag.Int("servers", 10, "number of synthetic servers")
+	serverFile := flag.String("server-file", "", "file with servers")
+	nKeys := flag.Int("keys", 100000, "number of synthetic keys")
+	keyFile := flag.String("key-file", "", "file with keys")
+	lookups := flag.Int("lookups", 0, "number of lookups to time, "+
+		"defaults to number of keys")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	cfg := compare.Config{Lookups: *lookups}
+
+	var err error
+	if *serverFile != "" {
+		if cfg.Servers, err = readServers(*serverFile); err != nil {
+			die("%s", err)
+		}
+	} else {
+		cfg.Servers = syntheticServers(*nServers)
+	}
+
+	if *keyFile != "" {
+		if cfg.Keys, err = readKeys(*keyFile); err != nil {
+			die("%s", err)
+		}
+	} else {
+		cfg.Keys = compare.SyntheticKeys(*nKeys)
+	}
+	if len(cfg.Keys) == 0 {
+		die("%s", compare.ErrNoKeys)
+	}
+
+	report := compare.Run(cfg, compare.Selectors())
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		_, err = report.WriteTo(os.Stdout)
+	}
+	if err != nil {
+		die("%s", err)
+	}
+}
@@ -0,0 +1,316 @@
+package memcachetest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+const (
+	magicRequest  = 0x80
+	magicResponse = 0x81
+)
+
+const (
+	statusOK             = 0x00
+	statusKeyNotFound    = 0x01
+	statusKeyExists      = 0x02
+	statusInvalidArgs    = 0x04
+	statusNotStored      = 0x05
+	statusNonNumeric     = 0x06
+	statusAuthError      = 0x20
+	statusUnknownCommand = 0x81
+)
+
+var opcodeNames = map[uint8]string{
+	0x00: "get",
+	0x01: "set",
+	0x02: "add",
+	0x03: "replace",
+	0x04: "delete",
+	0x05: "increment",
+	0x06: "decrement",
+	0x07: "quit",
+	0x08: "flush",
+	0x09: "getq",
+	0x0a: "noop",
+	0x0b: "version",
+	0x0c: "getk",
+	0x0d: "getkq",
+	0x0e: "append",
+	0x0f: "prepend",
+	0x10: "stat",
+	0x1c: "touch",
+	0x1d: "gat",
+	0x1e: "gatq",
+	0x20: "sasl_list_mechs",
+	0x21: "sasl_auth",
+}
+
+type request struct {
+	opcode uint8
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func readRequest(r *bufio.Reader) (*request, error) {
+	var h [24]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0] != magicRequest {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(h[2:]))
+	extrasLen := int(h[4])
+	bodyLen := int(binary.BigEndian.Uint32(h[8:]))
+	if keyLen+extrasLen > bodyLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &request{
+		opcode: h[1],
+		opaque: binary.BigEndian.Uint32(h[12:]),
+		cas:    binary.BigEndian.Uint64(h[16:]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : extrasLen+keyLen],
+		value:  body[extrasLen+keyLen:],
+	}, nil
+}
+
+type response struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func writeResponse(w io.Writer, req *request, resp *response) {
+	var h [24]byte
+
+	h[0] = magicResponse
+	h[1] = req.opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(resp.key)))
+	h[4] = uint8(len(resp.extras))
+	binary.BigEndian.PutUint16(h[6:], resp.status)
+	binary.BigEndian.PutUint32(h[8:],
+		uint32(len(resp.extras)+len(resp.key)+len(resp.value)))
+	binary.BigEndian.PutUint32(h[12:], req.opaque)
+	binary.BigEndian.PutUint64(h[16:], resp.cas)
+
+	w.Write(h[:])
+	w.Write(resp.extras)
+	w.Write(resp.key)
+	w.Write(resp.value)
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func (s *Server) handleBinary(rw *bufio.ReadWriter) {
+	authenticated := false
+
+	for {
+		req, err := readRequest(rw.Reader)
+		if err != nil {
+			return
+		}
+
+		name, ok := opcodeNames[req.opcode]
+		if !ok {
+			name = "unknown"
+		}
+		s.count(name)
+
+		if name == "quit" {
+			return
+		}
+
+		var resp *response
+		switch {
+		case name == "sasl_list_mechs":
+			resp = &response{value: []byte("PLAIN")}
+		case name == "sasl_auth":
+			resp = s.binaryAuth(req)
+			authenticated = resp.status == statusOK
+		case s.authRequired() && !authenticated:
+			resp = &response{
+				status: statusAuthError,
+				value:  []byte("Auth failure"),
+			}
+		default:
+			resp = s.binaryCommand(rw, name, req)
+		}
+
+		if resp != nil {
+			writeResponse(rw, req, resp)
+		}
+
+		// Quiet commands are answered together with the next loud one.
+		if rw.Reader.Buffered() == 0 {
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) binaryAuth(req *request) *response {
+	fail := &response{status: statusAuthError, value: []byte("Auth failure")}
+
+	if string(req.key) != "PLAIN" {
+		return fail
+	}
+
+	parts := bytes.Split(req.value, []byte{0})
+	if len(parts) != 3 || !s.checkAuth(string(parts[1]), string(parts[2])) {
+		return fail
+	}
+
+	return &response{value: []byte("Authenticated")}
+}
+
+// binaryCommand handles single request. Nil response means nothing should be
+// sent (quiet commands).
+func (s *Server) binaryCommand(
+	rw *bufio.ReadWriter,
+	name string,
+	req *request,
+) *response {
+	key := string(req.key)
+	quiet := name == "getq" || name == "getkq" || name == "gatq"
+
+	switch name {
+	case "get", "getq", "getk", "getkq", "gat", "gatq":
+		var touch *int64
+		if name == "gat" || name == "gatq" {
+			if len(req.extras) != 4 {
+				return &response{status: statusInvalidArgs}
+			}
+			exp := int64(int32(binary.BigEndian.Uint32(req.extras)))
+			touch = &exp
+		}
+
+		it, ok := s.get(key, touch)
+		if !ok {
+			if quiet {
+				return nil
+			}
+			return &response{
+				status: statusKeyNotFound,
+				value:  []byte("Not found"),
+			}
+		}
+
+		resp := &response{
+			cas:    it.CAS,
+			extras: uint32Bytes(it.Flags),
+			value:  it.Value,
+		}
+		if name == "getk" || name == "getkq" {
+			resp.key = req.key
+		}
+		return resp
+	case "set", "add", "replace", "append", "prepend":
+		var flags uint32
+		var exp int64
+		if name != "append" && name != "prepend" {
+			if len(req.extras) != 8 {
+				return &response{status: statusInvalidArgs}
+			}
+			flags = binary.BigEndian.Uint32(req.extras)
+			exp = int64(int32(binary.BigEndian.Uint32(req.extras[4:])))
+		}
+
+		mode := name
+		if name == "set" && req.cas != 0 {
+			mode = "cas"
+		}
+		value := append([]byte(nil), req.value...)
+
+		res, cas := s.store(mode, key, flags, exp, value, req.cas)
+		switch {
+		case res == resStored:
+			return &response{cas: cas}
+		case res == resNotStored && name == "add":
+			return &response{status: statusKeyExists}
+		case res == resNotStored && name == "replace":
+			return &response{status: statusKeyNotFound}
+		case res == resNotStored:
+			return &response{status: statusNotStored}
+		case res == resExists:
+			return &response{status: statusKeyExists}
+		default:
+			return &response{status: statusKeyNotFound}
+		}
+	case "delete":
+		if !s.delete(key) {
+			return &response{status: statusKeyNotFound}
+		}
+		return &response{}
+	case "increment", "decrement":
+		if len(req.extras) != 20 {
+			return &response{status: statusInvalidArgs}
+		}
+		delta := binary.BigEndian.Uint64(req.extras)
+
+		val, res := s.incrDecr(key, name == "increment", delta)
+		switch res {
+		case resNotFound:
+			return &response{status: statusKeyNotFound}
+		case resNonNumeric:
+			return &response{
+				status: statusNonNumeric,
+				value:  []byte("Non-numeric server-side value for incr or decr"),
+			}
+		}
+
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, val)
+		return &response{value: b}
+	case "touch":
+		if len(req.extras) != 4 {
+			return &response{status: statusInvalidArgs}
+		}
+		exp := int64(int32(binary.BigEndian.Uint32(req.extras)))
+		if !s.touch(key, exp) {
+			return &response{status: statusKeyNotFound}
+		}
+		return &response{}
+	case "flush":
+		s.flush()
+		return &response{}
+	case "noop":
+		return &response{}
+	case "version":
+		return &response{value: []byte(version)}
+	case "stat":
+		for _, stat := range s.stats() {
+			writeResponse(rw, req, &response{
+				key:   []byte(stat[0]),
+				value: []byte(stat[1]),
+			})
+		}
+		return &response{}
+	}
+
+	return &response{
+		status: statusUnknownCommand,
+		value:  []byte("Unknown command " + strconv.Itoa(int(req.opcode))),
+	}
+}
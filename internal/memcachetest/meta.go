@@ -0,0 +1,469 @@
+package memcachetest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metaFlag is single flag of meta command with its (possibly empty) token.
+type metaFlag struct {
+	flag  byte
+	token string
+}
+
+type metaFlags []metaFlag
+
+func parseMetaFlags(f []string) metaFlags {
+	flags := make(metaFlags, 0, len(f))
+	for _, s := range f {
+		flags = append(flags, metaFlag{flag: s[0], token: s[1:]})
+	}
+	return flags
+}
+
+func (fs metaFlags) has(flag byte) bool {
+	_, ok := fs.token(flag)
+	return ok
+}
+
+func (fs metaFlags) token(flag byte) (string, bool) {
+	for _, f := range fs {
+		if f.flag == flag {
+			return f.token, true
+		}
+	}
+	return "", false
+}
+
+// number returns numeric token of flag. ok is false when the flag is not
+// present.
+func (fs metaFlags) number(flag byte) (v int64, ok bool, err error) {
+	token, ok := fs.token(flag)
+	if !ok {
+		return 0, false, nil
+	}
+	v, err = strconv.ParseInt(token, 10, 64)
+	return v, true, err
+}
+
+// unumber is number for unsigned values (CAS, deltas).
+func (fs metaFlags) unumber(flag byte) (v uint64, ok bool, err error) {
+	token, ok := fs.token(flag)
+	if !ok {
+		return 0, false, nil
+	}
+	v, err = strconv.ParseUint(token, 10, 64)
+	return v, true, err
+}
+
+type metaResponse struct {
+	code  string
+	flags []string
+	value []byte
+}
+
+var errBadFormat = &metaResponse{code: "CLIENT_ERROR bad command line format"}
+
+// quietCodes are response codes suppressed by the q flag.
+var quietCodes = map[string]map[string]bool{
+	"mg": {"EN": true},
+	"ms": {"HD": true},
+	"md": {"HD": true, "NF": true},
+	"ma": {"HD": true, "NF": true},
+}
+
+func (s *Server) metaCommand(rw *bufio.ReadWriter, f []string) error {
+	if f[0] == "mn" {
+		fmt.Fprint(rw, "MN\r\n")
+		return nil
+	}
+
+	if len(f) < 2 || (f[0] == "ms" && len(f) < 3) {
+		fmt.Fprint(rw, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	key, rest := f[1], f[2:]
+
+	var data []byte
+	if f[0] == "ms" {
+		size, err := strconv.Atoi(f[2])
+		if err != nil || size < 0 {
+			fmt.Fprint(rw, "CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+
+		data = make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return err
+		}
+		if string(data[size:]) != "\r\n" {
+			fmt.Fprint(rw, "CLIENT_ERROR bad data chunk\r\n")
+			return nil
+		}
+		data = data[:size]
+		rest = f[3:]
+	}
+
+	flags := parseMetaFlags(rest)
+	if flags.has('b') {
+		k, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			fmt.Fprint(rw, "CLIENT_ERROR error decoding key\r\n")
+			return nil
+		}
+		key = string(k)
+	}
+
+	var resp *metaResponse
+	switch f[0] {
+	case "mg":
+		resp = s.metaGet(key, flags)
+	case "ms":
+		resp = s.metaSet(key, data, flags)
+	case "md":
+		resp = s.metaDelete(key, flags)
+	case "ma":
+		resp = s.metaArithmetic(key, flags)
+	}
+
+	if strings.HasPrefix(resp.code, "CLIENT_ERROR") {
+		fmt.Fprintf(rw, "%s\r\n", resp.code)
+		return nil
+	}
+	if flags.has('q') && quietCodes[f[0]][resp.code] {
+		return nil
+	}
+
+	line := []string{resp.code}
+	if resp.code == "VA" {
+		line = append(line, strconv.Itoa(len(resp.value)))
+	}
+	line = append(line, resp.flags...)
+
+	for _, fl := range flags {
+		switch fl.flag {
+		case 'O':
+			line = append(line, "O"+fl.token)
+		case 'k':
+			if flags.has('b') {
+				line = append(line,
+					"k"+base64.StdEncoding.EncodeToString([]byte(key)), "b")
+			} else {
+				line = append(line, "k"+key)
+			}
+		}
+	}
+
+	fmt.Fprintf(rw, "%s\r\n", strings.Join(line, " "))
+	if resp.code == "VA" {
+		rw.Write(resp.value)
+		fmt.Fprint(rw, "\r\n")
+	}
+	return nil
+}
+
+// remaining returns remaining TTL of it in seconds, -1 for items which do not
+// expire.
+func remaining(it *Item, now time.Time) int64 {
+	if it.Expires.IsZero() {
+		return -1
+	}
+	return int64((it.Expires.Sub(now) + time.Second - 1) / time.Second)
+}
+
+func (s *Server) metaGet(key string, fs metaFlags) *metaResponse {
+	vivify, doVivify, err1 := fs.number('N')
+	recache, doRecache, err2 := fs.number('R')
+	ttl, doTouch, err3 := fs.number('T')
+	if err1 != nil || err2 != nil || err3 != nil {
+		return errBadFormat
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+	won, alreadyWon := false, false
+
+	if it == nil {
+		if !doVivify {
+			return &metaResponse{code: "EN"}
+		}
+
+		// Vivified item is empty and the client gets the right to fill
+		// it.
+		s.cas++
+		it = &Item{
+			CAS:        s.cas,
+			Expires:    expiration(vivify, now),
+			LastAccess: now,
+			winSent:    true,
+		}
+		s.items[key] = it
+		won = true
+	} else {
+		recacheWin := doRecache && remaining(it, now) != -1 &&
+			remaining(it, now) < recache
+
+		switch {
+		case it.winSent:
+			alreadyWon = true
+		case it.Stale || recacheWin:
+			it.winSent = true
+			won = true
+		}
+	}
+
+	if doTouch {
+		it.Expires = expiration(ttl, now)
+	}
+
+	resp := &metaResponse{code: "HD"}
+	if fs.has('v') {
+		resp.code = "VA"
+		resp.value = it.Value
+	}
+
+	for _, f := range fs {
+		var flag string
+		switch f.flag {
+		case 'c':
+			flag = fmt.Sprintf("c%d", it.CAS)
+		case 'f':
+			flag = fmt.Sprintf("f%d", it.Flags)
+		case 's':
+			flag = fmt.Sprintf("s%d", len(it.Value))
+		case 't':
+			flag = fmt.Sprintf("t%d", remaining(it, now))
+		case 'l':
+			flag = fmt.Sprintf("l%d", int64(now.Sub(it.LastAccess)/time.Second))
+		case 'h':
+			if it.Fetched {
+				flag = "h1"
+			} else {
+				flag = "h0"
+			}
+		default:
+			continue
+		}
+		resp.flags = append(resp.flags, flag)
+	}
+
+	if won {
+		resp.flags = append(resp.flags, "W")
+	}
+	if it.Stale {
+		resp.flags = append(resp.flags, "X")
+	}
+	if alreadyWon {
+		resp.flags = append(resp.flags, "Z")
+	}
+
+	it.Fetched = true
+	it.LastAccess = now
+	return resp
+}
+
+func (s *Server) metaSet(key string, data []byte, fs metaFlags) *metaResponse {
+	flags, _, err1 := fs.unumber('F')
+	ttl, _, err2 := fs.number('T')
+	cas, compare, err3 := fs.unumber('C')
+	if err1 != nil || err2 != nil || err3 != nil || flags > 1<<32-1 {
+		return errBadFormat
+	}
+
+	mode := "S"
+	if m, ok := fs.token('M'); ok {
+		mode = strings.ToUpper(m)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+	stale := false
+
+	if compare {
+		if it == nil {
+			return &metaResponse{code: "NF"}
+		}
+		if it.CAS != cas {
+			// With invalidation older CAS is stored, but marked stale.
+			if !fs.has('I') || cas > it.CAS {
+				return &metaResponse{code: "EX"}
+			}
+			stale = true
+		}
+	}
+
+	switch mode {
+	case "S":
+	case "E":
+		if it != nil {
+			return &metaResponse{code: "NS"}
+		}
+	case "R", "A", "P":
+		if it == nil {
+			return &metaResponse{code: "NS"}
+		}
+	default:
+		return errBadFormat
+	}
+
+	s.cas++
+	switch mode {
+	case "A":
+		it.Value = append(append([]byte(nil), it.Value...), data...)
+		it.CAS = s.cas
+	case "P":
+		it.Value = append(append([]byte(nil), data...), it.Value...)
+		it.CAS = s.cas
+	default:
+		s.items[key] = &Item{
+			Value:      data,
+			Flags:      uint32(flags),
+			CAS:        s.cas,
+			Expires:    expiration(ttl, now),
+			Stale:      stale,
+			LastAccess: now,
+		}
+	}
+
+	resp := &metaResponse{code: "HD"}
+	if fs.has('c') {
+		resp.flags = append(resp.flags, fmt.Sprintf("c%d", s.cas))
+	}
+	return resp
+}
+
+func (s *Server) metaDelete(key string, fs metaFlags) *metaResponse {
+	cas, compare, err1 := fs.unumber('C')
+	ttl, doTouch, err2 := fs.number('T')
+	if err1 != nil || err2 != nil {
+		return errBadFormat
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+	if it == nil {
+		return &metaResponse{code: "NF"}
+	}
+	if compare && it.CAS != cas {
+		return &metaResponse{code: "EX"}
+	}
+
+	if !fs.has('I') {
+		delete(s.items, key)
+		return &metaResponse{code: "HD"}
+	}
+
+	// Invalidated item stays, the next reader gets the right to recache it.
+	it.Stale = true
+	it.winSent = false
+	if doTouch {
+		it.Expires = expiration(ttl, now)
+	}
+	return &metaResponse{code: "HD"}
+}
+
+func (s *Server) metaArithmetic(key string, fs metaFlags) *metaResponse {
+	vivify, doVivify, err1 := fs.number('N')
+	initial, _, err2 := fs.unumber('J')
+	delta, ok, err3 := fs.unumber('D')
+	ttl, doTouch, err4 := fs.number('T')
+	cas, compare, err5 := fs.unumber('C')
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil ||
+		err5 != nil {
+
+		return errBadFormat
+	}
+	if !ok {
+		delta = 1
+	}
+
+	incr := true
+	if m, ok := fs.token('M'); ok {
+		switch strings.ToUpper(m) {
+		case "I", "+":
+		case "D", "-":
+			incr = false
+		default:
+			return errBadFormat
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+
+	var val uint64
+	switch {
+	case it == nil && !doVivify:
+		return &metaResponse{code: "NF"}
+	case it == nil:
+		s.cas++
+		it = &Item{
+			CAS:        s.cas,
+			Expires:    expiration(vivify, now),
+			LastAccess: now,
+		}
+		s.items[key] = it
+		val = initial
+	default:
+		if compare && it.CAS != cas {
+			return &metaResponse{code: "EX"}
+		}
+
+		var err error
+		val, err = strconv.ParseUint(string(it.Value), 10, 64)
+		if err != nil {
+			return &metaResponse{
+				code: "CLIENT_ERROR cannot increment or decrement non-numeric value",
+			}
+		}
+
+		if incr {
+			val += delta
+		} else if delta > val {
+			val = 0
+		} else {
+			val -= delta
+		}
+
+		s.cas++
+		it.CAS = s.cas
+	}
+
+	it.Value = []byte(strconv.FormatUint(val, 10))
+	if doTouch {
+		it.Expires = expiration(ttl, now)
+	}
+
+	resp := &metaResponse{code: "HD"}
+	if fs.has('v') {
+		resp.code = "VA"
+		resp.value = it.Value
+	}
+	for _, f := range fs {
+		switch f.flag {
+		case 'c':
+			resp.flags = append(resp.flags, fmt.Sprintf("c%d", it.CAS))
+		case 't':
+			resp.flags = append(resp.flags,
+				fmt.Sprintf("t%d", remaining(it, now)))
+		}
+	}
+	return resp
+}
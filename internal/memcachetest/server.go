@@ -0,0 +1,393 @@
+/*
+Package memcachetest provides in-process fake memcached server speaking text
+(including the meta commands) and binary protocols. It is meant to be used
+from tests only, it does not try to be complete nor fast.
+*/
+package memcachetest
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Item is single item stored in the Server.
+type Item struct {
+	Value   []byte
+	Flags   uint32
+	CAS     uint64
+	Expires time.Time
+
+	// Meta protocol's metadata.
+	Stale      bool
+	Fetched    bool
+	LastAccess time.Time
+	winSent    bool
+}
+
+func (it *Item) expired(now time.Time) bool {
+	return !it.Expires.IsZero() && !now.Before(it.Expires)
+}
+
+// Server is fake memcached server listening on local TCP port.
+type Server struct {
+	ln net.Listener
+
+	m        sync.Mutex
+	items    map[string]*Item
+	cas      uint64
+	cmds     map[string]int
+	conns    map[net.Conn]struct{}
+	username string
+	password string
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts new Server listening on random port on 127.0.0.1.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	return Serve(ln), nil
+}
+
+// Serve starts new Server accepting connections from ln.
+func Serve(ln net.Listener) *Server {
+	s := &Server{
+		ln:    ln,
+		items: make(map[string]*Item),
+		cmds:  make(map[string]int),
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Addr returns address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops the server and closes all open connections.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.m.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.m.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// RequireAuth makes the server require SASL PLAIN authentication with given
+// credentials. As real memcached, server requiring authentication speaks only
+// the binary protocol.
+func (s *Server) RequireAuth(username string, password string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.username = username
+	s.password = password
+}
+
+// Item returns copy of item stored under key.
+func (s *Server) Item(key string) (Item, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	it, ok := s.items[key]
+	if !ok || it.expired(time.Now()) {
+		return Item{}, false
+	}
+	return *it, true
+}
+
+// SetItem stores it under key, bypassing the protocol. CAS value is assigned
+// by the server, zero LastAccess means now.
+func (s *Server) SetItem(key string, it Item) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if it.LastAccess.IsZero() {
+		it.LastAccess = time.Now()
+	}
+
+	s.cas++
+	it.CAS = s.cas
+	s.items[key] = &it
+}
+
+// Len returns number of (not expired) items stored in the server.
+func (s *Server) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, it := range s.items {
+		if !it.expired(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Commands returns how many times was command cmd (for example "get")
+// received. Binary protocol commands are named by their lowercase opcode
+// names, for example "getkq" or "sasl_auth".
+func (s *Server) Commands(cmd string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.cmds[cmd]
+}
+
+func (s *Server) count(cmd string) {
+	s.m.Lock()
+	s.cmds[cmd]++
+	s.m.Unlock()
+}
+
+func (s *Server) authRequired() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.username != ""
+}
+
+func (s *Server) checkAuth(username string, password string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.username == username && s.password == password
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.m.Lock()
+		s.conns[c] = struct{}{}
+		s.m.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+
+			s.m.Lock()
+			delete(s.conns, c)
+			s.m.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+
+	// Protocol is decided by the first byte, the same way memcached does
+	// it.
+	b, err := rw.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if b[0] == magicRequest {
+		s.handleBinary(rw)
+	} else {
+		s.handleText(rw)
+	}
+}
+
+// result of storage operations.
+type result int
+
+const (
+	resStored result = iota
+	resNotStored
+	resExists
+	resNotFound
+	resNonNumeric
+)
+
+func expiration(exp int64, now time.Time) time.Time {
+	switch {
+	case exp == 0:
+		return time.Time{}
+	case exp < 0:
+		return now
+	case exp <= 60*60*24*30:
+		return now.Add(time.Duration(exp) * time.Second)
+	default:
+		return time.Unix(exp, 0)
+	}
+}
+
+// lookup returns live item stored under key. Caller must hold the lock.
+func (s *Server) lookup(key string, now time.Time) *Item {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if it.expired(now) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+// get returns copy of the item stored under key. When touch is not nil, the
+// expiration is updated.
+func (s *Server) get(key string, touch *int64) (Item, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+	if it == nil {
+		return Item{}, false
+	}
+	if touch != nil {
+		it.Expires = expiration(*touch, now)
+	}
+	return *it, true
+}
+
+// store implements storage commands. mode is one of set, add, replace,
+// append, prepend and cas.
+func (s *Server) store(
+	mode string,
+	key string,
+	flags uint32,
+	exp int64,
+	data []byte,
+	cas uint64,
+) (result, uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+
+	switch mode {
+	case "add":
+		if it != nil {
+			return resNotStored, 0
+		}
+	case "replace", "append", "prepend":
+		if it == nil {
+			return resNotStored, 0
+		}
+	case "cas":
+		if it == nil {
+			return resNotFound, 0
+		}
+		if it.CAS != cas {
+			return resExists, 0
+		}
+	}
+
+	s.cas++
+	switch mode {
+	case "append":
+		it.Value = append(append([]byte(nil), it.Value...), data...)
+		it.CAS = s.cas
+	case "prepend":
+		it.Value = append(append([]byte(nil), data...), it.Value...)
+		it.CAS = s.cas
+	default:
+		s.items[key] = &Item{
+			Value:      data,
+			Flags:      flags,
+			CAS:        s.cas,
+			Expires:    expiration(exp, now),
+			LastAccess: now,
+		}
+	}
+
+	return resStored, s.cas
+}
+
+func (s *Server) delete(key string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.lookup(key, time.Now()) == nil {
+		return false
+	}
+	delete(s.items, key)
+	return true
+}
+
+func (s *Server) incrDecr(key string, incr bool, delta uint64) (uint64, result) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	it := s.lookup(key, time.Now())
+	if it == nil {
+		return 0, resNotFound
+	}
+	val, err := strconv.ParseUint(string(it.Value), 10, 64)
+	if err != nil {
+		return 0, resNonNumeric
+	}
+
+	if incr {
+		val += delta
+	} else if delta > val {
+		val = 0
+	} else {
+		val -= delta
+	}
+
+	s.cas++
+	it.Value = []byte(strconv.FormatUint(val, 10))
+	it.CAS = s.cas
+	return val, resStored
+}
+
+func (s *Server) touch(key string, exp int64) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	it := s.lookup(key, now)
+	if it == nil {
+		return false
+	}
+	it.Expires = expiration(exp, now)
+	return true
+}
+
+func (s *Server) flush() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.items = make(map[string]*Item)
+}
+
+func (s *Server) stats() [][2]string {
+	return [][2]string{
+		{"curr_items", strconv.Itoa(s.Len())},
+		{"version", version},
+	}
+}
+
+const version = "1.6.0-memcachetest"
@@ -0,0 +1,210 @@
+package memcachetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+func (s *Server) handleText(rw *bufio.ReadWriter) {
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(rw, "ERROR\r\n")
+			rw.Flush()
+			continue
+		}
+
+		if fields[0] == "quit" {
+			return
+		}
+
+		s.count(fields[0])
+
+		if s.authRequired() {
+			fmt.Fprint(rw, "CLIENT_ERROR unauthenticated\r\n")
+		} else if err := s.textCommand(rw, fields); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) textCommand(rw *bufio.ReadWriter, f []string) error {
+	switch f[0] {
+	case "get", "gets":
+		s.textGet(rw, f[0] == "gets", nil, f[1:])
+	case "gat", "gats":
+		if len(f) < 3 {
+			fmt.Fprint(rw, "ERROR\r\n")
+			return nil
+		}
+		exp, err := strconv.ParseInt(f[1], 10, 32)
+		if err != nil {
+			fmt.Fprint(rw, "CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+		s.textGet(rw, f[0] == "gats", &exp, f[2:])
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.textStore(rw, f)
+	case "delete":
+		s.textReply(rw, f, s.textDelete(f))
+	case "incr", "decr":
+		s.textReply(rw, f, s.textIncrDecr(f))
+	case "touch":
+		s.textReply(rw, f, s.textTouch(f))
+	case "flush_all":
+		s.flush()
+		s.textReply(rw, f, "OK")
+	case "version":
+		fmt.Fprintf(rw, "VERSION %s\r\n", version)
+	case "stats":
+		for _, stat := range s.stats() {
+			fmt.Fprintf(rw, "STAT %s %s\r\n", stat[0], stat[1])
+		}
+		fmt.Fprint(rw, "END\r\n")
+	case "mg", "ms", "md", "ma", "mn":
+		return s.metaCommand(rw, f)
+	case "verbosity":
+		s.textReply(rw, f, "OK")
+	default:
+		fmt.Fprint(rw, "ERROR\r\n")
+	}
+
+	return nil
+}
+
+func (s *Server) textReply(rw *bufio.ReadWriter, f []string, resp string) {
+	if f[len(f)-1] == "noreply" {
+		return
+	}
+	fmt.Fprintf(rw, "%s\r\n", resp)
+}
+
+func (s *Server) textGet(
+	rw *bufio.ReadWriter,
+	withCAS bool,
+	touch *int64,
+	keys []string,
+) {
+	for _, key := range keys {
+		it, ok := s.get(key, touch)
+		if !ok {
+			continue
+		}
+
+		if withCAS {
+			fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n",
+				key, it.Flags, len(it.Value), it.CAS)
+		} else {
+			fmt.Fprintf(rw, "VALUE %s %d %d\r\n",
+				key, it.Flags, len(it.Value))
+		}
+		rw.Write(it.Value)
+		fmt.Fprint(rw, "\r\n")
+	}
+	fmt.Fprint(rw, "END\r\n")
+}
+
+func (s *Server) textStore(rw *bufio.ReadWriter, f []string) error {
+	n := 5
+	if f[0] == "cas" {
+		n = 6
+	}
+	if len(f) < n {
+		fmt.Fprint(rw, "ERROR\r\n")
+		return nil
+	}
+
+	flags, err1 := strconv.ParseUint(f[2], 10, 32)
+	exp, err2 := strconv.ParseInt(f[3], 10, 32)
+	size, err3 := strconv.Atoi(f[4])
+	var cas uint64
+	var err4 error
+	if f[0] == "cas" {
+		cas, err4 = strconv.ParseUint(f[5], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil ||
+		size < 0 {
+
+		fmt.Fprint(rw, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		fmt.Fprint(rw, "CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+	data = data[:size]
+
+	res, _ := s.store(f[0], f[1], uint32(flags), exp, data, cas)
+	switch res {
+	case resStored:
+		s.textReply(rw, f, "STORED")
+	case resNotStored:
+		s.textReply(rw, f, "NOT_STORED")
+	case resExists:
+		s.textReply(rw, f, "EXISTS")
+	case resNotFound:
+		s.textReply(rw, f, "NOT_FOUND")
+	}
+	return nil
+}
+
+func (s *Server) textDelete(f []string) string {
+	if len(f) < 2 {
+		return "ERROR"
+	}
+
+	if !s.delete(f[1]) {
+		return "NOT_FOUND"
+	}
+	return "DELETED"
+}
+
+func (s *Server) textIncrDecr(f []string) string {
+	if len(f) < 3 {
+		return "ERROR"
+	}
+	delta, err := strconv.ParseUint(f[2], 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument"
+	}
+
+	val, res := s.incrDecr(f[1], f[0] == "incr", delta)
+	switch res {
+	case resNotFound:
+		return "NOT_FOUND"
+	case resNonNumeric:
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	}
+	return strconv.FormatUint(val, 10)
+}
+
+func (s *Server) textTouch(f []string) string {
+	if len(f) < 3 {
+		return "ERROR"
+	}
+	exp, err := strconv.ParseInt(f[2], 10, 32)
+	if err != nil {
+		return "CLIENT_ERROR invalid exptime argument"
+	}
+
+	if !s.touch(f[1], exp) {
+		return "NOT_FOUND"
+	}
+	return "TOUCHED"
+}
@@ -0,0 +1,121 @@
+/*
+Package serverlist provides pieces shared by the server lists built around
+ketama.Server (jump, rendezvous and maglev): validation of the servers, their
+weights and lookups, and the hash functions.
+*/
+package serverlist
+
+import (
+	"errors"
+	"net"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// ErrNilAddr is reported by Validate for server without address.
+var ErrNilAddr = errors.New("nil address")
+
+// Validate checks all servers. If any of them is invalid, returned error is
+// ketama.ServerErrors describing every invalid server.
+func Validate(servers []ketama.Server) error {
+	var errs ketama.ServerErrors
+
+	for i, server := range servers {
+		var err error
+		switch {
+		case server.Addr == nil:
+			err = ErrNilAddr
+		case server.Weight < 0:
+			err = ketama.ErrNegativeWeight
+		}
+		if err != nil {
+			errs = append(errs, &ketama.ServerError{
+				Index: i,
+				Addr:  server.Addr,
+				Err:   err,
+			})
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Weight returns weight of server. 0 is considered same as 1, the same way
+// Ketama does.
+func Weight(server ketama.Server) int {
+	if server.Weight == 0 {
+		return 1
+	}
+	return server.Weight
+}
+
+// SameSettings reports whether a and b have the same settings not affecting
+// placement of the keys: credentials, TLS and zone. It matches what Ketama
+// compares when the server list changes.
+func SameSettings(a ketama.Server, b ketama.Server) bool {
+	return a.Username == b.Username &&
+		a.Password == b.Password &&
+		a.TLS == b.TLS &&
+		a.Zone == b.Zone
+}
+
+// FromAddrs returns servers with addrs, all having weight of 1.
+func FromAddrs(addrs []net.Addr) []ketama.Server {
+	servers := make([]ketama.Server, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, ketama.Server{Addr: addr})
+	}
+	return servers
+}
+
+// Label returns string identifying addr, its network and address.
+func Label(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// Lookup returns the server with address addr from servers.
+func Lookup(servers []ketama.Server, addr net.Addr) (ketama.Server, bool) {
+	for _, server := range servers {
+		if server.Addr.Network() == addr.Network() &&
+			server.Addr.String() == addr.String() {
+
+			return server, true
+		}
+	}
+	return ketama.Server{}, false
+}
+
+// Each calls fn with every address of addrs, until fn returns an error.
+func Each(addrs []net.Addr, fn func(net.Addr) error) error {
+	for _, addr := range addrs {
+		if err := fn(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FNV1a returns 64-bit FNV-1a hash of s. Unlike hash/fnv it does not
+// allocate.
+func FNV1a(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// Mix is the finalizer of MurmurHash3, it makes every bit of the result depend
+// on every bit of h.
+func Mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,42 @@
+package serverlist
+
+import (
+	"crypto/tls"
+	"hash/fnv"
+	"testing"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func TestFNV1a(t *testing.T) {
+	for _, s := range []string{"", "a", "some-key"} {
+		h := fnv.New64a()
+		h.Write([]byte(s))
+		if got, want := FNV1a(s), h.Sum64(); got != want {
+			t.Errorf("FNV1a(%q) = %x, want %x", s, got, want)
+		}
+	}
+}
+
+func TestSameSettings(t *testing.T) {
+	a := ketama.Server{Username: "user", TLS: &tls.Config{}, Zone: "a"}
+
+	b := a
+	b.Weight = 5
+	if !SameSettings(a, b) {
+		t.Errorf("SameSettings = false for different weights, want true")
+	}
+
+	for _, change := range []func(*ketama.Server){
+		func(s *ketama.Server) { s.Username = "other" },
+		func(s *ketama.Server) { s.Password = "secret" },
+		func(s *ketama.Server) { s.TLS = &tls.Config{} },
+		func(s *ketama.Server) { s.Zone = "b" },
+	} {
+		b := a
+		change(&b)
+		if SameSettings(a, b) {
+			t.Errorf("SameSettings(%+v, %+v) = true, want false", a, b)
+		}
+	}
+}
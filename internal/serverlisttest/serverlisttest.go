@@ -0,0 +1,135 @@
+/*
+Package serverlisttest provides fixtures and common tests of the server lists
+built around ketama.Server. It is meant to be used from tests only.
+*/
+package serverlisttest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlist"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// List is server list under test.
+type List interface {
+	SetServers(servers []ketama.Server) error
+	SetServersAddr(addrs []net.Addr) error
+	LookupServer(addr net.Addr) (ketama.Server, bool)
+	PickServer(key string) (net.Addr, error)
+	Each(fn func(net.Addr) error) error
+}
+
+// Addrs returns n distinct TCP addresses.
+func Addrs(n int) []net.Addr {
+	addrs := make([]net.Addr, n)
+	for i := range addrs {
+		addrs[i] = &net.TCPAddr{
+			IP:   net.IPv4(10, 0, byte(i/250), byte(i%250+1)),
+			Port: 11211,
+		}
+	}
+	return addrs
+}
+
+// Keys returns n distinct keys.
+func Keys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+// PickAll returns address picked by l for each of keys.
+func PickAll(t testing.TB, l List, keys []string) map[string]net.Addr {
+	picked := make(map[string]net.Addr, len(keys))
+	for _, key := range keys {
+		addr, err := l.PickServer(key)
+		if err != nil {
+			t.Fatalf("PickServer: %s", err)
+		}
+		picked[key] = addr
+	}
+	return picked
+}
+
+// Run runs tests common to all server lists, using newList to get an empty
+// list for each of them.
+func Run(t *testing.T, newList func() List) {
+	t.Run("InvalidServers", func(t *testing.T) {
+		testInvalidServers(t, newList())
+	})
+	t.Run("NoServers", func(t *testing.T) {
+		testNoServers(t, newList())
+	})
+	t.Run("EachAndLookup", func(t *testing.T) {
+		testEachAndLookup(t, newList())
+	})
+}
+
+func testInvalidServers(t *testing.T, l List) {
+	a := Addrs(1)
+	l.SetServersAddr(a)
+
+	err := l.SetServers([]ketama.Server{
+		{Addr: a[0], Weight: -1},
+		{Addr: nil},
+	})
+	var errs ketama.ServerErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("SetServers = %v, want two server errors", err)
+	}
+	if !errors.Is(err, ketama.ErrNegativeWeight) ||
+		!errors.Is(err, serverlist.ErrNilAddr) {
+
+		t.Errorf("SetServers = %v, want both errors reported", err)
+	}
+
+	if addr, _ := l.PickServer("foo"); addr != a[0] {
+		t.Errorf("Invalid servers changed the list")
+	}
+}
+
+func testNoServers(t *testing.T, l List) {
+	if _, err := l.PickServer("foo"); err != memcache.ErrNoServers {
+		t.Errorf("PickServer = %v, want %v", err, memcache.ErrNoServers)
+	}
+
+	l.SetServersAddr(Addrs(1))
+	l.SetServersAddr(nil)
+	if _, err := l.PickServer("foo"); err != memcache.ErrNoServers {
+		t.Errorf("PickServer = %v, want %v", err, memcache.ErrNoServers)
+	}
+}
+
+func testEachAndLookup(t *testing.T, l List) {
+	a := Addrs(4)
+	l.SetServers([]ketama.Server{
+		{Addr: a[0]},
+		{Addr: a[1], Weight: 5},
+		{Addr: a[2], Username: "user"},
+	})
+
+	var seen []net.Addr
+	l.Each(func(addr net.Addr) error {
+		seen = append(seen, addr)
+		return nil
+	})
+	if len(seen) != 3 {
+		t.Errorf("Each called %d times, want 3", len(seen))
+	}
+
+	server, ok := l.LookupServer(a[2])
+	if !ok || server.Username != "user" {
+		t.Errorf("LookupServer = %+v, %v, want the server", server, ok)
+	}
+	if _, ok := l.LookupServer(a[3]); ok {
+		t.Errorf("LookupServer found unknown address")
+	}
+}
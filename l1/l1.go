@@ -0,0 +1,256 @@
+/*
+Package l1 provides small in-process cache in front of client.Client, meant for
+extremely hot keys.
+
+Items fetched from memcached are kept in memory for a short time (see
+Options.TTL), so repeated reads of the same key do not leave the process at
+all. Concurrent misses of the same key are coalesced, only one Get is sent to
+the server picked for the key and all callers share its result:
+
+	k := &ketama.Ketama{}
+	k.SetServersAddr(addrs)
+
+	c := l1.New(client.New(k), l1.Options{
+		MaxItems: 1000,
+		TTL:      500 * time.Millisecond,
+	})
+	item, err := c.Get(ctx, "hot-key")
+
+Writes through the Cache invalidate the local copy, writes done by other
+processes are visible once the local copy expires. Keep the TTL short.
+*/
+package l1
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/client"
+)
+
+// DefaultTTL is used when Options.TTL is zero.
+const DefaultTTL = time.Second
+
+// Options configure Cache.
+type Options struct {
+	// MaxItems limits the number of items held in memory. Zero means no
+	// limit.
+	MaxItems int
+	// MaxBytes limits total size of keys and values held in memory.
+	// Zero means no limit.
+	MaxBytes int
+	// TTL is how long items are held in memory. If zero, DefaultTTL is
+	// used.
+	TTL time.Duration
+	// TTLFunc, if set, returns TTL for the given key, overriding TTL.
+	// Keys with TTL <= 0 are not held in memory at all.
+	TTLFunc func(key string) time.Duration
+}
+
+// Stats are counters of Cache operations.
+type Stats struct {
+	// Hits is the number of Gets served from memory.
+	Hits uint64
+	// Misses is the number of Gets sent to memcached.
+	Misses uint64
+	// Coalesced is the number of Gets which waited for result of Get
+	// of the same key already in progress.
+	Coalesced uint64
+	// Evictions is the number of items removed to make space.
+	Evictions uint64
+}
+
+// call is single Get in progress, shared by all callers missing the key.
+type call struct {
+	done chan struct{}
+	item *client.Item
+	err  error
+}
+
+// Cache is in-process cache in front of client.Client. Safe to use from
+// multiple goroutines at once.
+type Cache struct {
+	c    *client.Client
+	opts Options
+
+	lru     *lru
+	flights map[string]*call
+	stats   Stats
+	m       sync.Mutex
+}
+
+// New returns Cache in front of c.
+func New(c *client.Client, opts Options) *Cache {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTTL
+	}
+
+	return &Cache{
+		c:       c,
+		opts:    opts,
+		lru:     newLRU(opts.MaxItems, opts.MaxBytes),
+		flights: make(map[string]*call),
+	}
+}
+
+// Client returns the underlying client.Client.
+func (c *Cache) Client() *client.Client {
+	return c.c
+}
+
+func (c *Cache) ttl(key string) time.Duration {
+	if c.opts.TTLFunc != nil {
+		return c.opts.TTLFunc(key)
+	}
+	return c.opts.TTL
+}
+
+// copyItem returns copy of item not sharing the value, so callers cannot
+// modify the items held in memory.
+func copyItem(item *client.Item) *client.Item {
+	it := *item
+	it.Value = append([]byte(nil), item.Value...)
+	return &it
+}
+
+// Get gets the item for the given key, from memory if it is there, from
+// memcached otherwise. ErrCacheMiss is returned for a memcache cache miss;
+// misses are not held in memory.
+func (c *Cache) Get(ctx context.Context, key string) (*client.Item, error) {
+	for {
+		c.m.Lock()
+		if e, ok := c.lru.get(key, time.Now()); ok {
+			c.stats.Hits++
+			c.m.Unlock()
+			return copyItem(&e.item), nil
+		}
+
+		cl, ok := c.flights[key]
+		if !ok {
+			cl = &call{done: make(chan struct{})}
+			c.flights[key] = cl
+			c.stats.Misses++
+			c.m.Unlock()
+
+			return c.fetch(ctx, key, cl)
+		}
+		c.stats.Coalesced++
+		c.m.Unlock()
+
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// Get of the caller leading the call was canceled or timed
+		// out, which says nothing about the key. Try again with our
+		// own context.
+		if isContextError(cl.err) && ctx.Err() == nil {
+			continue
+		}
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		return copyItem(cl.item), nil
+	}
+}
+
+// fetch gets key from memcached on behalf of all callers waiting for cl.
+func (c *Cache) fetch(
+	ctx context.Context,
+	key string,
+	cl *call,
+) (*client.Item, error) {
+	item, err := c.c.Get(ctx, key)
+
+	// Waiters get their own copies of the item, the caller may modify
+	// it.
+	cl.err = err
+	if err == nil {
+		cl.item = copyItem(item)
+	}
+
+	c.m.Lock()
+	// Invalidation during the Get removes cl from flights, the item may
+	// be stale then and must not be held.
+	if c.flights[key] == cl {
+		delete(c.flights, key)
+		if ttl := c.ttl(key); err == nil && ttl > 0 {
+			c.add(key, cl.item, ttl)
+		}
+	}
+	c.m.Unlock()
+
+	close(cl.done)
+
+	return item, err
+}
+
+// add holds item in memory. Caller must hold the lock.
+func (c *Cache) add(key string, item *client.Item, ttl time.Duration) {
+	evictions := c.lru.evictions
+	c.lru.add(key, *item, time.Now().Add(ttl))
+	c.stats.Evictions += c.lru.evictions - evictions
+}
+
+// Set writes the given item to memcached and removes it from memory, the next
+// Get fetches it again.
+func (c *Cache) Set(ctx context.Context, item *client.Item) error {
+	c.Invalidate(item.Key)
+	err := c.c.Set(ctx, item)
+	c.Invalidate(item.Key)
+	return err
+}
+
+// Delete deletes the item with the provided key from memcached and from
+// memory. ErrCacheMiss is returned if the item didn't exist in memcached.
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	c.Invalidate(key)
+	err := c.c.Delete(ctx, key)
+	c.Invalidate(key)
+	return err
+}
+
+// Invalidate removes key from memory, the next Get goes to memcached. Result
+// of Get of the key in progress is not held in memory either.
+func (c *Cache) Invalidate(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.lru.remove(key)
+	delete(c.flights, key)
+}
+
+// Purge removes all items from memory.
+func (c *Cache) Purge() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.lru.purge()
+	c.flights = make(map[string]*call)
+}
+
+// Len returns number of items held in memory, including expired ones not
+// removed yet.
+func (c *Cache) Len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.lru.ll.Len()
+}
+
+// Stats returns counters of Cache operations.
+func (c *Cache) Stats() Stats {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.stats
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,314 @@
+package l1
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/client"
+	"git.sr.ht/~graywolf/gomemcache/internal/memcachetest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// gatedListener holds reads of accepted connections until the gate is opened.
+type gatedListener struct {
+	net.Listener
+	gate chan struct{}
+}
+
+type gatedConn struct {
+	net.Conn
+	gate chan struct{}
+}
+
+func (ln gatedListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return gatedConn{c, ln.gate}, nil
+}
+
+func (c gatedConn) Read(b []byte) (int, error) {
+	<-c.gate
+	return c.Conn.Read(b)
+}
+
+func newTestCache(
+	t *testing.T,
+	ln net.Listener,
+	opts Options,
+) (*Cache, *memcachetest.Server) {
+	if ln == nil {
+		var err error
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %s", err)
+		}
+	}
+	s := memcachetest.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	k := &ketama.Ketama{}
+	if err := k.SetServersAddr([]net.Addr{s.Addr()}); err != nil {
+		t.Fatalf("Cannot set servers: %s", err)
+	}
+
+	mc := client.New(k)
+	mc.Timeout = 5 * time.Second
+	t.Cleanup(func() { mc.Close() })
+
+	return New(mc, opts), s
+}
+
+func TestGetHit(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{TTL: time.Minute})
+	ctx := context.Background()
+	s.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+
+	for i := 0; i < 3; i++ {
+		it, err := c.Get(ctx, "foo")
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		if string(it.Value) != "bar" {
+			t.Errorf("Get = %q, want bar", it.Value)
+		}
+		it.Value[0] = 'X'
+	}
+
+	if n := s.Commands("gets"); n != 1 {
+		t.Errorf("Server got %d gets, want 1", n)
+	}
+	st := c.Stats()
+	if st.Hits != 2 || st.Misses != 1 {
+		t.Errorf("Stats = %+v, want 2 hits and 1 miss", st)
+	}
+}
+
+func TestGetMissNotHeld(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{TTL: time.Minute})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(ctx, "foo"); err != client.ErrCacheMiss {
+			t.Errorf("Get = %v, want %v", err, client.ErrCacheMiss)
+		}
+	}
+	if n := s.Commands("gets"); n != 2 {
+		t.Errorf("Server got %d gets, want 2", n)
+	}
+}
+
+func TestGetExpires(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{TTL: 10 * time.Millisecond})
+	ctx := context.Background()
+	s.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+
+	c.Get(ctx, "foo")
+	time.Sleep(20 * time.Millisecond)
+	c.Get(ctx, "foo")
+
+	if n := s.Commands("gets"); n != 2 {
+		t.Errorf("Server got %d gets, want 2", n)
+	}
+}
+
+func TestTTLFunc(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{
+		TTLFunc: func(key string) time.Duration {
+			if key == "hot" {
+				return time.Minute
+			}
+			return 0
+		},
+	})
+	ctx := context.Background()
+	s.SetItem("hot", memcachetest.Item{Value: []byte("x")})
+	s.SetItem("cold", memcachetest.Item{Value: []byte("x")})
+
+	for i := 0; i < 2; i++ {
+		c.Get(ctx, "hot")
+		c.Get(ctx, "cold")
+	}
+
+	if n := s.Commands("gets"); n != 3 {
+		t.Errorf("Server got %d gets, want 3", n)
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{MaxItems: 2, TTL: time.Minute})
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c"} {
+		s.SetItem(key, memcachetest.Item{Value: []byte("x")})
+	}
+
+	c.Get(ctx, "a")
+	c.Get(ctx, "b")
+	c.Get(ctx, "a")
+	c.Get(ctx, "c") // Evicts b.
+
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len = %d, want 2", n)
+	}
+	if n := c.Stats().Evictions; n != 1 {
+		t.Errorf("Evictions = %d, want 1", n)
+	}
+
+	before := s.Commands("gets")
+	c.Get(ctx, "a")
+	if s.Commands("gets") != before {
+		t.Errorf("Recently used item was evicted")
+	}
+	c.Get(ctx, "b")
+	if s.Commands("gets") != before+1 {
+		t.Errorf("Least recently used item was not evicted")
+	}
+
+	c, s = newTestCache(t, nil, Options{MaxBytes: 10, TTL: time.Minute})
+	s.SetItem("big", memcachetest.Item{Value: []byte("0123456789")})
+	s.SetItem("small", memcachetest.Item{Value: []byte("x")})
+
+	c.Get(ctx, "big")
+	c.Get(ctx, "small")
+	if n := c.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	gate := make(chan struct{})
+	c, s := newTestCache(t, gatedListener{ln, gate}, Options{TTL: time.Minute})
+	s.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+
+	const n = 10
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			it, err := c.Get(context.Background(), "foo")
+			if err != nil {
+				t.Errorf("Get: %s", err)
+			} else if string(it.Value) != "bar" {
+				t.Errorf("Get = %q, want bar", it.Value)
+			}
+		}()
+	}
+
+	for c.Stats().Coalesced != n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	if got := s.Commands("gets"); got != 1 {
+		t.Errorf("Server got %d gets, want 1", got)
+	}
+}
+
+func TestCoalescedCanceled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	gate := make(chan struct{})
+	c, s := newTestCache(t, gatedListener{ln, gate}, Options{TTL: time.Minute})
+	s.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := c.Get(ctx, "foo")
+		leader <- err
+	}()
+	for c.Stats().Misses != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiter := make(chan error)
+	go func() {
+		_, err := c.Get(context.Background(), "foo")
+		waiter <- err
+	}()
+	for c.Stats().Coalesced != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-leader; err == nil {
+		t.Errorf("Canceled Get succeeded")
+	}
+	close(gate)
+	if err := <-waiter; err != nil {
+		t.Errorf("Get waiting for canceled Get = %v, want nil", err)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{TTL: time.Minute})
+	ctx := context.Background()
+	s.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+
+	c.Get(ctx, "foo")
+	s.SetItem("foo", memcachetest.Item{Value: []byte("baz")})
+	c.Invalidate("foo")
+
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(it.Value) != "baz" {
+		t.Errorf("Get after Invalidate = %q, want baz", it.Value)
+	}
+
+	c.Purge()
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len after Purge = %d, want 0", n)
+	}
+}
+
+func TestWrites(t *testing.T) {
+	c, s := newTestCache(t, nil, Options{TTL: time.Minute})
+	ctx := context.Background()
+
+	err := c.Set(ctx, &client.Item{Key: "foo", Value: []byte("bar")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	c.Get(ctx, "foo")
+
+	err = c.Set(ctx, &client.Item{Key: "foo", Value: []byte("baz")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	it, err := c.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(it.Value) != "baz" {
+		t.Errorf("Get after Set = %q, want baz", it.Value)
+	}
+
+	if err := c.Delete(ctx, "foo"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := c.Get(ctx, "foo"); err != client.ErrCacheMiss {
+		t.Errorf("Get after Delete = %v, want %v", err, client.ErrCacheMiss)
+	}
+	if _, ok := s.Item("foo"); ok {
+		t.Errorf("Delete did not reach the server")
+	}
+}
@@ -0,0 +1,99 @@
+package l1
+
+import (
+	"container/list"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/client"
+)
+
+// entry is single item held by lru.
+type entry struct {
+	key     string
+	item    client.Item
+	expires time.Time
+	size    int
+}
+
+// lru is least recently used cache bounded by number of items and their total
+// size. It is not safe for concurrent use.
+type lru struct {
+	maxItems int
+	maxBytes int
+
+	bytes int
+	ll    *list.List
+	items map[string]*list.Element
+
+	evictions uint64
+}
+
+func newLRU(maxItems int, maxBytes int) *lru {
+	return &lru{
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns live item stored under key and marks it as recently used.
+func (c *lru) get(key string, now time.Time) (*entry, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+// add stores item under key until expires, evicting least recently used items
+// to make space. Items larger than the whole cache are not stored.
+func (c *lru) add(key string, item client.Item, expires time.Time) {
+	c.remove(key)
+
+	e := &entry{
+		key:     key,
+		item:    item,
+		expires: expires,
+		size:    len(key) + len(item.Value),
+	}
+	if c.maxBytes > 0 && e.size > c.maxBytes {
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += e.size
+
+	for (c.maxItems > 0 && c.ll.Len() > c.maxItems) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes) {
+
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+}
+
+func (c *lru) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lru) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*entry)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+func (c *lru) purge() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+}
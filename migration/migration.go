@@ -0,0 +1,286 @@
+/*
+Package migration moves clients from an old memcached cluster to a new one
+without losing the hit rate of the old one.
+
+During the migration reads go to the new cluster first. On miss the old
+cluster is asked and the item found there is backfilled into the new cluster,
+with its remaining TTL when the old cluster supports meta get (text protocol,
+memcached 1.6 and newer), with Options.BackfillTTL otherwise. Writes and
+deletes go to both clusters, so the old one stays usable as a fallback. Once
+the migration ends, the old cluster is not used at all:
+
+	m := migration.New(oldClient, newClient, migration.Options{
+		Duration: 24 * time.Hour,
+	})
+	item, err := m.Get(ctx, "some-key")
+
+	fmt.Printf("hit ratio %.2f, backfill ratio %.2f\n",
+		m.Stats().HitRatio(), m.Stats().BackfillRatio())
+*/
+package migration
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/client"
+)
+
+// DefaultBackfillTTL is used when Options.BackfillTTL is zero.
+const DefaultBackfillTTL = 300
+
+// Options configure Migration.
+type Options struct {
+	// Duration of the migration, counted from New. Zero means the
+	// migration lasts until End is called.
+	Duration time.Duration
+	// BackfillTTL is expiration, in seconds, of items backfilled into the
+	// new cluster when their remaining TTL cannot be read from the old
+	// one. If zero, DefaultBackfillTTL is used.
+	BackfillTTL int32
+}
+
+// Stats are counters of reads during the migration.
+type Stats struct {
+	// Hits is the number of reads served by the new cluster.
+	Hits uint64
+	// OldHits is the number of reads served by the old cluster.
+	OldHits uint64
+	// Misses is the number of reads missing in both clusters.
+	Misses uint64
+	// Backfills is the number of items copied into the new cluster.
+	Backfills uint64
+	// BackfillErrors is the number of items which could not be copied.
+	// Items written into the new cluster in the meantime are not
+	// counted.
+	BackfillErrors uint64
+}
+
+// Reads returns total number of reads.
+func (s Stats) Reads() uint64 {
+	return s.Hits + s.OldHits + s.Misses
+}
+
+// HitRatio returns fraction of reads served by the new cluster.
+func (s Stats) HitRatio() float64 {
+	return ratio(s.Hits, s.Reads())
+}
+
+// BackfillRatio returns fraction of reads which backfilled an item into the new
+// cluster.
+func (s Stats) BackfillRatio() float64 {
+	return ratio(s.Backfills, s.Reads())
+}
+
+func ratio(a uint64, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// Migration reads from and writes to clusters under migration. It is safe to
+// use from multiple goroutines at once.
+type Migration struct {
+	// The 64-bit fields are accessed atomically, they come first to be
+	// aligned on 32-bit platforms.
+
+	// end is UnixNano of the end of the migration, zero if none.
+	end int64
+
+	hits, oldHits, misses     uint64
+	backfills, backfillErrors uint64
+
+	old  *client.Client
+	new  *client.Client
+	opts Options
+}
+
+// New starts migration from cluster of client old to cluster of client new.
+func New(old *client.Client, new *client.Client, opts Options) *Migration {
+	if opts.BackfillTTL == 0 {
+		opts.BackfillTTL = DefaultBackfillTTL
+	}
+
+	m := &Migration{old: old, new: new, opts: opts}
+	if opts.Duration != 0 {
+		m.end = time.Now().Add(opts.Duration).UnixNano()
+	}
+	return m
+}
+
+// Active reports whether the migration is still in progress.
+func (m *Migration) Active() bool {
+	end := atomic.LoadInt64(&m.end)
+	return end == 0 || time.Now().UnixNano() < end
+}
+
+// End ends the migration now, the old cluster is not used any more.
+func (m *Migration) End() {
+	atomic.StoreInt64(&m.end, time.Now().UnixNano())
+}
+
+// Stats returns counters of reads so far.
+func (m *Migration) Stats() Stats {
+	return Stats{
+		Hits:           atomic.LoadUint64(&m.hits),
+		OldHits:        atomic.LoadUint64(&m.oldHits),
+		Misses:         atomic.LoadUint64(&m.misses),
+		Backfills:      atomic.LoadUint64(&m.backfills),
+		BackfillErrors: atomic.LoadUint64(&m.backfillErrors),
+	}
+}
+
+// Get gets the item for the given key from the new cluster or, during the
+// migration, from the old one. Items found in the old cluster are backfilled
+// into the new one and returned without CAS, it would not be valid in the new
+// cluster. ErrCacheMiss is returned when neither cluster has the item, or when
+// the new cluster misses and the old one fails, the old cluster is only
+// a fallback.
+func (m *Migration) Get(ctx context.Context, key string) (*client.Item, error) {
+	item, err := m.new.Get(ctx, key)
+	if err != client.ErrCacheMiss {
+		if err == nil {
+			atomic.AddUint64(&m.hits, 1)
+		}
+		return item, err
+	}
+
+	if !m.Active() {
+		atomic.AddUint64(&m.misses, 1)
+		return nil, err
+	}
+
+	item, exp, oldErr := m.getOld(ctx, key)
+	if oldErr != nil {
+		atomic.AddUint64(&m.misses, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&m.oldHits, 1)
+
+	item.CAS = 0
+	m.backfill(ctx, item, exp)
+
+	return item, nil
+}
+
+// getOld gets key from the old cluster together with expiration for the
+// backfill. Servers which do not understand meta get (memcached older than
+// 1.6) are asked with plain get, the expiration is then BackfillTTL.
+func (m *Migration) getOld(
+	ctx context.Context,
+	key string,
+) (*client.Item, int32, error) {
+	mi, err := m.old.MetaGet(ctx, key, client.MetaGetOptions{})
+	switch {
+	case err == client.ErrMetaUnsupported,
+		errors.Is(err, client.ErrClientError),
+		errors.Is(err, client.ErrProtocol):
+
+		item, err := m.old.Get(ctx, key)
+		return item, m.opts.BackfillTTL, err
+	case err != nil:
+		return nil, 0, err
+	}
+
+	return &mi.Item, mi.TTLExpiration(), nil
+}
+
+// backfill stores item into the new cluster unless it was written there in the
+// meantime.
+func (m *Migration) backfill(
+	ctx context.Context,
+	item *client.Item,
+	exp int32,
+) {
+	it := *item
+	it.Expiration = exp
+
+	switch err := m.new.Add(ctx, &it); err {
+	case nil:
+		atomic.AddUint64(&m.backfills, 1)
+	case client.ErrNotStored:
+	default:
+		atomic.AddUint64(&m.backfillErrors, 1)
+	}
+}
+
+// both calls fn with the new and the old client in parallel and returns their
+// errors.
+func (m *Migration) both(fn func(c *client.Client) error) (error, error) {
+	oldErr := make(chan error, 1)
+	go func() {
+		oldErr <- fn(m.old)
+	}()
+
+	err := fn(m.new)
+	return err, <-oldErr
+}
+
+// Set writes the given item to both clusters during the migration, to the new
+// one only afterwards.
+func (m *Migration) Set(ctx context.Context, item *client.Item) error {
+	if !m.Active() {
+		return m.new.Set(ctx, item)
+	}
+
+	err, oldErr := m.both(func(c *client.Client) error {
+		return c.Set(ctx, item)
+	})
+	if err != nil {
+		return err
+	}
+	return oldErr
+}
+
+// Delete deletes the item with the provided key from both clusters during the
+// migration, from the new one only afterwards. ErrCacheMiss is returned if
+// the item didn't exist in any of them.
+//
+// Delete racing with a backfill of the same key by Get may bring the item
+// back: Get reads it from the old cluster before the Delete and adds it to the
+// new one after. Callers which cannot tolerate that should overwrite such
+// items with Set, a backfill never replaces an existing item.
+func (m *Migration) Delete(ctx context.Context, key string) error {
+	if !m.Active() {
+		return m.new.Delete(ctx, key)
+	}
+
+	return missingInBoth(m.both(func(c *client.Client) error {
+		return c.Delete(ctx, key)
+	}))
+}
+
+// Touch updates the expiry for the given key in both clusters during the
+// migration, in the new one only afterwards. ErrCacheMiss is returned if the
+// key is not in any of them.
+func (m *Migration) Touch(
+	ctx context.Context,
+	key string,
+	expiration int32,
+) error {
+	if !m.Active() {
+		return m.new.Touch(ctx, key, expiration)
+	}
+
+	return missingInBoth(m.both(func(c *client.Client) error {
+		return c.Touch(ctx, key, expiration)
+	}))
+}
+
+// missingInBoth combines errors of operation done in both clusters, which fails
+// with ErrCacheMiss when the key is missing.
+func missingInBoth(err error, oldErr error) error {
+	// Missing in one of the clusters is a success.
+	switch {
+	case err == client.ErrCacheMiss && oldErr == nil:
+		return nil
+	case err == nil && oldErr == client.ErrCacheMiss:
+		return nil
+	case err != nil:
+		return err
+	}
+	return oldErr
+}
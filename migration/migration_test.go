@@ -0,0 +1,309 @@
+package migration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/client"
+	"git.sr.ht/~graywolf/gomemcache/internal/memcachetest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func newTestClient(t *testing.T) (*client.Client, *memcachetest.Server) {
+	s, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatalf("Cannot start server: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	k := &ketama.Ketama{}
+	if err := k.SetServersAddr([]net.Addr{s.Addr()}); err != nil {
+		t.Fatalf("Cannot set servers: %s", err)
+	}
+
+	c := client.New(k)
+	c.Timeout = time.Second
+	t.Cleanup(func() { c.Close() })
+
+	return c, s
+}
+
+type clusters struct {
+	m        *Migration
+	old, new *memcachetest.Server
+	oldC     *client.Client
+}
+
+func newClusters(t *testing.T, opts Options) clusters {
+	oldC, old := newTestClient(t)
+	newC, new := newTestClient(t)
+
+	return clusters{
+		m:    New(oldC, newC, opts),
+		old:  old,
+		new:  new,
+		oldC: oldC,
+	}
+}
+
+func TestGetBackfill(t *testing.T) {
+	c := newClusters(t, Options{})
+	ctx := context.Background()
+
+	c.old.SetItem("foo", memcachetest.Item{
+		Value:   []byte("bar"),
+		Flags:   42,
+		Expires: time.Now().Add(100 * time.Second),
+	})
+	c.old.SetItem("forever", memcachetest.Item{Value: []byte("x")})
+
+	it, err := c.m.Get(ctx, "foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(it.Value) != "bar" || it.Flags != 42 || it.CAS != 0 {
+		t.Errorf("Get = %+v, want bar with flags 42 and no CAS", it)
+	}
+
+	backfilled, ok := c.new.Item("foo")
+	if !ok {
+		t.Fatalf("Item was not backfilled")
+	}
+	if string(backfilled.Value) != "bar" || backfilled.Flags != 42 {
+		t.Errorf("Backfilled %+v, want bar with flags 42", backfilled)
+	}
+	if ttl := time.Until(backfilled.Expires); ttl < 95*time.Second ||
+		ttl > 100*time.Second {
+
+		t.Errorf("Backfilled with TTL %s, want about 100s", ttl)
+	}
+
+	c.m.Get(ctx, "forever")
+	if backfilled, _ := c.new.Item("forever"); !backfilled.Expires.IsZero() {
+		t.Errorf("Item without expiration backfilled with %s",
+			backfilled.Expires)
+	}
+
+	// The second read is served by the new cluster.
+	c.m.Get(ctx, "foo")
+	if _, err := c.m.Get(ctx, "missing"); err != client.ErrCacheMiss {
+		t.Errorf("Get = %v, want %v", err, client.ErrCacheMiss)
+	}
+
+	st := c.m.Stats()
+	want := Stats{Hits: 1, OldHits: 2, Misses: 1, Backfills: 2}
+	if st != want {
+		t.Errorf("Stats = %+v, want %+v", st, want)
+	}
+	if r := st.HitRatio(); r != 0.25 {
+		t.Errorf("HitRatio = %g, want 0.25", r)
+	}
+	if r := st.BackfillRatio(); r != 0.5 {
+		t.Errorf("BackfillRatio = %g, want 0.5", r)
+	}
+}
+
+func TestGetBackfillLongTTL(t *testing.T) {
+	c := newClusters(t, Options{})
+
+	// memcached takes expirations over 30 days as absolute times.
+	ttl := 40 * 24 * time.Hour
+	c.old.SetItem("foo", memcachetest.Item{
+		Value:   []byte("bar"),
+		Expires: time.Now().Add(ttl),
+	})
+	if _, err := c.m.Get(context.Background(), "foo"); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	backfilled, ok := c.new.Item("foo")
+	if !ok {
+		t.Fatalf("Item was not backfilled")
+	}
+	if left := time.Until(backfilled.Expires); left < ttl-time.Minute ||
+		left > ttl {
+
+		t.Errorf("Backfilled with TTL %s, want %s", left, ttl)
+	}
+}
+
+func TestGetBackfillBinary(t *testing.T) {
+	c := newClusters(t, Options{BackfillTTL: 60})
+	c.oldC.Protocol = client.Binary
+
+	c.old.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+	if _, err := c.m.Get(context.Background(), "foo"); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	backfilled, _ := c.new.Item("foo")
+	if ttl := time.Until(backfilled.Expires); ttl < 55*time.Second ||
+		ttl > 60*time.Second {
+
+		t.Errorf("Backfilled with TTL %s, want BackfillTTL", ttl)
+	}
+}
+
+// serveWithoutMeta serves item foo with value bar over ln, answering meta
+// commands with ERROR the way memcached older than 1.6 does.
+func serveWithoutMeta(ln net.Listener) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer nc.Close()
+			r := bufio.NewReader(nc)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(line, "gets foo") {
+					fmt.Fprint(nc, "VALUE foo 0 3 1\r\nbar\r\nEND\r\n")
+				} else {
+					fmt.Fprint(nc, "ERROR\r\n")
+				}
+			}
+		}()
+	}
+}
+
+func TestGetBackfillWithoutMeta(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveWithoutMeta(ln)
+
+	k := &ketama.Ketama{}
+	k.SetServersAddr([]net.Addr{ln.Addr()})
+	oldC := client.New(k)
+	oldC.Timeout = time.Second
+	t.Cleanup(func() { oldC.Close() })
+
+	newC, new := newTestClient(t)
+	m := New(oldC, newC, Options{BackfillTTL: 60})
+
+	it, err := m.Get(context.Background(), "foo")
+	if err != nil || string(it.Value) != "bar" {
+		t.Fatalf("Get = %v, %v, want bar", it, err)
+	}
+	backfilled, _ := new.Item("foo")
+	if ttl := time.Until(backfilled.Expires); ttl < 55*time.Second ||
+		ttl > 60*time.Second {
+
+		t.Errorf("Backfilled with TTL %s, want BackfillTTL", ttl)
+	}
+}
+
+func TestGetOldFails(t *testing.T) {
+	c := newClusters(t, Options{})
+	c.old.Close()
+
+	_, err := c.m.Get(context.Background(), "foo")
+	if err != client.ErrCacheMiss {
+		t.Errorf("Get = %v, want %v", err, client.ErrCacheMiss)
+	}
+	if st := c.m.Stats(); st != (Stats{Misses: 1}) {
+		t.Errorf("Stats = %+v, want single miss", st)
+	}
+}
+
+func TestBackfillDoesNotOverwrite(t *testing.T) {
+	c := newClusters(t, Options{})
+	c.old.SetItem("foo", memcachetest.Item{Value: []byte("old")})
+
+	it := &client.Item{Key: "foo", Value: []byte("new")}
+	item, _, err := c.m.getOld(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("getOld: %s", err)
+	}
+	c.m.Set(context.Background(), it)
+	c.m.backfill(context.Background(), item, 0)
+
+	if stored, _ := c.new.Item("foo"); string(stored.Value) != "new" {
+		t.Errorf("Backfill overwrote newer value with %q", stored.Value)
+	}
+	if st := c.m.Stats(); st.Backfills != 0 || st.BackfillErrors != 0 {
+		t.Errorf("Stats = %+v, want no backfills", st)
+	}
+}
+
+func TestWritesGoToBoth(t *testing.T) {
+	c := newClusters(t, Options{})
+	ctx := context.Background()
+
+	err := c.m.Set(ctx, &client.Item{Key: "foo", Value: []byte("bar")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	for name, s := range map[string]*memcachetest.Server{
+		"old": c.old,
+		"new": c.new,
+	} {
+		if _, ok := s.Item("foo"); !ok {
+			t.Errorf("Set did not reach the %s cluster", name)
+		}
+	}
+
+	// Present in the old cluster only.
+	c.old.SetItem("only-old", memcachetest.Item{Value: []byte("x")})
+	if err := c.m.Touch(ctx, "only-old", 10); err != nil {
+		t.Errorf("Touch = %v, want nil", err)
+	}
+	if err := c.m.Delete(ctx, "only-old"); err != nil {
+		t.Errorf("Delete = %v, want nil", err)
+	}
+	if _, ok := c.old.Item("only-old"); ok {
+		t.Errorf("Delete did not reach the old cluster")
+	}
+	if err := c.m.Delete(ctx, "only-old"); err != client.ErrCacheMiss {
+		t.Errorf("Delete = %v, want %v", err, client.ErrCacheMiss)
+	}
+}
+
+func TestTimeBoxed(t *testing.T) {
+	c := newClusters(t, Options{Duration: 20 * time.Millisecond})
+	ctx := context.Background()
+
+	if !c.m.Active() {
+		t.Fatalf("Migration is not active")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if c.m.Active() {
+		t.Fatalf("Migration is active after its duration")
+	}
+
+	c.old.SetItem("foo", memcachetest.Item{Value: []byte("bar")})
+	if _, err := c.m.Get(ctx, "foo"); err != client.ErrCacheMiss {
+		t.Errorf("Get after the migration = %v, want %v",
+			err, client.ErrCacheMiss)
+	}
+	if n := c.old.Commands("mg"); n != 0 {
+		t.Errorf("Old cluster was read %d times", n)
+	}
+
+	c.m.Set(ctx, &client.Item{Key: "bar", Value: []byte("x")})
+	if _, ok := c.old.Item("bar"); ok {
+		t.Errorf("Set after the migration reached the old cluster")
+	}
+}
+
+func TestEnd(t *testing.T) {
+	c := newClusters(t, Options{})
+	if !c.m.Active() {
+		t.Fatalf("Migration without duration is not active")
+	}
+	c.m.End()
+	if c.m.Active() {
+		t.Errorf("Migration is active after End")
+	}
+}
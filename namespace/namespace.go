@@ -0,0 +1,145 @@
+/*
+Package namespace provides wrapper around memcache.Client prefixing all keys
+with a namespace, the same way libmemcached's MEMCACHED_CALLBACK_NAMESPACE
+does.
+
+For the keys to be placed on the same servers as libmemcached places them,
+ketama.Ketama must be told about the namespace as well. NewWithKetama does
+both:
+
+	k := &ketama.Ketama{}
+	k.SetServersAddr(addrs)
+
+	mc := namespace.NewWithKetama(k, "app:", false)
+	mc.Set(&memcache.Item{Key: "some-key", Value: []byte("x")})
+*/
+package namespace
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// Client prefixes keys of all operations with namespace and passes them to the
+// underlying memcache.Client. Items returned from Client have the namespace
+// stripped from their keys.
+type Client struct {
+	mc *memcache.Client
+	ns string
+}
+
+// New returns Client prefixing all keys with ns before passing them to mc.
+func New(mc *memcache.Client, ns string) *Client {
+	return &Client{mc: mc, ns: ns}
+}
+
+// NewWithKetama configures namespace on k (see ketama.Ketama.SetNamespace for
+// meaning of hashWith) and returns Client using k as server selector.
+func NewWithKetama(k *ketama.Ketama, ns string, hashWith bool) *Client {
+	k.SetNamespace(ns, hashWith)
+	return New(memcache.NewFromSelector(k), ns)
+}
+
+// Namespace returns the namespace keys are prefixed with.
+func (c *Client) Namespace() string {
+	return c.ns
+}
+
+// Client returns the underlying memcache.Client.
+func (c *Client) Client() *memcache.Client {
+	return c.mc
+}
+
+func (c *Client) key(key string) string {
+	return c.ns + key
+}
+
+// wrap returns copy of item with key prefixed. Copying the whole structure
+// keeps the (unexported) CAS id intact.
+func (c *Client) wrap(item *memcache.Item) *memcache.Item {
+	it := *item
+	it.Key = c.key(item.Key)
+	return &it
+}
+
+func (c *Client) unwrap(item *memcache.Item) *memcache.Item {
+	item.Key = item.Key[len(c.ns):]
+	return item
+}
+
+// Get gets the item for the given key. See memcache.Client.Get.
+func (c *Client) Get(key string) (*memcache.Item, error) {
+	item, err := c.mc.Get(c.key(key))
+	if err != nil {
+		return nil, err
+	}
+	return c.unwrap(item), nil
+}
+
+// GetMulti is a batch version of Get. Keys of returned map are without the
+// namespace. Like memcache.Client.GetMulti, items fetched before an error are
+// returned together with it.
+func (c *Client) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	nkeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		nkeys = append(nkeys, c.key(key))
+	}
+
+	m, err := c.mc.GetMulti(nkeys)
+	if m == nil {
+		return nil, err
+	}
+
+	res := make(map[string]*memcache.Item, len(m))
+	for _, item := range m {
+		item = c.unwrap(item)
+		res[item.Key] = item
+	}
+	return res, err
+}
+
+// Set writes the given item, unconditionally. See memcache.Client.Set.
+func (c *Client) Set(item *memcache.Item) error {
+	return c.mc.Set(c.wrap(item))
+}
+
+// Add writes the given item, if no value already exists for its key. See
+// memcache.Client.Add.
+func (c *Client) Add(item *memcache.Item) error {
+	return c.mc.Add(c.wrap(item))
+}
+
+// Replace writes the given item, but only if the server *does* already hold
+// data for this key. See memcache.Client.Replace.
+func (c *Client) Replace(item *memcache.Item) error {
+	return c.mc.Replace(c.wrap(item))
+}
+
+// CompareAndSwap writes the given item that was previously returned by Get.
+// See memcache.Client.CompareAndSwap.
+func (c *Client) CompareAndSwap(item *memcache.Item) error {
+	return c.mc.CompareAndSwap(c.wrap(item))
+}
+
+// Delete deletes the item with the provided key. See memcache.Client.Delete.
+func (c *Client) Delete(key string) error {
+	return c.mc.Delete(c.key(key))
+}
+
+// Increment atomically increments key by delta. See
+// memcache.Client.Increment.
+func (c *Client) Increment(key string, delta uint64) (uint64, error) {
+	return c.mc.Increment(c.key(key), delta)
+}
+
+// Decrement atomically decrements key by delta. See
+// memcache.Client.Decrement.
+func (c *Client) Decrement(key string, delta uint64) (uint64, error) {
+	return c.mc.Decrement(c.key(key), delta)
+}
+
+// Touch updates the expiry for the given key. See memcache.Client.Touch.
+func (c *Client) Touch(key string, seconds int32) error {
+	return c.mc.Touch(c.key(key), seconds)
+}
@@ -0,0 +1,163 @@
+package namespace
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/memcachetest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func newTestClient(t *testing.T) (*Client, *memcachetest.Server) {
+	s, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatalf("Cannot start server: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	k := &ketama.Ketama{}
+	if err := k.SetServersAddr([]net.Addr{s.Addr()}); err != nil {
+		t.Fatalf("Cannot set servers: %s", err)
+	}
+
+	return NewWithKetama(k, "app:", false), s
+}
+
+func TestPrefixed(t *testing.T) {
+	c, s := newTestClient(t)
+
+	err := c.Set(&memcache.Item{Key: "foo", Value: []byte("bar")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	if _, ok := s.Item("app:foo"); !ok {
+		t.Errorf("Key was not prefixed on the server")
+	}
+	if _, ok := s.Item("foo"); ok {
+		t.Errorf("Unprefixed key found on the server")
+	}
+
+	it, err := c.Get("foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if it.Key != "foo" || string(it.Value) != "bar" {
+		t.Errorf("Get returned wrong item: %q = %q", it.Key, it.Value)
+	}
+
+	m, err := c.GetMulti([]string{"foo", "missing"})
+	if err != nil {
+		t.Fatalf("GetMulti: %s", err)
+	}
+	if len(m) != 1 || m["foo"] == nil || m["foo"].Key != "foo" {
+		t.Errorf("GetMulti returned wrong items: %v", m)
+	}
+
+	if err := c.Delete("foo"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := c.Get("foo"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get after Delete = %v, want %v",
+			err, memcache.ErrCacheMiss)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	err := c.Set(&memcache.Item{Key: "foo", Value: []byte("1")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	it, err := c.Get("foo")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	it.Value = []byte("2")
+	if err := c.CompareAndSwap(it); err != nil {
+		t.Fatalf("CompareAndSwap: %s", err)
+	}
+	if it.Key != "foo" {
+		t.Errorf("CompareAndSwap modified item's key to %q", it.Key)
+	}
+
+	it.Value = []byte("3")
+	if err := c.CompareAndSwap(it); err != memcache.ErrCASConflict {
+		t.Errorf("Second CompareAndSwap = %v, want %v",
+			err, memcache.ErrCASConflict)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	c, s := newTestClient(t)
+
+	err := c.Set(&memcache.Item{Key: "cnt", Value: []byte("1")})
+	if err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	v, err := c.Increment("cnt", 41)
+	if err != nil {
+		t.Fatalf("Increment: %s", err)
+	}
+	if v != 42 {
+		t.Errorf("Increment = %d, want 42", v)
+	}
+	if it, _ := s.Item("app:cnt"); string(it.Value) != "42" {
+		t.Errorf("Server holds %q, want 42", it.Value)
+	}
+}
+
+func TestGetMultiPartial(t *testing.T) {
+	var servers []*memcachetest.Server
+	var addrs []net.Addr
+	for i := 0; i < 2; i++ {
+		s, err := memcachetest.NewServer()
+		if err != nil {
+			t.Fatalf("Cannot start server: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		servers = append(servers, s)
+		addrs = append(addrs, s.Addr())
+	}
+
+	k := &ketama.Ketama{}
+	if err := k.SetServersAddr(addrs); err != nil {
+		t.Fatalf("Cannot set servers: %s", err)
+	}
+	c := NewWithKetama(k, "app:", false)
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	live := 0
+	for _, key := range keys {
+		err := c.Set(&memcache.Item{Key: key, Value: []byte("x")})
+		if err != nil {
+			t.Fatalf("Set: %s", err)
+		}
+		if addr, _ := k.PickServer("app:" + key); addr == addrs[0] {
+			live++
+		}
+	}
+	if live == 0 || live == len(keys) {
+		t.Fatalf("Keys are not spread over both servers")
+	}
+	servers[1].Close()
+
+	m, err := c.GetMulti(keys)
+	if err == nil {
+		t.Errorf("GetMulti with failed server succeeded")
+	}
+	if len(m) != live {
+		t.Errorf("GetMulti returned %d items, want %d", len(m), live)
+	}
+	for key, it := range m {
+		if it.Key != key {
+			t.Errorf("GetMulti returned %q under %q", it.Key, key)
+		}
+	}
+}
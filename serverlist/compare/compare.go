@@ -0,0 +1,369 @@
+/*
+Package compare measures server selectors of this repository against each
+other on the same server list and key set, so choosing one of them can be
+based on data:
+
+	report := compare.Run(compare.Config{
+		Servers: servers,
+		Keys:    compare.SyntheticKeys(100000),
+	}, compare.Selectors())
+	report.WriteTo(os.Stdout)
+
+For every selector Run measures:
+
+	balance   spread of the keys over the servers: max/mean and
+	          min/mean of keys per server (weighted), and the standard
+	          deviation relative to the mean
+	movement  fraction of the keys moved to another server when
+	          a server is added, removed or its weight changes, next to
+	          the ideal fraction which has to move
+	lookup    average duration of PickServer
+	memory    heap retained by the selector holding the server list
+
+cmd/selectorsim is command line interface to this package.
+*/
+package compare
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlist"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// ErrNoKeys is reported for every selector when Config has no keys.
+var ErrNoKeys = errors.New("no keys to place")
+
+// Selector is server selector under comparison.
+type Selector interface {
+	SetServers(servers []ketama.Server) error
+	PickServer(key string) (net.Addr, error)
+}
+
+// releaser is implemented by selectors whose picks hold load, like bounded
+// load ketama, until released.
+type releaser interface {
+	release()
+}
+
+// Candidate is a named Selector constructor.
+type Candidate struct {
+	Name string
+	New  func() Selector
+}
+
+// Config describes the setup to compare the selectors on.
+type Config struct {
+	// Servers is the server list, at least two servers are needed for
+	// the movement scenarios.
+	Servers []ketama.Server
+	// Keys to place, at least one is needed.
+	Keys []string
+	// Lookups is the number of PickServer calls to measure the lookup
+	// latency with. If zero, len(Keys) is used.
+	Lookups int
+}
+
+// Balance describes spread of the keys over the servers. Number of keys of
+// every server is divided by its weight first, so the ideal value of the
+// ratios is 1 and of the deviation 0.
+type Balance struct {
+	MaxMean float64 `json:"max_mean"`
+	MinMean float64 `json:"min_mean"`
+	StdDev  float64 `json:"stddev"`
+}
+
+// Movement is the fraction of keys moved in single scenario.
+type Movement struct {
+	Scenario string  `json:"scenario"`
+	Moved    float64 `json:"moved"`
+	Ideal    float64 `json:"ideal"`
+}
+
+// Result holds measurements of single selector.
+type Result struct {
+	Name     string        `json:"name"`
+	Balance  Balance       `json:"balance"`
+	Movement []Movement    `json:"movement"`
+	Lookup   time.Duration `json:"lookup_ns"`
+	Memory   uint64        `json:"memory_bytes"`
+	// Err is set when the selector could not be measured.
+	Err string `json:"error,omitempty"`
+}
+
+// Report is the result of Run.
+type Report struct {
+	Servers int      `json:"servers"`
+	Keys    int      `json:"keys"`
+	Results []Result `json:"results"`
+}
+
+// SyntheticKeys returns n distinct keys looking like real ones.
+func SyntheticKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d:profile", i)
+	}
+	return keys
+}
+
+// Run measures all candidates using cfg.
+func Run(cfg Config, candidates []Candidate) Report {
+	report := Report{
+		Servers: len(cfg.Servers),
+		Keys:    len(cfg.Keys),
+	}
+	for _, c := range candidates {
+		r, err := measure(cfg, c)
+		r.Name = c.Name
+		if err != nil {
+			r.Err = err.Error()
+		}
+		report.Results = append(report.Results, r)
+	}
+	return report
+}
+
+func measure(cfg Config, c Candidate) (Result, error) {
+	r := Result{}
+	if len(cfg.Keys) == 0 {
+		return r, ErrNoKeys
+	}
+
+	s, mem, err := build(c, cfg.Servers)
+	if err != nil {
+		return r, err
+	}
+	r.Memory = mem
+
+	placement, err := place(s, cfg.Keys)
+	if err != nil {
+		return r, err
+	}
+	r.Balance = balance(cfg.Servers, placement)
+
+	for _, sc := range scenarios(cfg.Servers) {
+		s, _, err := build(c, sc.servers)
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", sc.name, err)
+		}
+		after, err := place(s, cfg.Keys)
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", sc.name, err)
+		}
+
+		r.Movement = append(r.Movement, Movement{
+			Scenario: sc.name,
+			Moved:    moved(placement, after),
+			Ideal:    sc.ideal,
+		})
+	}
+
+	r.Lookup = lookup(s, cfg)
+	return r, nil
+}
+
+// build returns new selector holding servers and the heap it retains.
+func build(c Candidate, servers []ketama.Server) (Selector, uint64, error) {
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	s := c.New()
+	if err := s.SetServers(servers); err != nil {
+		return nil, 0, err
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(s)
+
+	var mem uint64
+	if after.HeapAlloc > before.HeapAlloc {
+		mem = after.HeapAlloc - before.HeapAlloc
+	}
+	return s, mem, nil
+}
+
+// place returns server of every key, keyed by the address.
+func place(s Selector, keys []string) ([]string, error) {
+	if r, ok := s.(releaser); ok {
+		defer r.release()
+	}
+
+	placement := make([]string, len(keys))
+	for i, key := range keys {
+		addr, err := s.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		placement[i] = addr.Network() + "/" + addr.String()
+	}
+	return placement, nil
+}
+
+func balance(servers []ketama.Server, placement []string) Balance {
+	counts := make(map[string]int)
+	for _, p := range placement {
+		counts[p]++
+	}
+
+	totalWeight := 0
+	for _, server := range servers {
+		totalWeight += serverlist.Weight(server)
+	}
+
+	// Keys per unit of weight, every server should have the mean.
+	mean := float64(len(placement)) / float64(totalWeight)
+	b := Balance{MinMean: math.Inf(1)}
+	var sq float64
+	for _, server := range servers {
+		addr := server.Addr.Network() + "/" + server.Addr.String()
+		w := float64(serverlist.Weight(server))
+		norm := float64(counts[addr]) / w / mean
+
+		b.MaxMean = math.Max(b.MaxMean, norm)
+		b.MinMean = math.Min(b.MinMean, norm)
+		sq += (norm - 1) * (norm - 1)
+	}
+	b.StdDev = math.Sqrt(sq / float64(len(servers)))
+
+	return b
+}
+
+func moved(before []string, after []string) float64 {
+	n := 0
+	for i := range before {
+		if before[i] != after[i] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(before))
+}
+
+func lookup(s Selector, cfg Config) time.Duration {
+	n := cfg.Lookups
+	if n == 0 {
+		n = len(cfg.Keys)
+	}
+	if n == 0 {
+		return 0
+	}
+
+	r, _ := s.(releaser)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		s.PickServer(cfg.Keys[i%len(cfg.Keys)])
+		if r != nil {
+			r.release()
+		}
+	}
+	return time.Since(start) / time.Duration(n)
+}
+
+// scenario is a change of the server list.
+type scenario struct {
+	name    string
+	servers []ketama.Server
+	// ideal is the fraction of keys which has to move.
+	ideal float64
+}
+
+func scenarios(servers []ketama.Server) []scenario {
+	if len(servers) < 2 {
+		return nil
+	}
+
+	total := 0
+	for _, server := range servers {
+		total += serverlist.Weight(server)
+	}
+	first := serverlist.Weight(servers[0])
+	last := serverlist.Weight(servers[len(servers)-1])
+
+	added := append(append([]ketama.Server(nil), servers...),
+		ketama.Server{Addr: &net.TCPAddr{
+			IP:   net.IPv4(192, 0, 2, 1),
+			Port: 11211,
+		}})
+
+	doubled := append([]ketama.Server(nil), servers...)
+	doubled[0].Weight = 2 * first
+
+	return []scenario{{
+		name:    "add",
+		servers: added,
+		ideal:   1 / float64(total+1),
+	}, {
+		name:    "remove-first",
+		servers: servers[1:],
+		ideal:   float64(first) / float64(total),
+	}, {
+		name:    "remove-last",
+		servers: servers[:len(servers)-1],
+		ideal:   float64(last) / float64(total),
+	}, {
+		name:    "double-weight",
+		servers: doubled,
+		ideal:   float64(first) / float64(total+first),
+	}}
+}
+
+// WriteTo writes r as human readable table to w.
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	tw := tabwriter.NewWriter(cw, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%d servers, %d keys\n\n", r.Servers, r.Keys)
+	fmt.Fprintf(tw, "selector\tmax/mean\tmin/mean\tstddev\t"+
+		"lookup\tmemory\n")
+	for _, res := range r.Results {
+		if res.Err != "" {
+			fmt.Fprintf(tw, "%s\terror: %s\n", res.Name, res.Err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%.3f\t%.3f\t%.3f\t%s\t%d B\n",
+			res.Name,
+			res.Balance.MaxMean,
+			res.Balance.MinMean,
+			res.Balance.StdDev,
+			res.Lookup,
+			res.Memory)
+	}
+
+	fmt.Fprintf(tw, "\nselector\tscenario\tmoved\tideal\n")
+	for _, res := range r.Results {
+		for _, m := range res.Movement {
+			fmt.Fprintf(tw, "%s\t%s\t%.2f %%\t%.2f %%\n",
+				res.Name, m.Scenario, m.Moved*100, m.Ideal*100)
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	if cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
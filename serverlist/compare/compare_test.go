@@ -0,0 +1,155 @@
+package compare
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func servers(n int) []ketama.Server {
+	servers := make([]ketama.Server, n)
+	for i := range servers {
+		servers[i].Addr = &net.TCPAddr{
+			IP:   net.IPv4(10, 0, 0, byte(i+1)),
+			Port: 11211,
+		}
+	}
+	return servers
+}
+
+func TestRun(t *testing.T) {
+	report := Run(Config{
+		Servers: servers(10),
+		Keys:    SyntheticKeys(20000),
+	}, Selectors())
+
+	if len(report.Results) != len(Selectors()) {
+		t.Fatalf("Report has %d results, want %d",
+			len(report.Results), len(Selectors()))
+	}
+
+	results := make(map[string]Result)
+	for _, r := range report.Results {
+		if r.Err != "" {
+			t.Errorf("%s failed: %s", r.Name, r.Err)
+		}
+		if r.Balance.MaxMean < 1 || r.Balance.MinMean > 1 {
+			t.Errorf("%s has impossible balance %+v", r.Name, r.Balance)
+		}
+		if len(r.Movement) != 4 {
+			t.Errorf("%s has %d movement scenarios, want 4",
+				r.Name, len(r.Movement))
+		}
+		if r.Lookup <= 0 {
+			t.Errorf("%s has lookup latency %s", r.Name, r.Lookup)
+		}
+		results[r.Name] = r
+	}
+
+	// Jump is known to move nearly everything on removal of the first
+	// server and nothing but the removed keys on removal of the last one.
+	jump := results["jump"].Movement
+	if jump[1].Scenario != "remove-first" || jump[1].Moved < 0.5 {
+		t.Errorf("jump remove-first = %+v, want most keys moved", jump[1])
+	}
+	if jump[2].Scenario != "remove-last" ||
+		jump[2].Moved > jump[2].Ideal*1.2 {
+
+		t.Errorf("jump remove-last = %+v, want about ideal", jump[2])
+	}
+}
+
+func TestBalance(t *testing.T) {
+	s := servers(2)
+	s[1].Weight = 3
+	placement := []string{"tcp/10.0.0.1:11211", "tcp/10.0.0.2:11211",
+		"tcp/10.0.0.2:11211", "tcp/10.0.0.2:11211"}
+
+	b := balance(s, placement)
+	if b.MaxMean != 1 || b.MinMean != 1 || b.StdDev != 0 {
+		t.Errorf("balance = %+v, want perfect", b)
+	}
+}
+
+func TestBoundedLoadReleased(t *testing.T) {
+	b, err := ketama.NewBoundedLoad(&ketama.Ketama{}, 0.25)
+	if err != nil {
+		t.Fatalf("NewBoundedLoad: %s", err)
+	}
+	s := &boundedLoad{BoundedLoad: b}
+	if err := s.SetServers(servers(3)); err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+
+	keys := SyntheticKeys(1000)
+	if _, err := place(s, keys); err != nil {
+		t.Fatalf("place: %s", err)
+	}
+	lookup(s, Config{Keys: keys})
+
+	for _, server := range servers(3) {
+		if n := b.Load(server.Addr); n != 0 {
+			t.Errorf("Load(%s) = %d after placement, want 0",
+				server.Addr, n)
+		}
+	}
+}
+
+func TestRunError(t *testing.T) {
+	broken := errors.New("broken")
+	report := Run(Config{
+		Servers: servers(2),
+		Keys:    SyntheticKeys(10),
+	}, []Candidate{{
+		Name: "broken",
+		New:  func() Selector { return brokenSelector{broken} },
+	}})
+
+	if r := report.Results[0]; r.Err != broken.Error() {
+		t.Errorf("Err = %q, want %q", r.Err, broken)
+	}
+}
+
+func TestRunNoKeys(t *testing.T) {
+	report := Run(Config{Servers: servers(2)}, Selectors())
+	for _, r := range report.Results {
+		if r.Err != ErrNoKeys.Error() {
+			t.Errorf("%s: Err = %q, want %q", r.Name, r.Err, ErrNoKeys)
+		}
+	}
+}
+
+type brokenSelector struct {
+	err error
+}
+
+func (s brokenSelector) SetServers([]ketama.Server) error { return s.err }
+
+func (s brokenSelector) PickServer(string) (net.Addr, error) {
+	return nil, s.err
+}
+
+func TestWriteTo(t *testing.T) {
+	report := Run(Config{
+		Servers: servers(3),
+		Keys:    SyntheticKeys(100),
+	}, Selectors())
+
+	b := bytes.Buffer{}
+	n, err := report.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo = %d, wrote %d bytes", n, b.Len())
+	}
+	for _, c := range Selectors() {
+		if !strings.Contains(b.String(), c.Name) {
+			t.Errorf("Report does not mention %s:\n%s", c.Name, b.String())
+		}
+	}
+}
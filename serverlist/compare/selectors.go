@@ -0,0 +1,63 @@
+package compare
+
+import (
+	"net"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/jump"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/maglev"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/rendezvous"
+)
+
+// boundedLoad makes ketama.BoundedLoad a Selector. Every picked key is
+// acquired until release, as if each key was a running request, so the bound
+// applies to the placement itself. Run releases the keys after every
+// placement and every lookup, the loads do not leak into the next one.
+type boundedLoad struct {
+	*ketama.BoundedLoad
+	acquired []net.Addr
+}
+
+func (b *boundedLoad) SetServers(servers []ketama.Server) error {
+	return b.Ketama().SetServers(servers)
+}
+
+func (b *boundedLoad) PickServer(key string) (net.Addr, error) {
+	addr, err := b.BoundedLoad.PickServer(key)
+	if err == nil {
+		b.Acquire(addr)
+		b.acquired = append(b.acquired, addr)
+	}
+	return addr, err
+}
+
+func (b *boundedLoad) release() {
+	for _, addr := range b.acquired {
+		b.Release(addr)
+	}
+	b.acquired = b.acquired[:0]
+}
+
+// Selectors returns candidates for every selector in this repository.
+func Selectors() []Candidate {
+	return []Candidate{{
+		Name: "ketama",
+		New:  func() Selector { return &ketama.Ketama{} },
+	}, {
+		Name: "ketama-bounded-load",
+		New: func() Selector {
+			// 0.25 is valid epsilon, there is no error.
+			b, _ := ketama.NewBoundedLoad(&ketama.Ketama{}, 0.25)
+			return &boundedLoad{BoundedLoad: b}
+		},
+	}, {
+		Name: "jump",
+		New:  func() Selector { return &jump.Jump{} },
+	}, {
+		Name: "rendezvous",
+		New:  func() Selector { return &rendezvous.Rendezvous{} },
+	}, {
+		Name: "maglev",
+		New:  func() Selector { return &maglev.Maglev{} },
+	}}
+}
@@ -0,0 +1,35 @@
+/*
+Package jump provides server selection using Jump Consistent Hash (Lamping and
+Veach, "A Fast, Minimal Memory, Consistent Hash Algorithm").
+
+Compared to serverlist/ketama, keys are spread perfectly evenly and no
+continuum is held in memory, but the placement is not compatible with
+libmemcached. Use it for clusters accessed from Go only. Jump implements
+memcache.ServerSelector:
+
+	j := &jump.Jump{}
+	j.SetServersAddr(addrs)
+
+	mc := memcache.NewFromSelector(j)
+
+Jump hashes keys into buckets numbered 0 to n-1 and the order of the servers
+decides which server owns which bucket. Adding a bucket at the end moves only
+the keys the new bucket takes over, 1/n of them, and nothing else. That gives
+the rules for changing the server list:
+
+Add new servers to the end of the list.
+
+Remove only the last server. Removing a server from the middle shifts all the
+servers after it into different buckets and moves most of the keys. To take
+a server from the middle out of service, fill its bucket by moving the last
+server of the list into its slot, so the list gets one shorter at the end.
+Only the keys of the removed server and of the last bucket move, the rest stay
+where they are (as long as both servers have the same weight).
+
+Weight w of a server gives it w consecutive buckets, so it gets w times more
+keys than a server with weight 1. Changing weight of the last server behaves
+like adding or removing servers at the end. Changing weight of any other
+server shifts the buckets of all servers after it and moves most of the keys,
+the same way removal from the middle does.
+*/
+package jump
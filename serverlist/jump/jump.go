@@ -0,0 +1,109 @@
+package jump
+
+import (
+	"net"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlist"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// ErrNilAddr is reported by SetServers for server without address.
+var ErrNilAddr = serverlist.ErrNilAddr
+
+// Jump provides server list using Jump Consistent Hash. Zero value is an empty
+// server list ready to use.
+type Jump struct {
+	servers []ketama.Server
+	addrs   []net.Addr
+	// buckets holds owner of every bucket, server with weight w owns w
+	// consecutive ones.
+	buckets []net.Addr
+	m       sync.RWMutex
+}
+
+// SetServers updates current list of servers to servers. Mind the order, see
+// package documentation. It is safe to call from multiple goroutines at once.
+//
+// Weight 0 is considered same as 1, the same way Ketama does. All servers are
+// checked before any change is made. If any of them is invalid, returned error
+// is ketama.ServerErrors describing every invalid server.
+func (j *Jump) SetServers(servers []ketama.Server) error {
+	if err := serverlist.Validate(servers); err != nil {
+		return err
+	}
+
+	var addrs []net.Addr
+	var buckets []net.Addr
+	for _, server := range servers {
+		addrs = append(addrs, server.Addr)
+		for w := 0; w < serverlist.Weight(server); w++ {
+			buckets = append(buckets, server.Addr)
+		}
+	}
+
+	servers = append([]ketama.Server(nil), servers...)
+
+	j.m.Lock()
+	j.servers = servers
+	j.addrs = addrs
+	j.buckets = buckets
+	j.m.Unlock()
+
+	return nil
+}
+
+// SetServersAddr updates current list of servers to addrs. All addresses have
+// weight of 1. It is safe to call from multiple goroutines at once.
+func (j *Jump) SetServersAddr(addrs []net.Addr) error {
+	return j.SetServers(serverlist.FromAddrs(addrs))
+}
+
+// LookupServer returns the server with address addr from the current list. Safe
+// to call from multiple goroutines at once.
+func (j *Jump) LookupServer(addr net.Addr) (ketama.Server, bool) {
+	j.m.RLock()
+	defer j.m.RUnlock()
+
+	return serverlist.Lookup(j.servers, addr)
+}
+
+// PickServer returns address onto which the key should go. Safe to call from
+// multiple goroutines at once.
+func (j *Jump) PickServer(key string) (net.Addr, error) {
+	j.m.RLock()
+	defer j.m.RUnlock()
+
+	if len(j.buckets) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+
+	return j.buckets[hash(serverlist.FNV1a(key), len(j.buckets))], nil
+}
+
+// Each calls fn with every address that is currently registered into this
+// server list.
+func (j *Jump) Each(fn func(net.Addr) error) error {
+	j.m.RLock()
+	addrs := j.addrs
+	j.m.RUnlock()
+
+	return serverlist.Each(addrs, fn)
+}
+
+// hash returns bucket in range [0, n) for key, as described in the paper.
+func hash(key uint64, n int) int {
+	var b int64 = -1
+	var j int64
+
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) *
+			(float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
@@ -0,0 +1,140 @@
+package jump
+
+import (
+	"net"
+	"testing"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlisttest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func TestHashMonotone(t *testing.T) {
+	for key := uint64(0); key < 10000; key++ {
+		prev := hash(key, 1)
+		if prev != 0 {
+			t.Fatalf("hash(%d, 1) = %d, want 0", key, prev)
+		}
+		for n := 2; n <= 50; n++ {
+			b := hash(key, n)
+			if b != prev && b != n-1 {
+				t.Fatalf("hash(%d, %d) = %d, want %d or %d",
+					key, n, b, prev, n-1)
+			}
+			prev = b
+		}
+	}
+}
+
+func TestBalance(t *testing.T) {
+	j := &Jump{}
+	if err := j.SetServersAddr(serverlisttest.Addrs(10)); err != nil {
+		t.Fatalf("SetServersAddr: %s", err)
+	}
+
+	counts := make(map[net.Addr]int)
+	keys := serverlisttest.Keys(100000)
+	for _, addr := range serverlisttest.PickAll(t, j, keys) {
+		counts[addr]++
+	}
+
+	ideal := len(keys) / 10
+	for addr, n := range counts {
+		if n < ideal*95/100 || n > ideal*105/100 {
+			t.Errorf("%s got %d keys, want %d +- 5 %%", addr, n, ideal)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	a := serverlisttest.Addrs(2)
+	j := &Jump{}
+	err := j.SetServers([]ketama.Server{
+		{Addr: a[0], Weight: 0},
+		{Addr: a[1], Weight: 3},
+	})
+	if err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+
+	counts := make(map[net.Addr]int)
+	keys := serverlisttest.Keys(40000)
+	for _, addr := range serverlisttest.PickAll(t, j, keys) {
+		counts[addr]++
+	}
+	if n := counts[a[0]]; n < 9000 || n > 11000 {
+		t.Errorf("Server with weight 0 got %d keys, want about 10000", n)
+	}
+}
+
+func TestAddRemoveLast(t *testing.T) {
+	keys := serverlisttest.Keys(100000)
+	a := serverlisttest.Addrs(11)
+
+	j := &Jump{}
+	j.SetServersAddr(a[:10])
+	before := serverlisttest.PickAll(t, j, keys)
+
+	j.SetServersAddr(a)
+	after := serverlisttest.PickAll(t, j, keys)
+
+	moved := 0
+	for _, key := range keys {
+		if before[key] == after[key] {
+			continue
+		}
+		moved++
+		if after[key] != a[10] {
+			t.Fatalf("Key %q moved to old server %s", key, after[key])
+		}
+	}
+	if moved < len(keys)/11*9/10 || moved > len(keys)/11*11/10 {
+		t.Errorf("%d keys moved, want about %d", moved, len(keys)/11)
+	}
+
+	j.SetServersAddr(a[:10])
+	for key, addr := range serverlisttest.PickAll(t, j, keys) {
+		if addr != before[key] {
+			t.Fatalf("Key %q did not return to %s", key, before[key])
+		}
+	}
+}
+
+func TestReplaceInPlace(t *testing.T) {
+	keys := serverlisttest.Keys(10000)
+	a := serverlisttest.Addrs(11)
+
+	j := &Jump{}
+	j.SetServersAddr(a[:10])
+	before := serverlisttest.PickAll(t, j, keys)
+
+	replaced := append([]net.Addr(nil), a[:10]...)
+	replaced[3] = a[10]
+	j.SetServersAddr(replaced)
+
+	for key, addr := range serverlisttest.PickAll(t, j, keys) {
+		if before[key] == a[3] {
+			if addr != a[10] {
+				t.Errorf("Key %q of replaced server went to %s", key, addr)
+			}
+		} else if addr != before[key] {
+			t.Errorf("Key %q moved from %s to %s", key, before[key], addr)
+		}
+	}
+}
+
+func TestServerList(t *testing.T) {
+	serverlisttest.Run(t, func() serverlisttest.List { return &Jump{} })
+}
+
+func BenchmarkPickServer(b *testing.B) {
+	j := &Jump{}
+	j.SetServersAddr(serverlisttest.Addrs(100))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		j.PickServer("some-key")
+	}
+
+	b.ReportAllocs()
+}
@@ -0,0 +1,176 @@
+package ketama
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ErrEpsilon is returned by NewBoundedLoad for epsilon that is not > 0.
+var ErrEpsilon = errors.New("epsilon must be > 0")
+
+// walk calls fn with distinct addresses of the continuum, starting with the
+// owner of position h and going clockwise, until fn returns false or all
+// addresses were visited.
+func (c *continuum) walk(h uint, fn func(net.Addr) bool) {
+	if c == nil || len(c.ring) == 0 {
+		return
+	}
+
+	var seen map[net.Addr]bool
+
+	i := search(c.ring, h)
+	for n := 0; n < len(c.ring); n++ {
+		addr := c.ring[i].bucket.UserData.(net.Addr)
+		if !seen[addr] {
+			if !fn(addr) {
+				return
+			}
+			if seen == nil {
+				seen = make(map[net.Addr]bool)
+			}
+			seen[addr] = true
+		}
+
+		if i++; i == uint(len(c.ring)) {
+			i = 0
+		}
+	}
+}
+
+// BoundedLoad picks servers using consistent hashing with bounded loads
+// (Mirrokni, Thorup and Zadimoghaddam, "Consistent Hashing with Bounded
+// Loads") on top of the Ketama continuum.
+//
+// Clients report requests in flight using Acquire and Release. No server is
+// picked while it has (1+ε) times more requests in flight than its share of
+// the total (the share is proportional to its weight), the key goes to the
+// next server clockwise on the continuum instead. While the load is even,
+// placement is the same as the one of Ketama.
+//
+// Placement depends on the load, so a Set and a later Get of the same key can
+// go to different servers, and the Get then misses. BoundedLoad suits reads
+// of items any server can fill (or which are written everywhere), not the
+// usual look-aside caching.
+//
+// client.Client calls Acquire and Release on its own around every request
+// when BoundedLoad is its selector. BoundedLoad is safe to use from multiple
+// goroutines at once.
+type BoundedLoad struct {
+	k       *Ketama
+	epsilon float64
+
+	loads map[string]int64
+	total int64
+	m     sync.Mutex
+}
+
+// NewBoundedLoad returns BoundedLoad using server list of k with capacity
+// factor epsilon, which must be > 0 (and finite). Lower epsilon balances the
+// load more evenly, but more keys are moved away from their servers.
+func NewBoundedLoad(k *Ketama, epsilon float64) (*BoundedLoad, error) {
+	if !(epsilon > 0) || math.IsInf(epsilon, 1) {
+		return nil, ErrEpsilon
+	}
+
+	return &BoundedLoad{
+		k:       k,
+		epsilon: epsilon,
+		loads:   make(map[string]int64),
+	}, nil
+}
+
+// Ketama returns the underlying Ketama.
+func (b *BoundedLoad) Ketama() *Ketama {
+	return b.k
+}
+
+// PickServer returns address onto which the key should go: the first server
+// clockwise from the key's position on the continuum with load under the
+// bound. Namespace and hash tag of the Ketama are used, hot keys are not
+// recorded.
+func (b *BoundedLoad) PickServer(key string) (net.Addr, error) {
+	b.k.m.RLock()
+	defer b.k.m.RUnlock()
+
+	if b.k.continuum == nil {
+		return nil, memcache.ErrNoServers
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	// Bound of server with weight 1. The request about to be made counts
+	// as well, so no bound is below 1.
+	unit := (1 + b.epsilon) * float64(b.total+1) / float64(b.k.totalWeight)
+
+	var picked net.Addr
+	b.k.continuum.walk(b.k.keyHash(key), func(addr net.Addr) bool {
+		if picked == nil {
+			// The owner is the fallback if everything is full.
+			picked = addr
+		}
+
+		id := addrKey(addr)
+		w := fixWeight(b.k.servers[b.k.index[id]].Weight)
+		if b.loads[id] < int64(math.Ceil(unit*float64(w))) {
+			picked = addr
+			return false
+		}
+		return true
+	})
+	return picked, nil
+}
+
+// Acquire reports request to addr started.
+func (b *BoundedLoad) Acquire(addr net.Addr) {
+	b.m.Lock()
+	b.loads[addrKey(addr)]++
+	b.total++
+	b.m.Unlock()
+}
+
+// Release reports request to addr, previously reported by Acquire, finished.
+func (b *BoundedLoad) Release(addr net.Addr) {
+	key := addrKey(addr)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.loads[key] == 0 {
+		return
+	}
+
+	b.total--
+	if b.loads[key]--; b.loads[key] == 0 {
+		delete(b.loads, key)
+	}
+}
+
+// Load returns the number of requests to addr in flight.
+func (b *BoundedLoad) Load(addr net.Addr) int64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.loads[addrKey(addr)]
+}
+
+// Each calls fn with every address of the underlying Ketama.
+func (b *BoundedLoad) Each(fn func(net.Addr) error) error {
+	return b.k.Each(fn)
+}
+
+// LookupServer returns the server with address addr from the underlying
+// Ketama.
+func (b *BoundedLoad) LookupServer(addr net.Addr) (Server, bool) {
+	return b.k.LookupServer(addr)
+}
+
+// Subscribe registers fn to be called on changes of the server list of the
+// underlying Ketama, see Ketama.Subscribe.
+func (b *BoundedLoad) Subscribe(fn func(TopologyChange)) (unsubscribe func()) {
+	return b.k.Subscribe(fn)
+}
@@ -0,0 +1,162 @@
+package ketama
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func newBoundedLoad(t *testing.T, n int, epsilon float64) *BoundedLoad {
+	addrs := make([]net.Addr, n)
+	for i := range addrs {
+		addrs[i] = &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 11211}
+	}
+
+	k := &Ketama{}
+	if err := k.SetServersAddr(addrs); err != nil {
+		t.Fatalf("SetServersAddr: %s", err)
+	}
+
+	b, err := NewBoundedLoad(k, epsilon)
+	if err != nil {
+		t.Fatalf("NewBoundedLoad: %s", err)
+	}
+	return b
+}
+
+func TestBoundedLoadEpsilon(t *testing.T) {
+	for _, epsilon := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		_, err := NewBoundedLoad(&Ketama{}, epsilon)
+		if err != ErrEpsilon {
+			t.Errorf("NewBoundedLoad(%v) = %v, want %v",
+				epsilon, err, ErrEpsilon)
+		}
+	}
+}
+
+func TestBoundedLoadUnloaded(t *testing.T) {
+	b := newBoundedLoad(t, 5, 0.25)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		got, _ := b.PickServer(key)
+		want, _ := b.Ketama().PickServer(key)
+		if got != want {
+			t.Fatalf("PickServer(%q) = %s, want %s as Ketama", key, got, want)
+		}
+	}
+}
+
+func TestBoundedLoadSpills(t *testing.T) {
+	b := newBoundedLoad(t, 5, 0.25)
+
+	owner, _ := b.Ketama().PickServer("hot")
+	for i := 0; i < 10; i++ {
+		b.Acquire(owner)
+	}
+
+	got, _ := b.PickServer("hot")
+	if got == owner {
+		t.Fatalf("PickServer returned overloaded owner %s", owner)
+	}
+
+	var next net.Addr
+	b.k.continuum.walk(b.k.keyHash("hot"), func(addr net.Addr) bool {
+		if addr != owner {
+			next = addr
+			return false
+		}
+		return true
+	})
+	if got != next {
+		t.Errorf("PickServer = %s, want next server on the ring %s",
+			got, next)
+	}
+
+	for i := 0; i < 10; i++ {
+		b.Release(owner)
+	}
+	if got, _ := b.PickServer("hot"); got != owner {
+		t.Errorf("PickServer after Release = %s, want %s", got, owner)
+	}
+}
+
+func TestBoundedLoadBound(t *testing.T) {
+	const (
+		servers  = 5
+		requests = 1000
+		epsilon  = 0.25
+	)
+	b := newBoundedLoad(t, servers, epsilon)
+
+	// Every request sticks to the same key, without the bound all of them
+	// would go to the single owner.
+	for i := 0; i < requests; i++ {
+		addr, _ := b.PickServer("hot")
+		b.Acquire(addr)
+	}
+
+	limit := int64(math.Ceil((1 + epsilon) * requests / servers))
+	b.Each(func(addr net.Addr) error {
+		if n := b.Load(addr); n > limit {
+			t.Errorf("%s has load %d, want at most %d", addr, n, limit)
+		}
+		return nil
+	})
+}
+
+func TestBoundedLoadWeights(t *testing.T) {
+	const (
+		requests = 1000
+		epsilon  = 0.25
+	)
+	a := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 11211},
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11211},
+	}
+	k := &Ketama{}
+	k.SetServers([]Server{{Addr: a[0], Weight: 1}, {Addr: a[1], Weight: 3}})
+	b, _ := NewBoundedLoad(k, epsilon)
+
+	for i := 0; i < requests; i++ {
+		addr, _ := b.PickServer(fmt.Sprintf("key-%d", i%10))
+		b.Acquire(addr)
+	}
+
+	for i, w := range []float64{1, 3} {
+		limit := int64(math.Ceil((1 + epsilon) * requests * w / 4))
+		if n := b.Load(a[i]); n > limit {
+			t.Errorf("%s has load %d, want at most %d", a[i], n, limit)
+		}
+	}
+	if n := b.Load(a[1]); n <= requests/2 {
+		t.Errorf("Heavier server has load %d, want more than half", n)
+	}
+}
+
+func TestBoundedLoadRelease(t *testing.T) {
+	b := newBoundedLoad(t, 1, 0.25)
+	addr, _ := b.PickServer("foo")
+
+	b.Release(addr)
+	if n := b.Load(addr); n != 0 {
+		t.Errorf("Load after unmatched Release = %d, want 0", n)
+	}
+
+	b.Acquire(addr)
+	b.Acquire(addr)
+	b.Release(addr)
+	if n := b.Load(addr); n != 1 {
+		t.Errorf("Load = %d, want 1", n)
+	}
+}
+
+func TestBoundedLoadNoServers(t *testing.T) {
+	b, _ := NewBoundedLoad(&Ketama{}, 0.25)
+	if _, err := b.PickServer("foo"); err != memcache.ErrNoServers {
+		t.Errorf("PickServer = %v, want %v", err, memcache.ErrNoServers)
+	}
+}
@@ -0,0 +1,73 @@
+package ketama
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ServerError describes single invalid server passed to SetServers.
+type ServerError struct {
+	// Index of the server in the list passed to SetServers.
+	Index int
+	// Addr of the server.
+	Addr net.Addr
+	// Err is the reason server was rejected. It is one of sentinel errors
+	// of this package (possibly wrapped) or error returned by Validator.
+	Err error
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server %d (%v): %s", e.Index, e.Addr, e.Err)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// ServerErrors is returned by SetServers when any of the servers is invalid. It
+// holds one ServerError for each invalid server, ordered by index.
+//
+// errors.Is reports whether any of the contained errors matches the target,
+// errors.As with *ServerError target extracts the first one.
+type ServerErrors []*ServerError
+
+func (e ServerErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Sprintf("%d invalid server(s): %s",
+		len(e), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the contained errors matches target.
+func (e ServerErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first contained error that matches target.
+func (e ServerErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e ServerErrors) sort() {
+	sort.SliceStable(e, func(i, j int) bool {
+		return e[i].Index < e[j].Index
+	})
+}
@@ -0,0 +1,108 @@
+package ketama
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestServerErrorsAggregated(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11211}
+
+	k := &Ketama{}
+	err := k.SetServers([]Server{
+		{Addr: tcpAddr(1), Weight: 1},
+		{Addr: fakeAddr{}, Weight: 1},
+		{Addr: tcpAddr(2), Weight: -1},
+		{Addr: udp, Weight: 1},
+		{Addr: tcpAddr(3), Weight: 1},
+	})
+
+	var errs ServerErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Error is not ServerErrors: %v", err)
+	}
+
+	want := []struct {
+		index int
+		err   error
+	}{
+		{1, ErrUnsupportedAddr},
+		{2, ErrNegativeWeight},
+		{3, ErrMixedTCPUDP},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Got %d errors, want %d: %v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		if errs[i].Index != w.index {
+			t.Errorf("Error %d has index %d, want %d",
+				i, errs[i].Index, w.index)
+		}
+		if !errors.Is(errs[i], w.err) {
+			t.Errorf("Error %d is %v, want %v", i, errs[i], w.err)
+		}
+	}
+
+	for _, w := range want {
+		if !errors.Is(err, w.err) {
+			t.Errorf("errors.Is(err, %v) is false", w.err)
+		}
+	}
+	if errors.Is(err, ErrUDPNotSupported) {
+		t.Errorf("errors.Is matched error that is not present")
+	}
+
+	var se *ServerError
+	if !errors.As(err, &se) {
+		t.Fatalf("Cannot extract *ServerError")
+	}
+	if se.Index != 1 || se.Addr != (fakeAddr{}) {
+		t.Errorf("Wrong first error: %v", se)
+	}
+
+	if s := k.Snapshot(); s.Generation != 0 || len(s.Servers) != 0 {
+		t.Errorf("Invalid list was partially applied")
+	}
+}
+
+func TestServerErrorsMixedUDPFirst(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11211}
+
+	k := &Ketama{}
+	err := k.SetServers([]Server{
+		{Addr: udp, Weight: 1},
+		{Addr: tcpAddr(1), Weight: 1},
+		{Addr: &net.UnixAddr{Name: "/tmp/mc.sock", Net: "unix"}, Weight: 1},
+		{Addr: tcpAddr(2), Weight: 1},
+	})
+
+	var errs ServerErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Error is not ServerErrors: %v", err)
+	}
+	if len(errs) != 2 || errs[0].Index != 1 || errs[1].Index != 3 {
+		t.Errorf("TCP servers should be reported: %v", err)
+	}
+}
+
+func TestServerErrorsValidator(t *testing.T) {
+	udp1 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	udp2 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}
+
+	k := &Ketama{}
+	k.SetValidator(RejectUDP)
+
+	err := k.SetServersAddr([]net.Addr{udp1, udp2})
+
+	var errs ServerErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Error is not ServerErrors: %v", err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("Both UDP servers should be reported: %v", err)
+	}
+	if !errors.Is(err, ErrUDPNotSupported) {
+		t.Errorf("Wrong error returned: %v", err)
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
 )
 
-func ExampleUsage() {
+func Example() {
 	k := &ketama.Ketama{}
 	k.SetServersAddr([]net.Addr{&net.TCPAddr{
 		IP:   net.ParseIP("127.0.0.1"),
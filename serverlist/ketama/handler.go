@@ -0,0 +1,167 @@
+package ketama
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+)
+
+// ServerStatus describes single server in Status.
+type ServerStatus struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	Weight  int    `json:"weight"`
+	// Points is the number of points the server has on the continuum.
+	Points int `json:"points"`
+	// Share is the fraction of the key space owned by the server.
+	Share float64 `json:"share"`
+}
+
+// Status is the state of Ketama as rendered by Handler.
+type Status struct {
+	Generation uint64         `json:"generation"`
+	Servers    []ServerStatus `json:"servers"`
+}
+
+// shares returns number of points and fraction of the key space owned by
+// each address.
+func (c *continuum) shares() (map[net.Addr]int, map[net.Addr]float64) {
+	points := make(map[net.Addr]int)
+	shares := make(map[net.Addr]float64)
+	if c == nil || len(c.ring) == 0 {
+		return points, shares
+	}
+
+	const space = 1 << 32
+
+	// Point owns the arc from the previous point (exclusive) up to
+	// itself, the first one owns the wrap around as well. Points are
+	// 32 bit, uint32 arithmetic handles the wrap.
+	prev := uint32(c.ring[len(c.ring)-1].point)
+	for _, p := range c.ring {
+		addr := p.bucket.UserData.(net.Addr)
+		arc := uint32(p.point) - prev
+
+		points[addr]++
+		shares[addr] += float64(arc) / space
+		prev = uint32(p.point)
+	}
+	if len(c.ring) == 1 {
+		shares[c.ring[0].bucket.UserData.(net.Addr)] = 1
+	}
+	return points, shares
+}
+
+// Status returns current server list with weights, number of points and share
+// of the key space of each server. Safe to call from multiple goroutines at
+// once.
+func (k *Ketama) Status() Status {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.status()
+}
+
+// status implements Status. Caller must hold the lock.
+func (k *Ketama) status() Status {
+	points, shares := k.continuum.shares()
+
+	s := Status{
+		Generation: k.generation,
+		Servers:    make([]ServerStatus, 0, len(k.servers)),
+	}
+	for _, server := range k.servers {
+		s.Servers = append(s.Servers, ServerStatus{
+			Network: server.Addr.Network(),
+			Addr:    server.Addr.String(),
+			Weight:  fixWeight(server.Weight),
+			Points:  points[server.Addr],
+			Share:   shares[server.Addr],
+		})
+	}
+	return s
+}
+
+// keyOwner is the answer of Handler to "which server owns this key?".
+type keyOwner struct {
+	Key        string `json:"key"`
+	Network    string `json:"network,omitempty"`
+	Server     string `json:"server,omitempty"`
+	Generation uint64 `json:"generation"`
+	Error      string `json:"error,omitempty"`
+}
+
+var handlerTemplate = template.Must(template.New("ketama").
+	Funcs(template.FuncMap{
+		"percent": func(f float64) float64 { return f * 100 },
+	}).
+	Parse(handlerHTML))
+
+const handlerHTML = `<!DOCTYPE html>
+<html>
+<head><title>ketama</title></head>
+<body>
+<h1>ketama, generation {{.Status.Generation}}</h1>
+<table border="1">
+<tr><th>Network</th><th>Address</th><th>Weight</th><th>Points</th><th>Key space</th></tr>
+{{- range .Status.Servers}}
+<tr><td>{{.Network}}</td><td>{{.Addr}}</td><td>{{.Weight}}</td><td>{{.Points}}</td><td>{{printf "%.2f" (percent .Share)}} %</td></tr>
+{{- end}}
+</table>
+<h2>Which server owns this key?</h2>
+<form method="get">
+<input type="text" name="key" value="{{.Owner.Key}}">
+<input type="submit" value="Look up">
+</form>
+{{- with .Owner}}{{if .Key}}
+<p>{{if .Error}}{{.Key}}: {{.Error}}{{else}}{{.Key}} is owned by {{.Network}} {{.Server}}{{end}}</p>
+{{- end}}{{end}}
+</body>
+</html>
+`
+
+// Handler returns http.Handler for inspection of k, meant to be mounted on
+// debug ports. It renders HTML page with the generation, the servers with
+// their weights and shares of the key space and a form for looking up the
+// server owning a key (query parameter key). With query parameter format=json
+// it returns Status, or the owner of the key, as JSON instead.
+//
+// Looking keys up does not record them as hot keys (see SetHotKeys).
+func (k *Ketama) Handler() http.Handler {
+	return http.HandlerFunc(k.serveHTTP)
+}
+
+func (k *Ketama) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	k.m.RLock()
+	status := k.status()
+	owner := keyOwner{Key: key, Generation: k.generation}
+	if key != "" {
+		if addr, err := k.pick(k.keyHash(key)); err != nil {
+			owner.Error = err.Error()
+		} else {
+			owner.Network = addr.Network()
+			owner.Server = addr.String()
+		}
+	}
+	k.m.RUnlock()
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if key != "" {
+			enc.Encode(owner)
+		} else {
+			enc.Encode(status)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	handlerTemplate.Execute(w, struct {
+		Status Status
+		Owner  keyOwner
+	}{status, owner})
+}
@@ -0,0 +1,118 @@
+package ketama
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	k := &Ketama{}
+	k.SetServers([]Server{
+		{Addr: tcpAddr(1), Weight: 1},
+		{Addr: tcpAddr(2), Weight: 1},
+		{Addr: tcpAddr(3), Weight: 2},
+	})
+
+	s := k.Status()
+	if s.Generation != 1 || len(s.Servers) != 3 {
+		t.Fatalf("Wrong status: %+v", s)
+	}
+
+	total := 0.0
+	for _, server := range s.Servers {
+		total += server.Share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("Shares sum up to %g", total)
+	}
+
+	// Heavier server has twice as many points and roughly twice the
+	// share.
+	if s.Servers[2].Points != 2*s.Servers[0].Points {
+		t.Errorf("Points %d and %d, want 1:2",
+			s.Servers[0].Points, s.Servers[2].Points)
+	}
+	if s.Servers[2].Share < 0.4 || s.Servers[2].Share > 0.6 {
+		t.Errorf("Heavier server has share %g, want about 0.5",
+			s.Servers[2].Share)
+	}
+
+	// Shares match where keys actually go.
+	counts := make(map[string]int)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		addr, _ := k.PickServer(strings.Repeat("k", i%7) + string(rune(i)))
+		counts[addr.String()]++
+	}
+	for _, server := range s.Servers {
+		got := float64(counts[server.Addr]) / n
+		if math.Abs(got-server.Share) > 0.02 {
+			t.Errorf("%s got %g of keys, share is %g",
+				server.Addr, got, server.Share)
+		}
+	}
+}
+
+func TestHandlerJSON(t *testing.T) {
+	k := newTestKetama(t, 3)
+	h := NewHotKeys(10, 1)
+	k.SetHotKeys(h)
+
+	w := httptest.NewRecorder()
+	k.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/?format=json", nil))
+
+	var s Status
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", w.Body.String(), err)
+	}
+	if s.Generation != k.Generation() || len(s.Servers) != 3 {
+		t.Errorf("Wrong status: %+v", s)
+	}
+
+	w = httptest.NewRecorder()
+	k.Handler().ServeHTTP(w,
+		httptest.NewRequest("GET", "/?format=json&key=foo", nil))
+
+	var owner keyOwner
+	if err := json.Unmarshal(w.Body.Bytes(), &owner); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", w.Body.String(), err)
+	}
+	want, _ := k.PickServer("foo")
+	if owner.Key != "foo" || owner.Server != want.String() ||
+		owner.Network != "tcp" {
+
+		t.Errorf("Owner of foo is %+v, want %s", owner, want)
+	}
+
+	// Only the PickServer above was recorded.
+	if top := h.Top(0); len(top) != 1 || top[0].Count != 1 {
+		t.Errorf("Handler recorded hot keys: %+v", top)
+	}
+}
+
+func TestHandlerHTML(t *testing.T) {
+	k := newTestKetama(t, 2)
+
+	w := httptest.NewRecorder()
+	k.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/?key=<foo>", nil))
+
+	body := w.Body.String()
+	want, _ := k.PickServer("<foo>")
+	if !strings.Contains(body, "&lt;foo&gt; is owned by tcp "+want.String()) {
+		t.Errorf("Owner not in the page:\n%s", body)
+	}
+	if strings.Count(body, "<tr>") != 3 {
+		t.Errorf("Page does not list 2 servers:\n%s", body)
+	}
+
+	k = &Ketama{}
+	w = httptest.NewRecorder()
+	k.Handler().ServeHTTP(w,
+		httptest.NewRequest("GET", "/?key=foo&format=json", nil))
+	if !strings.Contains(w.Body.String(), `"error"`) {
+		t.Errorf("No error for empty server list: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,79 @@
+package ketama
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrInvalidHashTag = errors.New("hash tag must be exactly two characters")
+)
+
+// hashTag holds delimiters of hash tag, see Ketama.SetHashTag.
+type hashTag struct {
+	open  byte
+	close byte
+}
+
+// extract returns part of the key that should be hashed. Mirrors
+// twemproxy's hash_tag: if key contains open delimiter followed (later) by
+// close delimiter and there is at least one character between them, only that
+// substring is hashed. Otherwise whole key is.
+func (t *hashTag) extract(key string) string {
+	if t == nil {
+		return key
+	}
+
+	start := strings.IndexByte(key, t.open)
+	if start < 0 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], t.close)
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
+
+// SetHashTag configures hash tag for PickServer. tag must be two characters
+// long, first one is opening delimiter, second one closing (for example "{}").
+// When key contains non-empty substring enclosed by the delimiters, only that
+// substring is used for server selection. That allows to co-locate related
+// keys (for example "user:{42}:profile" and "user:{42}:prefs") on the same
+// server.
+//
+// Empty tag disables this feature, which is the default. Note that using hash
+// tag breaks compatibility with libmemcached for keys containing the tag. It is
+// safe to call from multiple goroutines at once.
+func (k *Ketama) SetHashTag(tag string) error {
+	var ht *hashTag
+
+	switch len(tag) {
+	case 0:
+	case 2:
+		ht = &hashTag{open: tag[0], close: tag[1]}
+	default:
+		return ErrInvalidHashTag
+	}
+
+	k.m.Lock()
+	k.hashTag = ht
+	k.m.Unlock()
+
+	return nil
+}
+
+// PickServerForRoutingKey returns address onto which keys with routingKey
+// should go. routingKey is hashed as is, hash tag is not applied. Keys stored
+// via PickServer with hash tag land on the same server as
+// PickServerForRoutingKey called with the content of the tag. Safe to call
+// from multiple goroutines at once.
+func (k *Ketama) PickServerForRoutingKey(routingKey string) (net.Addr, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.pick(hashString(routingKey))
+}
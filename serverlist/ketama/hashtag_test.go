@@ -0,0 +1,113 @@
+package ketama
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func newTestKetama(t *testing.T, n int) *Ketama {
+	addrs := make([]net.Addr, 0, n)
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, &net.TCPAddr{
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 11211 + i,
+		})
+	}
+
+	k := &Ketama{}
+	if err := k.SetServersAddr(addrs); err != nil {
+		t.Fatalf("Cannot set servers: %s", err)
+	}
+
+	return k
+}
+
+func TestHashTagExtract(t *testing.T) {
+	ht := &hashTag{open: '{', close: '}'}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"user:{42}:profile", "42"},
+		{"user:{42}:prefs", "42"},
+		{"{a}{b}", "a"},
+		{"user:{}:empty", "user:{}:empty"},
+		{"user:{42:unclosed", "user:{42:unclosed"},
+		{"user:}42{:reversed", "user:}42{:reversed"},
+		{"plain", "plain"},
+	}
+
+	for _, tt := range tests {
+		if got := ht.extract(tt.key); got != tt.want {
+			t.Errorf("extract(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	var nilHT *hashTag
+	if got := nilHT.extract("user:{42}"); got != "user:{42}" {
+		t.Errorf("nil hash tag must not modify the key, got %q", got)
+	}
+}
+
+func TestHashTagColocation(t *testing.T) {
+	k := newTestKetama(t, 10)
+
+	if err := k.SetHashTag("{}"); err != nil {
+		t.Fatalf("Cannot set hash tag: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		tag := fmt.Sprintf("%d", i)
+
+		want, err := k.PickServerForRoutingKey(tag)
+		if err != nil {
+			t.Fatalf("PickServerForRoutingKey: %s", err)
+		}
+
+		for _, suffix := range []string{"profile", "prefs", "avatar"} {
+			key := fmt.Sprintf("user:{%s}:%s", tag, suffix)
+			got, err := k.PickServer(key)
+			if err != nil {
+				t.Fatalf("PickServer: %s", err)
+			}
+			if got != want {
+				t.Errorf("%s went to %s instead of %s",
+					key, got, want)
+			}
+		}
+	}
+}
+
+func TestHashTagDisabled(t *testing.T) {
+	k := newTestKetama(t, 10)
+
+	if err := k.SetHashTag("{}"); err != nil {
+		t.Fatalf("Cannot set hash tag: %s", err)
+	}
+	if err := k.SetHashTag(""); err != nil {
+		t.Fatalf("Cannot unset hash tag: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user:{%d}:profile", i)
+
+		a, _ := k.PickServer(key)
+		b, _ := k.PickServerForRoutingKey(key)
+		if a != b {
+			t.Errorf("Without hash tag %s must be hashed whole", key)
+		}
+	}
+}
+
+func TestHashTagInvalid(t *testing.T) {
+	k := &Ketama{}
+
+	for _, tag := range []string{"{", "{}}", "abcd"} {
+		if err := k.SetHashTag(tag); err != ErrInvalidHashTag {
+			t.Errorf("SetHashTag(%q) = %v, want %v",
+				tag, err, ErrInvalidHashTag)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package ketama
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// HotKey is single entry reported by HotKeys.
+type HotKey struct {
+	Key string
+	// Count is the estimated number of picks of the key. When every pick
+	// is sampled, it is never lower than the real number and at most
+	// Error higher. With sampling (see NewHotKeys) it is the number of
+	// sampled picks times the sampling interval, which can be lower or
+	// higher than the real number.
+	Count uint64
+	// Error is the maximum overestimation of Count caused by the
+	// space-saving algorithm, not including the sampling error.
+	Error uint64
+	// Addr is the server the key was picked for the last time, nil if
+	// it was recorded without one.
+	Addr net.Addr
+}
+
+// hotKey is entry of the space-saving summary, ordered in min-heap by count.
+type hotKey struct {
+	HotKey
+	index int
+}
+
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	e := x.(*hotKey)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// HotKeys tracks the most frequently picked keys using the space-saving
+// algorithm, so it needs memory for capacity keys only, however many distinct
+// keys are picked. Any key picked more than 1/capacity of all picks is
+// guaranteed to be tracked.
+//
+// Attach it to Ketama using SetHotKeys. HotKeys is an http.Handler too,
+// serving the top keys as JSON, see ServeHTTP. Safe to use from multiple
+// goroutines at once.
+type HotKeys struct {
+	// picks is accessed atomically, it comes first to be 64-bit aligned
+	// on 32-bit platforms.
+	picks    uint64
+	capacity int
+	every    uint64
+
+	keys map[string]*hotKey
+	heap hotKeyHeap
+	m    sync.Mutex
+}
+
+// NewHotKeys returns HotKeys tracking up to capacity keys. Only every n-th
+// pick is sampled (counts are scaled accordingly), which lowers the overhead
+// on the routing path. n <= 1 samples every pick.
+func NewHotKeys(capacity int, n int) *HotKeys {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	return &HotKeys{
+		capacity: capacity,
+		every:    uint64(n),
+		keys:     make(map[string]*hotKey, capacity),
+	}
+}
+
+// Record counts pick of key for server addr. Ketama calls it for every key
+// picked when HotKeys are attached, but it can be used on its own as well.
+func (h *HotKeys) Record(key string, addr net.Addr) {
+	if h.every > 1 && atomic.AddUint64(&h.picks, 1)%h.every != 0 {
+		return
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if e, ok := h.keys[key]; ok {
+		e.Count += h.every
+		e.Addr = addr
+		heap.Fix(&h.heap, e.index)
+		return
+	}
+
+	if len(h.heap) < h.capacity {
+		e := &hotKey{HotKey: HotKey{Key: key, Count: h.every, Addr: addr}}
+		h.keys[key] = e
+		heap.Push(&h.heap, e)
+		return
+	}
+
+	// The least counted key is replaced, the new one inherits its count
+	// as the possible error.
+	e := h.heap[0]
+	delete(h.keys, e.Key)
+
+	e.Key = key
+	e.Error = e.Count
+	e.Count += h.every
+	e.Addr = addr
+	h.keys[key] = e
+	heap.Fix(&h.heap, 0)
+}
+
+// Top returns up to n most picked keys, sorted from the most picked one. n <= 0
+// returns all tracked keys.
+func (h *HotKeys) Top(n int) []HotKey {
+	h.m.Lock()
+	all := make(hotKeyHeap, len(h.heap))
+	for i, e := range h.heap {
+		c := *e
+		all[i] = &c
+	}
+	h.m.Unlock()
+
+	if n <= 0 || n > len(all) {
+		n = len(all)
+	}
+
+	// all is a valid min-heap already, popping yields the order from
+	// the least picked key.
+	sorted := make([]HotKey, len(all))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(&all).(*hotKey).HotKey
+	}
+	return sorted[:n]
+}
+
+// Reset forgets all tracked keys.
+func (h *HotKeys) Reset() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.keys = make(map[string]*hotKey, h.capacity)
+	h.heap = nil
+}
+
+// ServeHTTP serves the top keys as JSON array of objects with key, count,
+// error and server fields. Query parameter n limits number of returned keys.
+// The server is empty for keys recorded without one.
+func (h *HotKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+
+	type jsonHotKey struct {
+		Key    string `json:"key"`
+		Count  uint64 `json:"count"`
+		Error  uint64 `json:"error"`
+		Server string `json:"server"`
+	}
+
+	top := h.Top(n)
+	resp := make([]jsonHotKey, 0, len(top))
+	for _, hk := range top {
+		e := jsonHotKey{Key: hk.Key, Count: hk.Count, Error: hk.Error}
+		if hk.Addr != nil {
+			e.Server = hk.Addr.String()
+		}
+		resp = append(resp, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SetHotKeys attaches h to k. Every key picked by PickServer or GroupKeys is
+// then recorded in h together with the server it was picked for. Nil h (the
+// default) disables the tracking. It is safe to call from multiple goroutines
+// at once.
+func (k *Ketama) SetHotKeys(h *HotKeys) {
+	k.m.Lock()
+	k.hotKeys = h
+	k.m.Unlock()
+}
@@ -0,0 +1,155 @@
+package ketama
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHotKeysExact(t *testing.T) {
+	h := NewHotKeys(10, 1)
+	addr := tcpAddr(1)
+
+	for i := 1; i <= 5; i++ {
+		for j := 0; j < i*10; j++ {
+			h.Record(fmt.Sprintf("key-%d", i), addr)
+		}
+	}
+
+	top := h.Top(3)
+	if len(top) != 3 {
+		t.Fatalf("Top(3) returned %d keys", len(top))
+	}
+	for i, hk := range top {
+		want := fmt.Sprintf("key-%d", 5-i)
+		if hk.Key != want || hk.Count != uint64((5-i)*10) || hk.Error != 0 {
+			t.Errorf("Top[%d] = %+v, want %s with exact count", i, hk, want)
+		}
+	}
+
+	if n := len(h.Top(0)); n != 5 {
+		t.Errorf("Top(0) returned %d keys, want 5", n)
+	}
+
+	h.Reset()
+	if n := len(h.Top(0)); n != 0 {
+		t.Errorf("Top after Reset returned %d keys", n)
+	}
+}
+
+func TestHotKeysBounded(t *testing.T) {
+	h := NewHotKeys(16, 1)
+	addr := tcpAddr(1)
+
+	// Few hot keys hidden in a lot of distinct cold ones. Each hot key
+	// gets 10% of picks, more than 1/capacity, so it must be tracked.
+	for i := 0; i < 100000; i++ {
+		if i%10 < 3 {
+			h.Record(fmt.Sprintf("hot-%d", i%10), addr)
+		} else {
+			h.Record(fmt.Sprintf("cold-%d", i), addr)
+		}
+	}
+
+	if n := len(h.keys); n > 16 {
+		t.Errorf("Tracking %d keys, capacity is 16", n)
+	}
+
+	top := h.Top(3)
+	for _, hk := range top {
+		if hk.Key[:4] != "hot-" {
+			t.Errorf("Cold key %s among the top ones", hk.Key)
+		}
+		if real := uint64(10000); hk.Count < real ||
+			hk.Count-hk.Error > real {
+
+			t.Errorf("%s has count %d (error %d), real is %d",
+				hk.Key, hk.Count, hk.Error, real)
+		}
+	}
+}
+
+func TestHotKeysSampled(t *testing.T) {
+	h := NewHotKeys(10, 4)
+
+	for i := 0; i < 400; i++ {
+		h.Record("foo", tcpAddr(1))
+	}
+
+	top := h.Top(1)
+	if len(top) != 1 || top[0].Count != 400 {
+		t.Errorf("Sampled count %+v, want 400", top)
+	}
+}
+
+func TestKetamaHotKeys(t *testing.T) {
+	k := newTestKetama(t, 5)
+	h := NewHotKeys(100, 1)
+	k.SetHotKeys(h)
+
+	for i := 0; i < 10; i++ {
+		k.PickServer("foo")
+	}
+	k.GroupKeys([]string{"foo", "bar"})
+
+	owner, _ := k.PickServer("foo")
+	top := h.Top(0)
+	if len(top) != 2 {
+		t.Fatalf("Tracked %d keys, want 2", len(top))
+	}
+	if top[0].Key != "foo" || top[0].Count != 12 || top[0].Addr != owner {
+		t.Errorf("Top key is %+v, want foo picked 12 times for %s",
+			top[0], owner)
+	}
+
+	k.SetHotKeys(nil)
+	k.PickServer("foo")
+	if top := h.Top(1); top[0].Count != 12 {
+		t.Errorf("Key recorded after SetHotKeys(nil)")
+	}
+}
+
+func TestHotKeysHTTP(t *testing.T) {
+	h := NewHotKeys(10, 1)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11211}
+	h.Record("foo", addr)
+	h.Record("foo", addr)
+	h.Record("bar", addr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?n=1", nil))
+
+	var resp []struct {
+		Key    string
+		Count  uint64
+		Server string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", w.Body.String(), err)
+	}
+	if len(resp) != 1 || resp[0].Key != "foo" || resp[0].Count != 2 ||
+		resp[0].Server != "127.0.0.1:11211" {
+
+		t.Errorf("Wrong response: %+v", resp)
+	}
+
+	// Keys recorded without server have it empty.
+	h.Record("baz", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	resp = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", w.Body.String(), err)
+	}
+	for _, e := range resp {
+		if e.Key == "baz" && e.Server != "" {
+			t.Errorf("Server of baz = %q, want empty", e.Server)
+		}
+	}
+	if len(resp) != 3 {
+		t.Errorf("%d keys served, want 3", len(resp))
+	}
+}
@@ -1,6 +1,7 @@
 package ketama
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -9,6 +10,17 @@ import (
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+var (
+	// ErrUnsupportedAddr is reported by SetServers for address of
+	// unsupported type.
+	ErrUnsupportedAddr = errors.New("unsupported address type")
+	// ErrMixedTCPUDP is reported by SetServers when the list contains
+	// both TCP and UDP addresses, which libmemcached does not allow.
+	ErrMixedTCPUDP = errors.New("TCP and UDP connection cannot coexist")
+	// ErrUDPNotSupported is returned by RejectUDP.
+	ErrUDPNotSupported = errors.New("UDP is not supported")
+)
+
 // Server holds details about single server.
 type Server struct {
 	// Addr of the server. net.TCPAddr, net.UDPAddr and net.UnixAddr are
@@ -17,34 +29,144 @@ type Server struct {
 	// Weight this server should have. Must be >= 0. To mirror
 	// libmemcached's behavior, 0 is considered same as 1.
 	Weight int
+	// Username and Password, when Username is not empty, are used by
+	// clients for SASL PLAIN authentication with the server. They do not
+	// affect placement of the keys.
+	Username string
+	Password string
+	// TLS, when not nil, makes clients connect to the server over TLS.
+	// RootCAs (the CA), Certificates (the client certificate) and
+	// ServerName are the settings usually needed, empty ServerName
+	// means host of Addr. It does not affect placement of the keys
+	// either, the continuum stays libmemcached compatible.
+	TLS *tls.Config
+	// Zone is availability zone of the server, used by ZoneAware to
+	// prefer servers close to the caller. It does not affect placement
+	// of the keys.
+	Zone string
 }
 
 // Ketama provides ketama-based server list. It is core stucture of this
 // package.
 type Ketama struct {
-	addrs     []net.Addr
-	continuum *continuum
-	m         sync.RWMutex
+	servers []Server
+	// index maps addrKey of every server to its position in servers.
+	index map[string]int
+	// zones maps address of every server to its Zone.
+	zones map[net.Addr]string
+	// zoneCount is number of distinct zones.
+	zoneCount int
+	// totalWeight is sum of weights of all servers.
+	totalWeight int
+	addrs       []net.Addr
+	continuum   *continuum
+	generation  uint64
+	hashTag     *hashTag
+	namespace   *namespace
+	validator   Validator
+	hotKeys     *HotKeys
+	transition  transition
+	m           sync.RWMutex
+
+	subscribers subscribers
 }
 
 // SetServers updates current list of server to servers. It is safe to call from
 // multiple goroutines at once.
+//
+// All servers are checked before any change is made. If any of them is
+// invalid, returned error is ServerErrors describing every invalid server.
+//
+// When the new list differs from the current one, generation of the topology
+// is increased and subscribers are notified (see Subscribe).
 func (k *Ketama) SetServers(servers []Server) error {
-	c, addrs, err := newContinuumFromServer(servers)
+	k.m.RLock()
+	validator := k.validator
+	k.m.RUnlock()
+
+	c, addrs, err := newContinuumFromServer(servers, validator)
 	if err != nil {
 		return err
 	}
 
+	servers = append([]Server(nil), servers...)
+
+	index := make(map[string]int, len(servers))
+	zones := make(map[net.Addr]string, len(servers))
+	distinct := make(map[string]bool)
+	totalWeight := 0
+	for i, server := range servers {
+		if _, ok := index[addrKey(server.Addr)]; !ok {
+			index[addrKey(server.Addr)] = i
+		}
+		if _, ok := zones[server.Addr]; !ok {
+			zones[server.Addr] = server.Zone
+		}
+		distinct[server.Zone] = true
+		totalWeight += fixWeight(server.Weight)
+	}
+
 	k.m.Lock()
 
+	change := TopologyChange{
+		OldGeneration: k.generation,
+		Old:           k.addrs,
+		New:           addrs,
+		Changed:       changedServers(k.servers, servers),
+	}
+	changed := !sameServers(k.servers, servers)
+
+	if !samePlacement(k.servers, servers) {
+		k.transition.start(k.continuum)
+	}
+	k.servers = servers
+	k.index = index
+	k.zones = zones
+	k.zoneCount = len(distinct)
+	k.totalWeight = totalWeight
 	k.continuum = c
 	k.addrs = addrs
+	if changed {
+		k.generation++
+	}
+	change.Generation = k.generation
 
+	// Taking the subscribers' lock before releasing ours guarantees
+	// notifications are delivered in the order of generations.
+	k.subscribers.m.Lock()
 	k.m.Unlock()
 
+	if changed {
+		k.subscribers.notify(change)
+	}
+	k.subscribers.m.Unlock()
+
 	return nil
 }
 
+// LookupServer returns the server with address addr from the current list. Safe
+// to call from multiple goroutines at once.
+func (k *Ketama) LookupServer(addr net.Addr) (Server, bool) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.lookupServer(addr)
+}
+
+// lookupServer implements LookupServer. Caller must hold the lock.
+func (k *Ketama) lookupServer(addr net.Addr) (Server, bool) {
+	i, ok := k.index[addrKey(addr)]
+	if !ok {
+		return Server{}, false
+	}
+	return k.servers[i], true
+}
+
+// addrKey returns string identifying addr, its network and address.
+func addrKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
 // SetServers updates current list of server to addrs. All addresses have
 // weight of 1. It is safe to call from multiple goroutines at once.
 func (k *Ketama) SetServersAddr(addrs []net.Addr) error {
@@ -59,18 +181,100 @@ func (k *Ketama) SetServersAddr(addrs []net.Addr) error {
 // PickServer returns address onto which the key should go. Matches libmemcached
 // in it's selection (that is whole point of this package). Safe to call from
 // multiple goroutines at once.
+//
+// If namespace is configured (see SetNamespace), it is handled the same way
+// libmemcached does. If hash tag is configured (see SetHashTag), only the
+// tagged part of the key is hashed. If hot keys tracking is enabled (see
+// SetHotKeys), the key is recorded.
 func (k *Ketama) PickServer(key string) (net.Addr, error) {
 	k.m.RLock()
 	defer k.m.RUnlock()
 
+	addr, err := k.pick(k.keyHash(key))
+	if err == nil && k.hotKeys != nil {
+		k.hotKeys.Record(key, addr)
+	}
+	return addr, err
+}
+
+// PickServers returns replica set of the key: up to n distinct addresses, the
+// one returned by PickServer first, followed by the next servers clockwise on
+// the continuum. Safe to call from multiple goroutines at once.
+func (k *Ketama) PickServers(key string, n int) ([]net.Addr, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.replicas(k.keyHash(key), n)
+}
+
+// replicas returns up to n distinct addresses starting at position h on the
+// continuum. Caller must hold the lock.
+func (k *Ketama) replicas(h uint, n int) ([]net.Addr, error) {
 	if k.continuum == nil {
 		return nil, memcache.ErrNoServers
 	}
 
-	b := k.continuum.hash(key)
+	var addrs []net.Addr
+	k.continuum.walk(h, func(addr net.Addr) bool {
+		if len(addrs) >= n {
+			return false
+		}
+		addrs = append(addrs, addr)
+		return true
+	})
+	return addrs, nil
+}
+
+// keyHash returns position of the key on the continuum. Caller must hold the
+// lock.
+func (k *Ketama) keyHash(key string) uint {
+	key, ok := k.namespace.hashKey(key)
+	if !ok {
+		return 0
+	}
+
+	return hashString(k.hashTag.extract(key))
+}
+
+// pick returns address for position h on the continuum. Caller must hold the
+// lock.
+func (k *Ketama) pick(h uint) (net.Addr, error) {
+	if k.continuum == nil {
+		return nil, memcache.ErrNoServers
+	}
+
+	b := k.continuum.hashPoint(h)
 	return b.UserData.(net.Addr), nil
 }
 
+// GroupKeys returns keys grouped by the address they should go to, as chosen by
+// PickServer. All keys are placed using the same snapshot of the server list,
+// so concurrent SetServers cannot split the batch across two different
+// topologies. Safe to call from multiple goroutines at once.
+func (k *Ketama) GroupKeys(keys []string) (map[net.Addr][]string, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	if k.continuum == nil {
+		return nil, memcache.ErrNoServers
+	}
+
+	groups := make(map[net.Addr][]string)
+	for _, key := range keys {
+		addr, err := k.pick(k.keyHash(key))
+		if err != nil {
+			return nil, err
+		}
+		if k.hotKeys != nil {
+			k.hotKeys.Record(key, addr)
+		}
+
+		groups[addr] = append(groups[addr], key)
+	}
+
+	return groups, nil
+}
+
 // Each calls fn with every address that is currently registered into this
 // server list.
 func (k *Ketama) Each(fn func(net.Addr) error) error {
@@ -90,23 +294,51 @@ func (k *Ketama) Each(fn func(net.Addr) error) error {
 
 func newContinuumFromServer(
 	servers []Server,
+	validator Validator,
 ) (
 	c *continuum,
 	addrs []net.Addr,
 	err error,
 ) {
-	var seenTypes int
+	var errs ServerErrors
 	var buckets []bucket
-	var label string
+	var streams []int
+	var firstStream int
 
 	if len(servers) == 0 {
 		return
 	}
 
-	for _, server := range servers {
-		label, err = addr2label(server.Addr, &seenTypes)
+	for i, server := range servers {
+		fail := func(err error) {
+			errs = append(errs, &ServerError{
+				Index: i,
+				Addr:  server.Addr,
+				Err:   err,
+			})
+		}
+
+		label, typ, err := addr2label(server.Addr)
 		if err != nil {
-			return
+			fail(err)
+			continue
+		}
+		if server.Weight < 0 {
+			fail(ErrNegativeWeight)
+			continue
+		}
+		if validator != nil {
+			if err := validator(server); err != nil {
+				fail(err)
+				continue
+			}
+		}
+
+		if typ&(typeTCP|typeUDP) != 0 {
+			streams = append(streams, i)
+			if firstStream == 0 {
+				firstStream = typ
+			}
 		}
 
 		addrs = append(addrs, server.Addr)
@@ -117,9 +349,21 @@ func newContinuumFromServer(
 		})
 	}
 
-	if seenTypes&typeTCP != 0 && seenTypes&typeUDP != 0 {
-		err = errors.New("TCP and UDP connection cannot coexist")
-		return
+	// Whichever of TCP and UDP comes first wins, all servers of the other
+	// type are reported.
+	for _, i := range streams {
+		if _, typ, _ := addr2label(servers[i].Addr); typ != firstStream {
+			errs = append(errs, &ServerError{
+				Index: i,
+				Addr:  servers[i].Addr,
+				Err:   ErrMixedTCPUDP,
+			})
+		}
+	}
+
+	if len(errs) != 0 {
+		errs.sort()
+		return nil, nil, errs
 	}
 
 	c, err = newContinuum(buckets)
@@ -135,19 +379,16 @@ func maybePort(port int) string {
 	}
 }
 
-func addr2label(addr net.Addr, seenTypes *int) (string, error) {
+func addr2label(addr net.Addr) (string, int, error) {
 	switch a := addr.(type) {
 	case *net.TCPAddr:
-		*seenTypes |= typeTCP
-		return fmt.Sprintf("%s%s", a.IP, maybePort(a.Port)), nil
+		return fmt.Sprintf("%s%s", a.IP, maybePort(a.Port)), typeTCP, nil
 	case *net.UDPAddr:
-		*seenTypes |= typeUDP
-		return fmt.Sprintf("%s%s", a.IP, maybePort(a.Port)), nil
+		return fmt.Sprintf("%s%s", a.IP, maybePort(a.Port)), typeUDP, nil
 	case *net.UnixAddr:
-		*seenTypes |= typeUnix
-		return a.Name + ":0", nil
+		return a.Name + ":0", typeUnix, nil
 	default:
-		return "", fmt.Errorf("Unsupported type: %T (%q)", addr, addr)
+		return "", 0, fmt.Errorf("%w: %T", ErrUnsupportedAddr, addr)
 	}
 }
 
@@ -142,12 +142,15 @@ func newContinuum(buckets []bucket) (*continuum, error) {
 }
 
 func (c continuum) hash(thing string) *bucket {
+	return c.hashPoint(hashString(thing))
+}
+
+func (c continuum) hashPoint(h uint) *bucket {
 
 	if len(c.ring) == 0 {
 		return nil
 	}
 
-	h := hashString(thing)
 	i := search(c.ring, h)
 
 	return &c.ring[i].bucket
@@ -2,6 +2,7 @@ package ketama
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	ketama "github.com/dgryski/go-ketama"
 )
 
@@ -17,9 +19,9 @@ func TestOldCompat(t *testing.T) {
 	var oldBuckets []ketama.Bucket
 	var newBuckets []bucket
 
-	oldBuckets = append(oldBuckets, ketama.Bucket{"127.0.0.1", 1})
-	oldBuckets = append(oldBuckets, ketama.Bucket{"127.0.0.1:11212", 1})
-	oldBuckets = append(oldBuckets, ketama.Bucket{"127.0.0.1:11213", 1})
+	oldBuckets = append(oldBuckets, ketama.Bucket{Label: "127.0.0.1", Weight: 1})
+	oldBuckets = append(oldBuckets, ketama.Bucket{Label: "127.0.0.1:11212", Weight: 1})
+	oldBuckets = append(oldBuckets, ketama.Bucket{Label: "127.0.0.1:11213", Weight: 1})
 
 	newBuckets = append(newBuckets, bucket{"127.0.0.1", "foo", 1})
 	newBuckets = append(newBuckets, bucket{"127.0.0.1:11212", "bar", 1})
@@ -92,8 +94,8 @@ func TestTCPUDPCannotCoexist(t *testing.T) {
 	}
 
 	servers := []Server{
-		{tcp, 1},
-		{udp, 1},
+		{Addr: tcp, Weight: 1},
+		{Addr: udp, Weight: 1},
 	}
 
 	k := &Ketama{}
@@ -101,6 +103,22 @@ func TestTCPUDPCannotCoexist(t *testing.T) {
 	if err == nil {
 		t.Errorf("TCP and UDP cannot coexist.")
 	}
+	if !errors.Is(err, ErrMixedTCPUDP) {
+		t.Errorf("Wrong error returned: %v", err)
+	}
+}
+
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "fake" }
+func (fakeAddr) String() string  { return "fake" }
+
+func TestUnsupportedAddr(t *testing.T) {
+	k := &Ketama{}
+	err := k.SetServersAddr([]net.Addr{fakeAddr{}})
+	if !errors.Is(err, ErrUnsupportedAddr) {
+		t.Errorf("Wrong error returned: %v", err)
+	}
 }
 
 func max(a int, b int) float64 {
@@ -278,10 +296,11 @@ func TestIfConsistent(t *testing.T) {
 func TestIfThreadSafe(t *testing.T) {
 	k := &Ketama{}
 	wg := sync.WaitGroup{}
-	ctx, _ := context.WithTimeout(
+	ctx, cancel := context.WithTimeout(
 		context.Background(),
 		100*time.Millisecond,
 	)
+	defer cancel()
 
 	const nWorkers = 3
 
@@ -319,6 +338,50 @@ func TestIfThreadSafe(t *testing.T) {
 	t.Logf("Writes: %v", writes)
 }
 
+func TestGroupKeys(t *testing.T) {
+	k := newTestKetama(t, 5)
+
+	keys := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+
+	groups, err := k.GroupKeys(keys)
+	if err != nil {
+		t.Fatalf("GroupKeys: %s", err)
+	}
+
+	if len(groups) != 5 {
+		t.Errorf("Keys grouped into %d servers instead of 5",
+			len(groups))
+	}
+
+	total := 0
+	for addr, group := range groups {
+		total += len(group)
+
+		for _, key := range group {
+			want, _ := k.PickServer(key)
+			if addr != want {
+				t.Errorf("%s grouped under %s instead of %s",
+					key, addr, want)
+			}
+		}
+	}
+
+	if total != len(keys) {
+		t.Errorf("Grouped %d keys instead of %d", total, len(keys))
+	}
+}
+
+func TestGroupKeysNoServers(t *testing.T) {
+	k := &Ketama{}
+
+	if _, err := k.GroupKeys([]string{"foo"}); err != memcache.ErrNoServers {
+		t.Errorf("GroupKeys = %v, want %v", err, memcache.ErrNoServers)
+	}
+}
+
 func BenchmarkPickServer(b *testing.B) {
 	k := &Ketama{}
 	k.SetServersAddr([]net.Addr{
@@ -0,0 +1,61 @@
+package ketama
+
+import (
+	"strings"
+)
+
+// maxKeyLength is the longest key libmemcached is willing to hash together
+// with namespace (MEMCACHED_MAX_KEY - 1).
+const maxKeyLength = 250
+
+// namespace holds libmemcached's namespace configuration, see
+// Ketama.SetNamespace.
+type namespace struct {
+	prefix   string
+	hashWith bool
+}
+
+// hashKey returns the part of key that libmemcached would hash. key is
+// expected to already contain the prefix (that is what memcache.Client passes
+// to PickServer). Keys without the prefix are returned unchanged. When ok is
+// false, libmemcached would use 0 as the hash value.
+func (ns *namespace) hashKey(key string) (hkey string, ok bool) {
+	if ns == nil || !strings.HasPrefix(key, ns.prefix) {
+		return key, true
+	}
+
+	if !ns.hashWith {
+		return key[len(ns.prefix):], true
+	}
+
+	// libmemcached silently hashes to 0 when namespace + key does not fit
+	// into its buffer.
+	if len(key) > maxKeyLength {
+		return "", false
+	}
+
+	return key, true
+}
+
+// SetNamespace configures namespace (MEMCACHED_CALLBACK_NAMESPACE in
+// libmemcached) keys passed to PickServer are prefixed with. Ketama does not
+// prefix anything itself, it only makes sure prefixed keys are placed the same
+// way libmemcached would place them. Use namespace.Client (or prefix keys in
+// some other way) to actually store the keys under the namespace.
+//
+// hashWith mirrors MEMCACHED_BEHAVIOR_HASH_WITH_NAMESPACE. When true, the
+// namespace is part of the hashed key, when false only the part of the key
+// after the prefix is hashed.
+//
+// Empty ns disables this feature, which is the default. It is safe to call
+// from multiple goroutines at once.
+func (k *Ketama) SetNamespace(ns string, hashWith bool) {
+	var n *namespace
+	if ns != "" {
+		n = &namespace{prefix: ns, hashWith: hashWith}
+	}
+
+	k.m.Lock()
+	k.namespace = n
+	k.m.Unlock()
+}
@@ -0,0 +1,76 @@
+package ketama
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceHashWithout(t *testing.T) {
+	k := newTestKetama(t, 10)
+	k.SetNamespace("app:", false)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		want, _ := k.PickServerForRoutingKey(key)
+		got, _ := k.PickServer("app:" + key)
+		if got != want {
+			t.Errorf("app:%s went to %s instead of %s",
+				key, got, want)
+		}
+	}
+}
+
+func TestNamespaceHashWith(t *testing.T) {
+	k := newTestKetama(t, 10)
+	k.SetNamespace("app:", true)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("app:key-%d", i)
+
+		want, _ := k.PickServerForRoutingKey(key)
+		got, _ := k.PickServer(key)
+		if got != want {
+			t.Errorf("%s went to %s instead of %s", key, got, want)
+		}
+	}
+}
+
+func TestNamespaceUnprefixedKey(t *testing.T) {
+	k := newTestKetama(t, 10)
+	k.SetNamespace("app:", false)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("other:key-%d", i)
+
+		want, _ := k.PickServerForRoutingKey(key)
+		got, _ := k.PickServer(key)
+		if got != want {
+			t.Errorf("%s went to %s instead of %s", key, got, want)
+		}
+	}
+}
+
+func TestNamespaceTooLong(t *testing.T) {
+	k := newTestKetama(t, 10)
+	k.SetNamespace("app:", true)
+
+	want, _ := k.pick(0)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("app:%d%s", i, strings.Repeat("x", 250))
+
+		got, _ := k.PickServer(key)
+		if got != want {
+			t.Errorf("Too long key must hash to 0")
+		}
+	}
+
+	ns := &namespace{prefix: "app:", hashWith: true}
+	if _, ok := ns.hashKey("app:" + strings.Repeat("x", 246)); !ok {
+		t.Errorf("Key of 250 characters must be hashed normally")
+	}
+	if _, ok := ns.hashKey("app:" + strings.Repeat("x", 247)); ok {
+		t.Errorf("Key of 251 characters must hash to 0")
+	}
+}
@@ -111,8 +111,8 @@ main(int argc, char **argv) {
 	size_t line_n = 0;
 	ssize_t read;
 
-	if (argc != 3) {
-		die("Usage: test-c SERVERS DATA");
+	if (argc != 3 && argc != 5) {
+		die("Usage: test-c SERVERS DATA [NAMESPACE HASH_WITH_NAMESPACE]");
 	}
 
 	mc = memcached_create(NULL);
@@ -123,6 +123,16 @@ main(int argc, char **argv) {
 	rc = memcached_behavior_set(mc, MEMCACHED_BEHAVIOR_KETAMA_WEIGHTED, 1);
 	mc_ensure("set ketama");
 
+	if (argc == 5) {
+		rc = memcached_callback_set(mc, MEMCACHED_CALLBACK_NAMESPACE, argv[3]);
+		mc_ensure("set namespace: %s", argv[3]);
+
+		rc = memcached_behavior_set(
+			mc, MEMCACHED_BEHAVIOR_HASH_WITH_NAMESPACE, atoi(argv[4])
+		);
+		mc_ensure("set hash with namespace: %s", argv[4]);
+	}
+
 	FILE *sf = fopen(argv[1], "r");
 	if (sf == NULL) {
 		die("Cannot open servers file: %s", strerror(errno));
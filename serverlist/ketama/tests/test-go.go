@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/bradfitz/gomemcache/memcache"
 
+	"git.sr.ht/~graywolf/gomemcache/namespace"
 	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
 )
 
@@ -22,7 +24,6 @@ func die(_fmt string, _data ...interface{}) {
 
 var k *ketama.Ketama
 var addrs []net.Addr
-var mc *memcache.Client
 
 func processServerLine(line string) {
 	s := bufio.NewScanner(strings.NewReader(line))
@@ -74,13 +75,25 @@ func processServerLine(line string) {
 }
 
 func main() {
-	if len(os.Args) != 3 {
-		die("Usage: test-go SERVERS DATA")
+	if len(os.Args) != 3 && len(os.Args) != 5 {
+		die("Usage: test-go SERVERS DATA [NAMESPACE HASH_WITH_NAMESPACE]")
 	}
 
 	servers := os.Args[1]
 	data := os.Args[2]
 
+	var ns string
+	var hashWith bool
+	if len(os.Args) == 5 {
+		var err error
+
+		ns = os.Args[3]
+		hashWith, err = strconv.ParseBool(os.Args[4])
+		if err != nil {
+			die("Cannot parse HASH_WITH_NAMESPACE: %s", err)
+		}
+	}
+
 	k := &ketama.Ketama{}
 
 	sf, err := os.Open(servers)
@@ -108,10 +121,11 @@ func main() {
 		die("Cannot SetServersAddr: %s", err)
 	}
 
+	nc := namespace.NewWithKetama(k, ns, hashWith)
+
 	ds := bufio.NewScanner(df)
 	for ds.Scan() {
-		mc = memcache.NewFromSelector(k)
-		err := mc.Set(&memcache.Item{
+		err := nc.Set(&memcache.Item{
 			Key:   ds.Text(),
 			Value: []byte("value :-> " + ds.Text()),
 		})
@@ -0,0 +1,163 @@
+package ketama
+
+import (
+	"net"
+	"sync"
+)
+
+// Snapshot is a consistent view of the server list at one point in time.
+type Snapshot struct {
+	// Generation of the topology. Starts at 0 (no servers) and is
+	// increased by every SetServers that changes the server list.
+	Generation uint64
+	// Servers as passed to SetServers.
+	Servers []Server
+}
+
+// TopologyChange describes single change of the server list, see Subscribe.
+type TopologyChange struct {
+	// OldGeneration is generation of the topology before the change.
+	OldGeneration uint64
+	// Generation is generation of the topology after the change.
+	Generation uint64
+	// Old holds addresses before the change.
+	Old []net.Addr
+	// New holds addresses after the change.
+	New []net.Addr
+	// Changed holds addresses present both before and after the change
+	// whose settings (weight, credentials, TLS or zone) changed.
+	Changed []net.Addr
+}
+
+// Generation returns current generation of the topology. Safe to call from
+// multiple goroutines at once.
+func (k *Ketama) Generation() uint64 {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.generation
+}
+
+// Snapshot returns current server list together with its generation. Safe to
+// call from multiple goroutines at once.
+func (k *Ketama) Snapshot() Snapshot {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return Snapshot{
+		Generation: k.generation,
+		Servers:    append([]Server(nil), k.servers...),
+	}
+}
+
+// Subscribe registers fn to be called whenever SetServers changes the server
+// list. Calls to SetServers that do not change anything (same servers with the
+// same settings in the same order) do not trigger fn. TLS configurations are
+// compared as pointers.
+//
+// fn is called synchronously from SetServers, after the new server list is in
+// effect, and changes are delivered in order of their generations. fn must
+// not call SetServers, SetServersAddr or Subscribe (nor the returned
+// unsubscribe function) since that would deadlock.
+//
+// Returned function removes the subscription. Safe to call from multiple
+// goroutines at once.
+func (k *Ketama) Subscribe(fn func(TopologyChange)) (unsubscribe func()) {
+	return k.subscribers.add(fn)
+}
+
+type subscribers struct {
+	fns  map[uint64]func(TopologyChange)
+	next uint64
+	m    sync.Mutex
+}
+
+func (s *subscribers) add(fn func(TopologyChange)) func() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.fns == nil {
+		s.fns = make(map[uint64]func(TopologyChange))
+	}
+
+	id := s.next
+	s.next++
+	s.fns[id] = fn
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.m.Lock()
+			delete(s.fns, id)
+			s.m.Unlock()
+		})
+	}
+}
+
+// notify calls all subscribers. Caller must hold the lock.
+func (s *subscribers) notify(change TopologyChange) {
+	for _, fn := range s.fns {
+		fn(change)
+	}
+}
+
+// samePlacement reports whether servers a and b place the keys the same way.
+func samePlacement(a []Server, b []Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if fixWeight(a[i].Weight) != fixWeight(b[i].Weight) ||
+			a[i].Addr.Network() != b[i].Addr.Network() ||
+			a[i].Addr.String() != b[i].Addr.String() {
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameSettings reports whether a and b have the same settings not affecting
+// placement of the keys.
+func sameSettings(a Server, b Server) bool {
+	return a.Username == b.Username &&
+		a.Password == b.Password &&
+		a.TLS == b.TLS &&
+		a.Zone == b.Zone
+}
+
+func sameServers(a []Server, b []Server) bool {
+	if !samePlacement(a, b) {
+		return false
+	}
+
+	for i := range a {
+		if !sameSettings(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// changedServers returns addresses of servers in both old and new whose
+// settings differ.
+func changedServers(old []Server, new []Server) []net.Addr {
+	byAddr := make(map[string]Server, len(old))
+	for _, s := range old {
+		byAddr[addrKey(s.Addr)] = s
+	}
+
+	var changed []net.Addr
+	for _, s := range new {
+		o, ok := byAddr[addrKey(s.Addr)]
+		if ok && (fixWeight(o.Weight) != fixWeight(s.Weight) ||
+			!sameSettings(o, s)) {
+
+			changed = append(changed, s.Addr)
+		}
+	}
+	return changed
+}
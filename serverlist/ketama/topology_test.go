@@ -0,0 +1,225 @@
+package ketama
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+func tcpAddr(port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+}
+
+func TestGeneration(t *testing.T) {
+	k := &Ketama{}
+
+	if g := k.Generation(); g != 0 {
+		t.Errorf("Initial generation is %d, want 0", g)
+	}
+
+	steps := []struct {
+		servers []Server
+		gen     uint64
+	}{
+		{[]Server{{Addr: tcpAddr(1), Weight: 1}}, 1},
+		{[]Server{{Addr: tcpAddr(1), Weight: 1}}, 1},
+		// 0 is considered same as 1
+		{[]Server{{Addr: tcpAddr(1), Weight: 0}}, 1},
+		{[]Server{{Addr: tcpAddr(1), Weight: 2}}, 2},
+		{[]Server{
+			{Addr: tcpAddr(1), Weight: 2},
+			{Addr: tcpAddr(2), Weight: 1},
+		}, 3},
+		{[]Server{
+			{Addr: tcpAddr(2), Weight: 1},
+			{Addr: tcpAddr(1), Weight: 2},
+		}, 4},
+		{nil, 5},
+		{nil, 5},
+	}
+
+	for i, step := range steps {
+		if err := k.SetServers(step.servers); err != nil {
+			t.Fatalf("SetServers: %s", err)
+		}
+
+		s := k.Snapshot()
+		if s.Generation != step.gen {
+			t.Errorf("Step %d: generation is %d, want %d",
+				i, s.Generation, step.gen)
+		}
+		if len(s.Servers) != len(step.servers) {
+			t.Errorf("Step %d: snapshot has %d servers, want %d",
+				i, len(s.Servers), len(step.servers))
+		}
+	}
+}
+
+func TestGenerationFailedSetServers(t *testing.T) {
+	k := &Ketama{}
+	k.SetServers([]Server{{Addr: tcpAddr(1), Weight: 1}})
+
+	err := k.SetServers([]Server{{Addr: tcpAddr(1), Weight: -1}})
+	if err == nil {
+		t.Fatalf("Negative weight must be rejected")
+	}
+	if g := k.Generation(); g != 1 {
+		t.Errorf("Failed SetServers changed generation to %d", g)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	k := &Ketama{}
+
+	var changes []TopologyChange
+	unsubscribe := k.Subscribe(func(c TopologyChange) {
+		changes = append(changes, c)
+	})
+
+	k.SetServersAddr([]net.Addr{tcpAddr(1)})
+	k.SetServersAddr([]net.Addr{tcpAddr(1)})
+	k.SetServersAddr([]net.Addr{tcpAddr(1), tcpAddr(2)})
+
+	unsubscribe()
+	unsubscribe()
+
+	k.SetServersAddr([]net.Addr{tcpAddr(3)})
+
+	if len(changes) != 2 {
+		t.Fatalf("Got %d notifications, want 2", len(changes))
+	}
+
+	c := changes[0]
+	if c.OldGeneration != 0 || c.Generation != 1 ||
+		len(c.Old) != 0 || len(c.New) != 1 {
+
+		t.Errorf("Wrong first change: %+v", c)
+	}
+
+	c = changes[1]
+	if c.OldGeneration != 1 || c.Generation != 2 ||
+		len(c.Old) != 1 || len(c.New) != 2 {
+
+		t.Errorf("Wrong second change: %+v", c)
+	}
+}
+
+func TestSubscribeOrdered(t *testing.T) {
+	k := &Ketama{}
+
+	var last uint64
+	k.Subscribe(func(c TopologyChange) {
+		if c.OldGeneration != last {
+			t.Errorf("Change from %d delivered after %d",
+				c.OldGeneration, last)
+		}
+		last = c.Generation
+
+		// Reading from within callback must be possible.
+		k.PickServer("foo")
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				k.SetServersAddr([]net.Addr{tcpAddr(i*1000 + j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if last != k.Generation() {
+		t.Errorf("Last notified generation %d, current %d",
+			last, k.Generation())
+	}
+}
+
+func TestLookupServer(t *testing.T) {
+	k := &Ketama{}
+
+	if _, ok := k.LookupServer(tcpAddr(1)); ok {
+		t.Errorf("Found server in empty list")
+	}
+
+	k.SetServers([]Server{
+		{Addr: tcpAddr(1), Weight: 1},
+		{Addr: tcpAddr(2), Weight: 2, Username: "u", Password: "p"},
+	})
+
+	s, ok := k.LookupServer(tcpAddr(2))
+	if !ok || s.Weight != 2 || s.Username != "u" || s.Password != "p" {
+		t.Errorf("LookupServer = %+v, %v", s, ok)
+	}
+	if _, ok := k.LookupServer(tcpAddr(3)); ok {
+		t.Errorf("Found server not in the list")
+	}
+
+	// Credentials do not affect placement, but clients must learn about
+	// them.
+	var changes []TopologyChange
+	k.Subscribe(func(c TopologyChange) {
+		changes = append(changes, c)
+	})
+	gen := k.Generation()
+	k.SetServers([]Server{
+		{Addr: tcpAddr(1), Weight: 1},
+		{Addr: tcpAddr(2), Weight: 2, Username: "u", Password: "q"},
+	})
+	if k.Generation() != gen+1 {
+		t.Errorf("Changed credentials did not change generation")
+	}
+	if len(changes) != 1 || len(changes[0].Changed) != 1 ||
+		changes[0].Changed[0].String() != tcpAddr(2).String() {
+
+		t.Errorf("Changes = %+v, want change of the second server",
+			changes)
+	}
+	if s, _ := k.LookupServer(tcpAddr(2)); s.Password != "q" {
+		t.Errorf("LookupServer returned old credentials")
+	}
+
+	for _, server := range []Server{
+		{Addr: tcpAddr(1), Weight: 1, TLS: &tls.Config{}},
+		{Addr: tcpAddr(1), Weight: 1, Zone: "a"},
+	} {
+		gen := k.Generation()
+		k.SetServers([]Server{
+			server,
+			{Addr: tcpAddr(2), Weight: 2, Username: "u", Password: "q"},
+		})
+		if k.Generation() != gen+1 {
+			t.Errorf("Changed %+v did not change generation", server)
+		}
+	}
+}
+
+func TestTLSDoesNotAffectPlacement(t *testing.T) {
+	plain := &Ketama{}
+	secure := &Ketama{}
+
+	var plainServers, secureServers []Server
+	for i := 1; i <= 5; i++ {
+		plainServers = append(plainServers, Server{Addr: tcpAddr(i)})
+		secureServers = append(secureServers, Server{
+			Addr: tcpAddr(i),
+			TLS:  &tls.Config{ServerName: "memcached.example.com"},
+		})
+	}
+	plain.SetServers(plainServers)
+	secure.SetServers(secureServers)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		a, _ := plain.PickServer(key)
+		b, _ := secure.PickServer(key)
+		if a.String() != b.String() {
+			t.Fatalf("%s placed on %s with TLS, on %s without",
+				key, b, a)
+		}
+	}
+}
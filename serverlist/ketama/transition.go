@@ -0,0 +1,89 @@
+package ketama
+
+import (
+	"net"
+	"time"
+)
+
+// transition keeps the previous continuum for a while after the server list
+// changes, see SetTransitionWindow.
+type transition struct {
+	window time.Duration
+	prev   *continuum
+	until  time.Time
+}
+
+// start opens the window with prev as the previous continuum.
+func (t *transition) start(prev *continuum) {
+	if t.window <= 0 {
+		return
+	}
+
+	t.prev = prev
+	t.until = time.Now().Add(t.window)
+}
+
+// previous returns the previous continuum while the window is open.
+func (t *transition) previous() *continuum {
+	if t.prev == nil || !time.Now().Before(t.until) {
+		return nil
+	}
+	return t.prev
+}
+
+// Transition holds owners of a key around a change of the server list, see
+// PickServerTransition.
+type Transition struct {
+	// New is the owner of the key, the address returned by PickServer.
+	New net.Addr
+	// Old is the owner of the key under the previous server list. It is
+	// nil when no transition window is open or when the owner did not
+	// change.
+	Old net.Addr
+}
+
+// SetTransitionWindow configures how long after a change of the server list
+// the previous one is remembered. During that window PickServerTransition
+// reports the previous owner of keys which moved, so that reads missing on
+// the new owner can be retried on the old one, which most likely still has
+// the item. client.Client does that on its own (see its CopyForward field).
+//
+// Zero d (the default) disables the window. When the list changes again
+// during the window, the window starts over and only the latest previous list
+// is remembered. Changes not affecting placement of the keys (like new
+// credentials) do not start the window. It is safe to call from multiple
+// goroutines at once.
+func (k *Ketama) SetTransitionWindow(d time.Duration) {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	k.transition.window = d
+	if d <= 0 {
+		k.transition.prev = nil
+	}
+}
+
+// PickServerTransition returns the current and, during the transition window
+// (see SetTransitionWindow), the previous owner of key. The key is not
+// recorded as a hot key. Safe to call from multiple goroutines at once.
+func (k *Ketama) PickServerTransition(key string) (Transition, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	h := k.keyHash(key)
+	addr, err := k.pick(h)
+	if err != nil {
+		return Transition{}, err
+	}
+
+	t := Transition{New: addr}
+	if prev := k.transition.previous(); prev != nil {
+		old := prev.hashPoint(h).UserData.(net.Addr)
+		if old.Network() != addr.Network() ||
+			old.String() != addr.String() {
+
+			t.Old = old
+		}
+	}
+	return t, nil
+}
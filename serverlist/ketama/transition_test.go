@@ -0,0 +1,89 @@
+package ketama
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPickServerTransition(t *testing.T) {
+	a := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 11211},
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11211},
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 11211},
+	}
+
+	k := &Ketama{}
+	k.SetTransitionWindow(time.Minute)
+	k.SetServersAddr(a[:2])
+
+	keys := make([]string, 1000)
+	before := make(map[string]net.Addr)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+
+		tr, err := k.PickServerTransition(keys[i])
+		if err != nil {
+			t.Fatalf("PickServerTransition: %s", err)
+		}
+		if tr.Old != nil {
+			t.Fatalf("Old owner %s reported for the first list", tr.Old)
+		}
+		before[keys[i]] = tr.New
+	}
+
+	k.SetServersAddr(a)
+
+	moved := 0
+	for _, key := range keys {
+		tr, _ := k.PickServerTransition(key)
+		if owner, _ := k.PickServer(key); tr.New != owner {
+			t.Errorf("New = %s, want %s", tr.New, owner)
+		}
+
+		if tr.New == before[key] {
+			if tr.Old != nil {
+				t.Errorf("Old = %s for key which did not move", tr.Old)
+			}
+			continue
+		}
+		moved++
+		if tr.Old != before[key] {
+			t.Errorf("Old = %v, want %s", tr.Old, before[key])
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("No key moved")
+	}
+
+	k.SetTransitionWindow(0)
+	for _, key := range keys {
+		if tr, _ := k.PickServerTransition(key); tr.Old != nil {
+			t.Fatalf("Old = %s with disabled window", tr.Old)
+		}
+	}
+}
+
+func TestTransitionWindowExpires(t *testing.T) {
+	a := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 11211},
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11211},
+	}
+
+	k := &Ketama{}
+	k.SetTransitionWindow(20 * time.Millisecond)
+	k.SetServersAddr(a[:1])
+	k.SetServersAddr(a[1:])
+
+	if tr, _ := k.PickServerTransition("foo"); tr.Old != a[0] {
+		t.Fatalf("Old = %v, want %s", tr.Old, a[0])
+	}
+
+	// Same list again does not open new window.
+	time.Sleep(30 * time.Millisecond)
+	k.SetServersAddr(a[1:])
+	if tr, _ := k.PickServerTransition("foo"); tr.Old != nil {
+		t.Errorf("Old = %s after the window", tr.Old)
+	}
+}
@@ -0,0 +1,30 @@
+package ketama
+
+import (
+	"net"
+)
+
+// Validator checks single server before SetServers accepts it. Returned error
+// is passed to the caller of SetServers.
+type Validator func(Server) error
+
+// SetValidator configures v to be called for each server passed to
+// SetServers. Nil v (the default) disables the validation. It is safe to call
+// from multiple goroutines at once.
+func (k *Ketama) SetValidator(v Validator) {
+	k.m.Lock()
+	k.validator = v
+	k.m.Unlock()
+}
+
+// RejectUDP is a Validator refusing UDP addresses with ErrUDPNotSupported.
+// github.com/bradfitz/gomemcache/memcache cannot talk to memcached over UDP,
+// so when Ketama is used with it, UDP addresses would only fail later when
+// dialing.
+func RejectUDP(server Server) error {
+	if _, ok := server.Addr.(*net.UDPAddr); ok {
+		return ErrUDPNotSupported
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package ketama
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRejectUDP(t *testing.T) {
+	udp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 11211}
+
+	k := &Ketama{}
+	if err := k.SetServersAddr([]net.Addr{udp}); err != nil {
+		t.Fatalf("UDP must be accepted by default: %s", err)
+	}
+
+	k.SetValidator(RejectUDP)
+
+	err := k.SetServersAddr([]net.Addr{udp})
+	if !errors.Is(err, ErrUDPNotSupported) {
+		t.Errorf("Wrong error returned: %v", err)
+	}
+
+	err = k.SetServersAddr([]net.Addr{
+		tcpAddr(11211),
+		&net.UnixAddr{Name: "/tmp/memcached.sock", Net: "unix"},
+	})
+	if err != nil {
+		t.Errorf("TCP and Unix must pass RejectUDP: %s", err)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	errOdd := errors.New("odd port")
+
+	k := &Ketama{}
+	k.SetValidator(func(s Server) error {
+		if s.Addr.(*net.TCPAddr).Port%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+
+	if err := k.SetServersAddr([]net.Addr{tcpAddr(2)}); err != nil {
+		t.Errorf("Even port rejected: %s", err)
+	}
+
+	err := k.SetServersAddr([]net.Addr{tcpAddr(2), tcpAddr(3)})
+	if !errors.Is(err, errOdd) {
+		t.Errorf("Wrong error returned: %v", err)
+	}
+	if g := k.Generation(); g != 1 {
+		t.Errorf("Rejected list changed generation to %d", g)
+	}
+
+	k.SetValidator(nil)
+	if err := k.SetServersAddr([]net.Addr{tcpAddr(3)}); err != nil {
+		t.Errorf("Validator was not removed: %s", err)
+	}
+}
@@ -0,0 +1,172 @@
+package ketama
+
+import (
+	"net"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ZoneAware picks servers for clients spread over availability zones, where
+// reading from another zone costs more than reading from the local one.
+//
+// Every key is stored on a replica set of servers spread over zones: walking
+// the continuum clockwise from the key, the owner of the key and then the
+// first server of each zone not in the set yet. When there are fewer zones
+// than replicas, the rest of the set are the next servers clockwise. Reads
+// (PickServer) prefer the replica in the caller's zone, writes (PickReplicas)
+// go to all replicas. client.Client writes to all replicas on its own when
+// ZoneAware is its selector.
+//
+// Zones of the servers are taken from Server.Zone. ZoneAware is safe to use
+// from multiple goroutines at once.
+type ZoneAware struct {
+	k        *Ketama
+	zone     string
+	replicas int
+	healthy  func(net.Addr) bool
+	m        sync.RWMutex
+}
+
+// NewZoneAware returns ZoneAware for caller in zone, using server list of k and
+// storing every key on the given number of replicas.
+func NewZoneAware(k *Ketama, zone string, replicas int) *ZoneAware {
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	return &ZoneAware{
+		k:        k,
+		zone:     zone,
+		replicas: replicas,
+	}
+}
+
+// Ketama returns the underlying Ketama.
+func (z *ZoneAware) Ketama() *Ketama {
+	return z.k
+}
+
+// SetHealthCheck configures fn reporting whether server addr is up. Replicas
+// that are down are skipped by PickServer. With client.Client it would
+// usually be:
+//
+//	z.SetHealthCheck(func(addr net.Addr) bool {
+//		return c.Health(addr).Healthy()
+//	})
+//
+// Nil fn (the default) considers all servers up. fn is called with no lock
+// held, it may use the Ketama. It is safe to call from multiple goroutines at
+// once.
+func (z *ZoneAware) SetHealthCheck(fn func(net.Addr) bool) {
+	z.m.Lock()
+	z.healthy = fn
+	z.m.Unlock()
+}
+
+// PickServer returns address the key should be read from: the first replica in
+// the caller's zone which is up. If there is none, the first replica which is
+// up in any zone is returned, and if all replicas are down, the owner of the
+// key.
+func (z *ZoneAware) PickServer(key string) (net.Addr, error) {
+	z.m.RLock()
+	healthy := z.healthy
+	z.m.RUnlock()
+
+	z.k.m.RLock()
+	replicas, zones, err := z.k.zoneReplicas(z.k.keyHash(key), z.replicas)
+	z.k.m.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback net.Addr
+	for i, addr := range replicas {
+		if healthy != nil && !healthy(addr) {
+			continue
+		}
+		if zones[i] == z.zone {
+			return addr, nil
+		}
+		if fallback == nil {
+			fallback = addr
+		}
+	}
+	if fallback == nil {
+		fallback = replicas[0]
+	}
+	return fallback, nil
+}
+
+// PickReplicas returns addresses the key should be written to, its whole
+// replica set, owner first.
+func (z *ZoneAware) PickReplicas(key string) ([]net.Addr, error) {
+	z.k.m.RLock()
+	defer z.k.m.RUnlock()
+
+	replicas, _, err := z.k.zoneReplicas(z.k.keyHash(key), z.replicas)
+	return replicas, err
+}
+
+// Each calls fn with every address of the underlying Ketama.
+func (z *ZoneAware) Each(fn func(net.Addr) error) error {
+	return z.k.Each(fn)
+}
+
+// LookupServer returns the server with address addr from the underlying
+// Ketama.
+func (z *ZoneAware) LookupServer(addr net.Addr) (Server, bool) {
+	return z.k.LookupServer(addr)
+}
+
+// Subscribe registers fn to be called on changes of the server list of the
+// underlying Ketama, see Ketama.Subscribe.
+func (z *ZoneAware) Subscribe(fn func(TopologyChange)) (unsubscribe func()) {
+	return z.k.Subscribe(fn)
+}
+
+// zoneReplicas returns replica set of up to n addresses spread over zones,
+// starting at position h on the continuum, and zone of each of them. Caller
+// must hold the lock.
+func (k *Ketama) zoneReplicas(h uint, n int) ([]net.Addr, []string, error) {
+	if k.continuum == nil {
+		return nil, nil, memcache.ErrNoServers
+	}
+
+	var addrs, rest []net.Addr
+	var zones []string
+	k.continuum.walk(h, func(addr net.Addr) bool {
+		if zone := k.zones[addr]; !contains(zones, zone) {
+			addrs = append(addrs, addr)
+			zones = append(zones, zone)
+		} else {
+			rest = append(rest, addr)
+		}
+
+		// Once every zone is in the set, the rest only tops it up.
+		if len(zones) == k.zoneCount {
+			return len(addrs)+len(rest) < n
+		}
+		return len(addrs) < n
+	})
+
+	for _, addr := range rest {
+		if len(addrs) >= n {
+			break
+		}
+		addrs = append(addrs, addr)
+		zones = append(zones, k.zones[addr])
+	}
+	return addrs, zones, nil
+}
+
+// contains reports whether zones contain zone. The replica sets are small,
+// scanning them is cheaper than a map.
+func contains(zones []string, zone string) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package ketama
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func newZoneAware(t *testing.T, zones []string, zone string) *ZoneAware {
+	servers := make([]Server, len(zones))
+	for i := range servers {
+		servers[i] = Server{
+			Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 11211},
+			Zone: zones[i],
+		}
+	}
+
+	k := &Ketama{}
+	if err := k.SetServers(servers); err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+	return NewZoneAware(k, zone, 3)
+}
+
+func TestPickServers(t *testing.T) {
+	z := newZoneAware(t, []string{"a", "b", "c", "a", "b"}, "a")
+	k := z.Ketama()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner, _ := k.PickServer(key)
+		addrs, err := k.PickServers(key, 3)
+		if err != nil {
+			t.Fatalf("PickServers: %s", err)
+		}
+		if len(addrs) != 3 || addrs[0] != owner {
+			t.Fatalf("PickServers(%q) = %v, want 3 starting with %s",
+				key, addrs, owner)
+		}
+		if addrs[0] == addrs[1] || addrs[1] == addrs[2] ||
+			addrs[0] == addrs[2] {
+
+			t.Fatalf("PickServers(%q) = %v, want distinct", key, addrs)
+		}
+	}
+
+	if addrs, _ := k.PickServers("foo", 10); len(addrs) != 5 {
+		t.Errorf("PickServers returned %d addresses, want 5", len(addrs))
+	}
+	if _, err := (&Ketama{}).PickServers("foo", 2); err != memcache.ErrNoServers {
+		t.Errorf("PickServers = %v, want %v", err, memcache.ErrNoServers)
+	}
+}
+
+func zoneOf(k *Ketama, addr net.Addr) string {
+	server, _ := k.LookupServer(addr)
+	return server.Zone
+}
+
+func TestZoneAwareRead(t *testing.T) {
+	z := newZoneAware(t, []string{"a", "b", "c"}, "b")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		addr, err := z.PickServer(key)
+		if err != nil {
+			t.Fatalf("PickServer: %s", err)
+		}
+		if zone := zoneOf(z.Ketama(), addr); zone != "b" {
+			t.Errorf("PickServer(%q) picked zone %s, want b", key, zone)
+		}
+
+		replicas, _ := z.PickReplicas(key)
+		if len(replicas) != 3 {
+			t.Errorf("PickReplicas(%q) = %v, want all 3 servers",
+				key, replicas)
+		}
+	}
+}
+
+func TestZoneAwareFallback(t *testing.T) {
+	z := newZoneAware(t, []string{"a", "b", "c"}, "b")
+	k := z.Ketama()
+
+	down := make(map[string]bool)
+	z.SetHealthCheck(func(addr net.Addr) bool {
+		return !down[zoneOf(k, addr)]
+	})
+
+	down["b"] = true
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		replicas, _ := z.PickReplicas(key)
+
+		// The first replica which is up, in ring order.
+		want := replicas[0]
+		if zoneOf(k, want) == "b" {
+			want = replicas[1]
+		}
+
+		if addr, _ := z.PickServer(key); addr != want {
+			t.Errorf("PickServer(%q) = %s (zone %s), want %s (zone %s)",
+				key, addr, zoneOf(k, addr), want, zoneOf(k, want))
+		}
+	}
+
+	down["a"], down["c"] = true, true
+	owner, _ := k.PickServer("foo")
+	if addr, _ := z.PickServer("foo"); addr != owner {
+		t.Errorf("PickServer with all replicas down = %s, want owner %s",
+			addr, owner)
+	}
+}
+
+func TestZoneAwareFewerServersThanReplicas(t *testing.T) {
+	z := newZoneAware(t, []string{"a"}, "b")
+
+	replicas, err := z.PickReplicas("foo")
+	if err != nil || len(replicas) != 1 {
+		t.Errorf("PickReplicas = %v, %v, want single server", replicas, err)
+	}
+	if addr, _ := z.PickServer("foo"); addr != replicas[0] {
+		t.Errorf("PickServer = %s, want %s", addr, replicas[0])
+	}
+}
+
+func TestZoneAwareSpread(t *testing.T) {
+	zones := []string{"a", "b", "c", "a", "b", "c", "a", "b", "c"}
+	z := newZoneAware(t, zones, "a")
+	k := z.Ketama()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		replicas, err := z.PickReplicas(key)
+		if err != nil {
+			t.Fatalf("PickReplicas: %s", err)
+		}
+		owner, _ := k.PickServer(key)
+		if replicas[0] != owner {
+			t.Fatalf("PickReplicas(%q) = %v, want owner %s first",
+				key, replicas, owner)
+		}
+
+		zones := make(map[string]bool)
+		for _, addr := range replicas {
+			zones[zoneOf(k, addr)] = true
+		}
+		if len(replicas) != 3 || len(zones) != 3 {
+			t.Fatalf("PickReplicas(%q) = %v, want one server per zone",
+				key, replicas)
+		}
+
+		if addr, _ := z.PickServer(key); zoneOf(k, addr) != "a" {
+			t.Errorf("PickServer(%q) read from zone %s, want a",
+				key, zoneOf(k, addr))
+		}
+	}
+}
+
+func TestZoneAwareFewerZonesThanReplicas(t *testing.T) {
+	z := newZoneAware(t, []string{"a", "a", "b", "a"}, "a")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		replicas, _ := z.PickReplicas(key)
+		if len(replicas) != 3 {
+			t.Fatalf("PickReplicas(%q) = %v, want 3 servers", key, replicas)
+		}
+
+		hasB := false
+		for _, addr := range replicas {
+			hasB = hasB || zoneOf(z.Ketama(), addr) == "b"
+		}
+		if !hasB {
+			t.Errorf("PickReplicas(%q) = %v, want server in zone b",
+				key, replicas)
+		}
+	}
+}
+
+func TestZoneAwareHealthCheckUnlocked(t *testing.T) {
+	z := newZoneAware(t, []string{"a", "b", "c"}, "b")
+	k := z.Ketama()
+
+	// Changing the list from the callback would deadlock if it ran under
+	// the lock of the Ketama.
+	z.SetHealthCheck(func(addr net.Addr) bool {
+		var addrs []net.Addr
+		k.Each(func(addr net.Addr) error {
+			addrs = append(addrs, addr)
+			return nil
+		})
+		k.SetServersAddr(addrs)
+		return true
+	})
+	if _, err := z.PickServer("foo"); err != nil {
+		t.Errorf("PickServer = %v", err)
+	}
+}
+
+func benchmarkZoneAware(b *testing.B, servers int, zones int) {
+	list := make([]Server, servers)
+	for i := range list {
+		list[i] = Server{
+			Addr: &net.TCPAddr{
+				IP:   net.IPv4(10, 0, byte(i/250), byte(i%250+1)),
+				Port: 11211,
+			},
+			Zone: fmt.Sprintf("zone-%d", i%zones),
+		}
+	}
+
+	k := &Ketama{}
+	if err := k.SetServers(list); err != nil {
+		b.Fatalf("SetServers: %s", err)
+	}
+	z := NewZoneAware(k, "zone-0", 3)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		z.PickServer("some-key")
+	}
+}
+
+func BenchmarkZoneAware(b *testing.B) {
+	b.Run("100Servers3Zones", func(b *testing.B) {
+		benchmarkZoneAware(b, 100, 3)
+	})
+	// Fewer zones than replicas.
+	b.Run("100Servers2Zones", func(b *testing.B) {
+		benchmarkZoneAware(b, 100, 2)
+	})
+	b.Run("500Servers2Zones", func(b *testing.B) {
+		benchmarkZoneAware(b, 500, 2)
+	})
+	b.Run("100Servers1Zone", func(b *testing.B) {
+		benchmarkZoneAware(b, 100, 1)
+	})
+}
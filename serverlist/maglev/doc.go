@@ -0,0 +1,24 @@
+/*
+Package maglev provides server selection using Maglev hashing (Eisenbud et
+al., "Maglev: A Fast and Reliable Software Network Load Balancer").
+
+Servers fill a lookup table of prime size by walking their own permutations of
+it, picking a server for a key is then a single table lookup, whatever the
+number of servers. Every server gets almost exactly the same number of table
+entries, so the keys are spread nearly perfectly. Maglev implements
+memcache.ServerSelector and accepts the same ketama.Server list as Ketama:
+
+	m := &maglev.Maglev{}
+	m.SetServers(servers)
+
+	mc := memcache.NewFromSelector(m)
+
+The price is some extra disruption and the cost of rebuilding the table. On
+removal of a server all its keys move, as with any consistent hashing, and a
+few keys of the other servers move as well. Removing 1 of 100 servers with
+the default table size moves about 1.6 % of the keys instead of the ideal 1 %
+(see TestRemovalDisruption). Rebuilding the default table for 500 servers
+takes about 5 ms, lookups take about 30 ns compared to about 390 ns of
+Ketama (see the benchmarks).
+*/
+package maglev
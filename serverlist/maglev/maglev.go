@@ -0,0 +1,223 @@
+package maglev
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlist"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// DefaultTableSize is the size of the lookup table used unless SetTableSize is
+// called. It is good for up to about 650 servers.
+const DefaultTableSize = 65537
+
+var (
+	// ErrNilAddr is reported by SetServers for server without address.
+	ErrNilAddr = serverlist.ErrNilAddr
+	// ErrTableSize is returned by SetTableSize for size that is not
+	// a prime.
+	ErrTableSize = errors.New("table size must be a prime")
+	// ErrTooManyServers is returned by SetServers and SetTableSize when
+	// the table is not larger than the number of servers.
+	ErrTooManyServers = errors.New("more servers than table entries")
+)
+
+// node is single server with its permutation of the table.
+type node struct {
+	addr   net.Addr
+	offset uint64
+	skip   uint64
+	weight int
+}
+
+// Maglev provides server list using Maglev hashing. Zero value is an empty
+// server list with table of DefaultTableSize ready to use.
+type Maglev struct {
+	size    int
+	servers []ketama.Server
+	addrs   []net.Addr
+	nodes   []node
+	// table holds index into nodes for every table entry.
+	table []int32
+	m     sync.RWMutex
+}
+
+// SetTableSize sets size of the lookup table, which must be a prime. Lookups
+// cost the same for every size, but larger tables balance the keys better:
+// the size should be at least 100 times the number of servers. Changing the
+// size moves most of the keys. It is safe to call from multiple goroutines at
+// once.
+func (m *Maglev) SetTableSize(size int) error {
+	if !isPrime(size) {
+		return ErrTableSize
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if len(m.nodes) >= size {
+		return ErrTooManyServers
+	}
+
+	m.size = size
+	if len(m.nodes) != 0 {
+		m.table = populate(m.nodes, size)
+	}
+	return nil
+}
+
+// tableSize returns size of the table. Caller must hold the lock.
+func (m *Maglev) tableSize() int {
+	if m.size == 0 {
+		return DefaultTableSize
+	}
+	return m.size
+}
+
+// SetServers updates current list of servers to servers and rebuilds the lookup
+// table. Order of the servers does not matter. It is safe to call from
+// multiple goroutines at once.
+//
+// Server with weight w fills w times more table entries, and so gets w times
+// more keys, than server with weight 1. Weight 0 is considered same as 1, the
+// same way Ketama does. All servers are checked before any change is made. If
+// any of them is invalid, returned error is ketama.ServerErrors describing
+// every invalid server.
+func (m *Maglev) SetServers(servers []ketama.Server) error {
+	if err := serverlist.Validate(servers); err != nil {
+		return err
+	}
+
+	var addrs []net.Addr
+	var nodes []node
+	for _, server := range servers {
+		h := serverlist.FNV1a(serverlist.Label(server.Addr))
+		addrs = append(addrs, server.Addr)
+		nodes = append(nodes, node{
+			addr:   server.Addr,
+			offset: serverlist.Mix(h),
+			skip:   serverlist.Mix(h ^ skipSeed),
+			weight: serverlist.Weight(server),
+		})
+	}
+
+	servers = append([]ketama.Server(nil), servers...)
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	size := m.tableSize()
+	if len(nodes) >= size {
+		return ErrTooManyServers
+	}
+
+	var table []int32
+	if len(nodes) != 0 {
+		table = populate(nodes, size)
+	}
+
+	m.servers = servers
+	m.addrs = addrs
+	m.nodes = nodes
+	m.table = table
+
+	return nil
+}
+
+// SetServersAddr updates current list of servers to addrs. All addresses have
+// weight of 1. It is safe to call from multiple goroutines at once.
+func (m *Maglev) SetServersAddr(addrs []net.Addr) error {
+	return m.SetServers(serverlist.FromAddrs(addrs))
+}
+
+// LookupServer returns the server with address addr from the current list. Safe
+// to call from multiple goroutines at once.
+func (m *Maglev) LookupServer(addr net.Addr) (ketama.Server, bool) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	return serverlist.Lookup(m.servers, addr)
+}
+
+// PickServer returns address onto which the key should go. It is single lookup
+// in the table, whatever the number of servers. Safe to call from multiple
+// goroutines at once.
+func (m *Maglev) PickServer(key string) (net.Addr, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+
+	if len(m.table) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+
+	i := serverlist.Mix(serverlist.FNV1a(key)) % uint64(len(m.table))
+	return m.nodes[m.table[i]].addr, nil
+}
+
+// Each calls fn with every address that is currently registered into this
+// server list.
+func (m *Maglev) Each(fn func(net.Addr) error) error {
+	m.m.RLock()
+	addrs := m.addrs
+	m.m.RUnlock()
+
+	return serverlist.Each(addrs, fn)
+}
+
+// populate returns lookup table of size entries for nodes. Every node walks
+// its own permutation of the table and takes the first free entry, as
+// described in the Maglev paper, except that in every round node with
+// weight w takes w entries instead of one.
+func populate(nodes []node, size int) []int32 {
+	m := uint64(size)
+
+	table := make([]int32, size)
+	for i := range table {
+		table[i] = -1
+	}
+
+	next := make([]uint64, len(nodes))
+	filled := 0
+	for {
+		for i := range nodes {
+			n := &nodes[i]
+			offset := n.offset % m
+			skip := n.skip%(m-1) + 1
+
+			for w := 0; w < n.weight; w++ {
+				c := (offset + next[i]*skip) % m
+				for table[c] >= 0 {
+					next[i]++
+					c = (offset + next[i]*skip) % m
+				}
+
+				table[c] = int32(i)
+				next[i]++
+
+				filled++
+				if filled == size {
+					return table
+				}
+			}
+		}
+	}
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for d := 2; d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// skipSeed makes skip of a node independent of its offset.
+const skipSeed = 0x9e3779b97f4a7c15
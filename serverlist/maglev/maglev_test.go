@@ -0,0 +1,183 @@
+package maglev
+
+import (
+	"net"
+	"testing"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlisttest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func TestTableBalance(t *testing.T) {
+	m := &Maglev{}
+	if err := m.SetServersAddr(serverlisttest.Addrs(100)); err != nil {
+		t.Fatalf("SetServersAddr: %s", err)
+	}
+
+	counts := make(map[int32]int)
+	for _, i := range m.table {
+		counts[i]++
+	}
+
+	// Every server gets either floor or ceil of size/n entries, give or
+	// take the last round.
+	ideal := DefaultTableSize / 100
+	for i, n := range counts {
+		if n < ideal-1 || n > ideal+2 {
+			t.Errorf("Server %d got %d entries, want about %d",
+				i, n, ideal)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	a := serverlisttest.Addrs(3)
+	m := &Maglev{}
+	err := m.SetServers([]ketama.Server{
+		{Addr: a[0], Weight: 0},
+		{Addr: a[1], Weight: 1},
+		{Addr: a[2], Weight: 2},
+	})
+	if err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+
+	counts := make(map[net.Addr]int)
+	for _, i := range m.table {
+		counts[m.nodes[i].addr]++
+	}
+
+	want := map[net.Addr]int{
+		a[0]: DefaultTableSize / 4,
+		a[1]: DefaultTableSize / 4,
+		a[2]: DefaultTableSize / 2,
+	}
+	for addr, n := range want {
+		if counts[addr] < n-2 || counts[addr] > n+2 {
+			t.Errorf("%s got %d entries, want about %d",
+				addr, counts[addr], n)
+		}
+	}
+}
+
+func TestRemovalDisruption(t *testing.T) {
+	const servers = 100
+
+	keys := serverlisttest.Keys(200000)
+	a := serverlisttest.Addrs(servers)
+
+	m := &Maglev{}
+	m.SetServersAddr(a)
+	before := serverlisttest.PickAll(t, m, keys)
+
+	removed := a[42]
+	m.SetServersAddr(append(append([]net.Addr(nil), a[:42]...), a[43:]...))
+	after := serverlisttest.PickAll(t, m, keys)
+
+	owned, moved := 0, 0
+	for _, key := range keys {
+		switch {
+		case before[key] == removed:
+			owned++
+		case after[key] != before[key]:
+			moved++
+		}
+	}
+
+	// Maglev trades some disruption for the balance: keys of the removed
+	// server have to move, but few keys of other servers move as well.
+	t.Logf("Removing 1 of %d servers moved %.2f %% of keys "+
+		"(%.2f %% owned by the removed server, %.2f %% of the others)",
+		servers,
+		float64(owned+moved)/float64(len(keys))*100,
+		float64(owned)/float64(len(keys))*100,
+		float64(moved)/float64(len(keys))*100)
+
+	if moved > owned {
+		t.Errorf("%d keys of remaining servers moved, want less than %d",
+			moved, owned)
+	}
+}
+
+func TestSetTableSize(t *testing.T) {
+	m := &Maglev{}
+	if err := m.SetTableSize(1000); err != ErrTableSize {
+		t.Errorf("SetTableSize(1000) = %v, want %v", err, ErrTableSize)
+	}
+
+	m.SetServersAddr(serverlisttest.Addrs(10))
+	if err := m.SetTableSize(7); err != ErrTooManyServers {
+		t.Errorf("SetTableSize(7) = %v, want %v", err, ErrTooManyServers)
+	}
+	if err := m.SetTableSize(1009); err != nil {
+		t.Fatalf("SetTableSize(1009): %s", err)
+	}
+	if len(m.table) != 1009 {
+		t.Errorf("Table has %d entries, want 1009", len(m.table))
+	}
+
+	err := m.SetServersAddr(serverlisttest.Addrs(1009))
+	if err != ErrTooManyServers {
+		t.Errorf("SetServersAddr = %v, want %v", err, ErrTooManyServers)
+	}
+	if len(m.nodes) != 10 {
+		t.Errorf("Rejected servers changed the list")
+	}
+}
+
+func TestServerList(t *testing.T) {
+	serverlisttest.Run(t, func() serverlisttest.List { return &Maglev{} })
+}
+
+// The benchmarks compare lookups of Maglev and Ketama with large number of
+// servers.
+
+func benchmarkPickServer(b *testing.B, servers int) {
+	m := &Maglev{}
+	m.SetServersAddr(serverlisttest.Addrs(servers))
+	keys := serverlisttest.Keys(1024)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.PickServer(keys[i%len(keys)])
+	}
+
+	b.ReportAllocs()
+}
+
+func benchmarkKetamaPickServer(b *testing.B, servers int) {
+	k := &ketama.Ketama{}
+	k.SetServersAddr(serverlisttest.Addrs(servers))
+	keys := serverlisttest.Keys(1024)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		k.PickServer(keys[i%len(keys)])
+	}
+
+	b.ReportAllocs()
+}
+
+func BenchmarkPickServer10(b *testing.B)  { benchmarkPickServer(b, 10) }
+func BenchmarkPickServer500(b *testing.B) { benchmarkPickServer(b, 500) }
+
+func BenchmarkKetamaPickServer10(b *testing.B) {
+	benchmarkKetamaPickServer(b, 10)
+}
+
+func BenchmarkKetamaPickServer500(b *testing.B) {
+	benchmarkKetamaPickServer(b, 500)
+}
+
+func BenchmarkSetServers500(b *testing.B) {
+	m := &Maglev{}
+	addrs := serverlisttest.Addrs(500)
+
+	for i := 0; i < b.N; i++ {
+		m.SetServersAddr(addrs)
+	}
+
+	b.ReportAllocs()
+}
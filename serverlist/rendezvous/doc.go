@@ -0,0 +1,25 @@
+/*
+Package rendezvous provides server selection using weighted rendezvous hashing,
+also known as highest random weight (HRW) hashing.
+
+Every server gets a score for every key and the key goes to the server with the
+highest score. No continuum is needed and removing a server moves only the keys
+it owned, each of them to the server with the next highest score. Ordering the
+servers by the score gives natural replica sets, see PickServers.
+
+Rendezvous implements memcache.ServerSelector and accepts the same
+ketama.Server list as Ketama, so it is a drop-in replacement when
+libmemcached compatibility is not needed:
+
+	r := &rendezvous.Rendezvous{}
+	r.SetServers([]ketama.Server{
+		{Addr: addr1, Weight: 1},
+		{Addr: addr2, Weight: 2},
+	})
+
+	mc := memcache.NewFromSelector(r)
+
+Picking a server costs O(n) in the number of servers, which is fine for
+clusters of tens of servers.
+*/
+package rendezvous
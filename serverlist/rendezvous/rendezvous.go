@@ -0,0 +1,160 @@
+package rendezvous
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlist"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+// ErrNilAddr is reported by SetServers for server without address.
+var ErrNilAddr = serverlist.ErrNilAddr
+
+// node is single server with its precomputed hash.
+type node struct {
+	addr   net.Addr
+	hash   uint64
+	weight float64
+}
+
+// Rendezvous provides server list using weighted rendezvous hashing. Zero value
+// is an empty server list ready to use.
+type Rendezvous struct {
+	servers []ketama.Server
+	addrs   []net.Addr
+	nodes   []node
+	m       sync.RWMutex
+}
+
+// SetServers updates current list of servers to servers. Order of the servers
+// does not matter. It is safe to call from multiple goroutines at once.
+//
+// Server with weight w gets w times more keys than server with weight 1,
+// weight 0 is considered same as 1, the same way Ketama does. All servers are
+// checked before any change is made. If any of them is invalid, returned error
+// is ketama.ServerErrors describing every invalid server.
+func (r *Rendezvous) SetServers(servers []ketama.Server) error {
+	if err := serverlist.Validate(servers); err != nil {
+		return err
+	}
+
+	var addrs []net.Addr
+	var nodes []node
+	for _, server := range servers {
+		addrs = append(addrs, server.Addr)
+		nodes = append(nodes, node{
+			addr:   server.Addr,
+			hash:   serverlist.FNV1a(serverlist.Label(server.Addr)),
+			weight: float64(serverlist.Weight(server)),
+		})
+	}
+
+	servers = append([]ketama.Server(nil), servers...)
+
+	r.m.Lock()
+	r.servers = servers
+	r.addrs = addrs
+	r.nodes = nodes
+	r.m.Unlock()
+
+	return nil
+}
+
+// SetServersAddr updates current list of servers to addrs. All addresses have
+// weight of 1. It is safe to call from multiple goroutines at once.
+func (r *Rendezvous) SetServersAddr(addrs []net.Addr) error {
+	return r.SetServers(serverlist.FromAddrs(addrs))
+}
+
+// LookupServer returns the server with address addr from the current list. Safe
+// to call from multiple goroutines at once.
+func (r *Rendezvous) LookupServer(addr net.Addr) (ketama.Server, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return serverlist.Lookup(r.servers, addr)
+}
+
+// PickServer returns address onto which the key should go, the server with the
+// highest score. Safe to call from multiple goroutines at once.
+func (r *Rendezvous) PickServer(key string) (net.Addr, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if len(r.nodes) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+
+	h := serverlist.FNV1a(key)
+
+	best, bestScore := 0, math.Inf(-1)
+	for i := range r.nodes {
+		if s := r.nodes[i].score(h); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return r.nodes[best].addr, nil
+}
+
+// PickServers returns up to n distinct addresses onto which replicas of the key
+// should go, ordered by their score. The first one is the address returned by
+// PickServer. When it is removed from the list, the second one becomes the
+// first and so on, no other key moves. Safe to call from multiple goroutines
+// at once.
+func (r *Rendezvous) PickServers(key string, n int) ([]net.Addr, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if len(r.nodes) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	h := serverlist.FNV1a(key)
+
+	type scored struct {
+		addr  net.Addr
+		score float64
+	}
+	all := make([]scored, len(r.nodes))
+	for i := range r.nodes {
+		all[i] = scored{r.nodes[i].addr, r.nodes[i].score(h)}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].score > all[j].score
+	})
+
+	addrs := make([]net.Addr, n)
+	for i := range addrs {
+		addrs[i] = all[i].addr
+	}
+	return addrs, nil
+}
+
+// Each calls fn with every address that is currently registered into this
+// server list.
+func (r *Rendezvous) Each(fn func(net.Addr) error) error {
+	r.m.RLock()
+	addrs := r.addrs
+	r.m.RUnlock()
+
+	return serverlist.Each(addrs, fn)
+}
+
+// score returns score of the node for key hashed to h. Using -w/ln(u), with
+// u uniformly distributed in (0, 1), makes the chance of the node winning
+// proportional to its weight.
+func (n *node) score(h uint64) float64 {
+	u := (float64(serverlist.Mix(h^n.hash)>>11) + 0.5) / (1 << 53)
+	return -n.weight / math.Log(u)
+}
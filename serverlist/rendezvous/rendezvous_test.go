@@ -0,0 +1,144 @@
+package rendezvous
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlisttest"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func TestBalance(t *testing.T) {
+	r := &Rendezvous{}
+	if err := r.SetServersAddr(serverlisttest.Addrs(10)); err != nil {
+		t.Fatalf("SetServersAddr: %s", err)
+	}
+
+	counts := make(map[net.Addr]int)
+	keys := serverlisttest.Keys(100000)
+	for _, addr := range serverlisttest.PickAll(t, r, keys) {
+		counts[addr]++
+	}
+
+	ideal := len(keys) / 10
+	for addr, n := range counts {
+		if n < ideal*95/100 || n > ideal*105/100 {
+			t.Errorf("%s got %d keys, want %d +- 5 %%", addr, n, ideal)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	a := serverlisttest.Addrs(3)
+	r := &Rendezvous{}
+	err := r.SetServers([]ketama.Server{
+		{Addr: a[0], Weight: 0},
+		{Addr: a[1], Weight: 1},
+		{Addr: a[2], Weight: 2},
+	})
+	if err != nil {
+		t.Fatalf("SetServers: %s", err)
+	}
+
+	counts := make(map[net.Addr]int)
+	keys := serverlisttest.Keys(40000)
+	for _, addr := range serverlisttest.PickAll(t, r, keys) {
+		counts[addr]++
+	}
+
+	want := map[net.Addr]int{a[0]: 10000, a[1]: 10000, a[2]: 20000}
+	for addr, n := range want {
+		if counts[addr] < n*95/100 || counts[addr] > n*105/100 {
+			t.Errorf("%s got %d keys, want about %d", addr, counts[addr], n)
+		}
+	}
+}
+
+func TestRemoval(t *testing.T) {
+	keys := serverlisttest.Keys(10000)
+	a := serverlisttest.Addrs(10)
+
+	r := &Rendezvous{}
+	r.SetServersAddr(a)
+	before := serverlisttest.PickAll(t, r, keys)
+
+	replicas := make(map[string][]net.Addr, len(keys))
+	for _, key := range keys {
+		replicas[key], _ = r.PickServers(key, 2)
+	}
+
+	removed := a[3]
+	r.SetServersAddr(append(append([]net.Addr(nil), a[:3]...), a[4:]...))
+
+	for key, addr := range serverlisttest.PickAll(t, r, keys) {
+		switch {
+		case before[key] == removed:
+			if addr != replicas[key][1] {
+				t.Errorf("Key %q went to %s, not to its second replica %s",
+					key, addr, replicas[key][1])
+			}
+		case addr != before[key]:
+			t.Errorf("Key %q moved from %s to %s", key, before[key], addr)
+		}
+	}
+}
+
+func TestPickServers(t *testing.T) {
+	a := serverlisttest.Addrs(5)
+	r := &Rendezvous{}
+	r.SetServersAddr(a)
+
+	for _, key := range serverlisttest.Keys(1000) {
+		first, _ := r.PickServer(key)
+		addrs, err := r.PickServers(key, 3)
+		if err != nil {
+			t.Fatalf("PickServers: %s", err)
+		}
+		if len(addrs) != 3 {
+			t.Fatalf("PickServers returned %d addresses, want 3",
+				len(addrs))
+		}
+		if addrs[0] != first {
+			t.Errorf("PickServers(%q)[0] = %s, want %s",
+				key, addrs[0], first)
+		}
+		if addrs[0] == addrs[1] || addrs[1] == addrs[2] ||
+			addrs[0] == addrs[2] {
+
+			t.Errorf("PickServers(%q) = %v, want distinct", key, addrs)
+		}
+	}
+
+	if addrs, _ := r.PickServers("foo", 10); len(addrs) != 5 {
+		t.Errorf("PickServers returned %d addresses, want 5", len(addrs))
+	}
+	if addrs, _ := r.PickServers("foo", 0); len(addrs) != 0 {
+		t.Errorf("PickServers returned %d addresses, want 0", len(addrs))
+	}
+}
+
+func TestServerList(t *testing.T) {
+	serverlisttest.Run(t, func() serverlisttest.List { return &Rendezvous{} })
+}
+
+func TestPickServersNoServers(t *testing.T) {
+	r := &Rendezvous{}
+	if _, err := r.PickServers("foo", 2); err != memcache.ErrNoServers {
+		t.Errorf("PickServers = %v, want %v", err, memcache.ErrNoServers)
+	}
+}
+
+func BenchmarkPickServer(b *testing.B) {
+	r := &Rendezvous{}
+	r.SetServersAddr(serverlisttest.Addrs(10))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.PickServer("some-key")
+	}
+
+	b.ReportAllocs()
+}
@@ -0,0 +1,390 @@
+/*
+Package router routes keys to multiple named memcached pools by their prefix,
+so single client can reach all of them:
+
+	r := &router.Router{}
+	err := r.SetPools([]router.Pool{{
+		Name:     "sessions",
+		Prefixes: []string{"sess:"},
+		Servers:  sessionServers,
+	}, {
+		Name:     "flags",
+		Prefixes: []string{"flag:", "flag:beta:"},
+		Servers:  flagServers,
+	}, {
+		Name:    "fragments",
+		Servers: fragmentServers,
+	}}, "fragments")
+
+	mc := memcache.NewFromSelector(r)
+
+Key goes to the pool with the longest prefix matching it, keys matching none
+go to the default pool. Within the pool, the server is picked by
+ketama.Ketama.
+*/
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/internal/serverlist"
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+var (
+	// ErrNoPool is returned for key matching no prefix when there is no
+	// default pool.
+	ErrNoPool = errors.New("no pool for key")
+	// ErrDuplicatePool is reported by SetPools when two pools have the
+	// same name.
+	ErrDuplicatePool = errors.New("duplicate pool name")
+	// ErrDuplicatePrefix is reported by SetPools when two pools have the
+	// same prefix.
+	ErrDuplicatePrefix = errors.New("duplicate prefix")
+	// ErrUnknownPool is reported by SetPools when the default pool is not
+	// among the pools.
+	ErrUnknownPool = errors.New("unknown pool")
+	// ErrConflictingServer is reported by SetPools when pools share an
+	// address with different credentials, TLS or zone.
+	ErrConflictingServer = errors.New("conflicting server settings")
+)
+
+// Pool is a named group of servers.
+type Pool struct {
+	Name string
+	// Prefixes of keys routed to the pool.
+	Prefixes []string
+	// Servers of the pool.
+	Servers []ketama.Server
+}
+
+// route maps single prefix to its pool.
+type route struct {
+	prefix string
+	k      *ketama.Ketama
+}
+
+// table is single configuration of the Router, never modified once built.
+type table struct {
+	// routes sorted from the longest prefix.
+	routes []route
+	pools  map[string]*ketama.Ketama
+	// names of the pools, sorted.
+	names []string
+	def   *ketama.Ketama
+	// servers of all pools by their label, and their addresses, each
+	// address once.
+	servers map[string]ketama.Server
+	addrs   []net.Addr
+}
+
+// Router implements memcache.ServerSelector by routing keys to pools. Zero
+// value has no pools. It is safe to use from multiple goroutines at once.
+type Router struct {
+	t          *table
+	generation uint64
+	m          sync.RWMutex
+
+	subscribers map[uint64]func(ketama.TopologyChange)
+	next        uint64
+	sm          sync.Mutex
+}
+
+// SetPools replaces all pools of r with pools, keys matching no prefix go to
+// pool named def. Empty def means there is no default pool.
+//
+// New pools are built first and swapped in at once, so every key is routed
+// either by the old or by the new configuration, never by a mix of both. If
+// any pool is invalid, nothing is changed.
+//
+// Every call builds new Ketamas, even for pools which did not change. Their
+// generations start over and subscriptions (see ketama.Ketama.Subscribe) made
+// on Ketamas returned by Pool get no further changes, so Pool needs to be
+// called again after SetPools. Subscribe to the Router itself to follow all
+// pools.
+//
+// The same address may be in several pools, with different weights, but its
+// credentials, TLS and zone must be the same in all of them.
+//
+// When servers are added to or removed from the union of all pools, or their
+// settings change, subscribers are notified (see Subscribe).
+func (r *Router) SetPools(pools []Pool, def string) error {
+	t := &table{
+		pools:   make(map[string]*ketama.Ketama, len(pools)),
+		servers: make(map[string]ketama.Server),
+	}
+	prefixes := make(map[string]string)
+
+	for _, pool := range pools {
+		if _, ok := t.pools[pool.Name]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicatePool, pool.Name)
+		}
+		for _, server := range pool.Servers {
+			if server.Addr == nil {
+				continue
+			}
+			key := serverlist.Label(server.Addr)
+			other, ok := t.servers[key]
+			if !ok {
+				t.servers[key] = server
+				t.addrs = append(t.addrs, server.Addr)
+			} else if !serverlist.SameSettings(other, server) {
+				return fmt.Errorf("%w: %s in pool %s",
+					ErrConflictingServer, server.Addr, pool.Name)
+			}
+		}
+
+		k := &ketama.Ketama{}
+		if err := k.SetServers(pool.Servers); err != nil {
+			return fmt.Errorf("pool %s: %w", pool.Name, err)
+		}
+		t.pools[pool.Name] = k
+		t.names = append(t.names, pool.Name)
+
+		for _, prefix := range pool.Prefixes {
+			if other, ok := prefixes[prefix]; ok {
+				return fmt.Errorf("%w: %q of pools %s and %s",
+					ErrDuplicatePrefix, prefix, other, pool.Name)
+			}
+			prefixes[prefix] = pool.Name
+
+			t.routes = append(t.routes, route{prefix: prefix, k: k})
+		}
+	}
+
+	if def != "" {
+		k, ok := t.pools[def]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownPool, def)
+		}
+		t.def = k
+	}
+
+	sort.Strings(t.names)
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].prefix) > len(t.routes[j].prefix)
+	})
+
+	r.m.Lock()
+
+	change := topologyChange(r.t, t)
+	changed := !sameAddrs(r.t, t) || len(change.Changed) != 0
+
+	r.t = t
+	change.OldGeneration = r.generation
+	if changed {
+		r.generation++
+	}
+	change.Generation = r.generation
+
+	// Taking the subscribers' lock before releasing ours guarantees
+	// notifications are delivered in the order of generations.
+	r.sm.Lock()
+	r.m.Unlock()
+
+	if changed {
+		for _, fn := range r.subscribers {
+			fn(change)
+		}
+	}
+	r.sm.Unlock()
+
+	return nil
+}
+
+// topologyChange returns change of the servers of all pools from table old
+// to table new, without generations.
+func topologyChange(old *table, new *table) ketama.TopologyChange {
+	change := ketama.TopologyChange{New: new.addrs}
+	if old == nil {
+		return change
+	}
+
+	change.Old = old.addrs
+	for _, addr := range new.addrs {
+		key := serverlist.Label(addr)
+		server, ok := old.servers[key]
+		if ok && !serverlist.SameSettings(server, new.servers[key]) {
+			change.Changed = append(change.Changed, addr)
+		}
+	}
+	return change
+}
+
+// sameAddrs reports whether tables old and new have the same servers.
+func sameAddrs(old *table, new *table) bool {
+	if old == nil {
+		return len(new.addrs) == 0
+	}
+	if len(old.servers) != len(new.servers) {
+		return false
+	}
+	for key := range new.servers {
+		if _, ok := old.servers[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe registers fn to be called whenever SetPools changes the servers
+// of all pools together: adds or removes an address, or changes its
+// credentials, TLS or zone. Weights and moves between pools are not reported.
+// Changes made directly to Ketamas returned by Pool are not reported either.
+// The change holds generations of the Router, increased by every reported
+// change.
+//
+// fn is called synchronously from SetPools, after the new pools are in
+// effect, and changes are delivered in order of their generations. fn must
+// not call SetPools or Subscribe (nor the returned unsubscribe function)
+// since that would deadlock.
+//
+// Returned function removes the subscription. Safe to call from multiple
+// goroutines at once.
+func (r *Router) Subscribe(fn func(ketama.TopologyChange)) (unsubscribe func()) {
+	r.sm.Lock()
+	defer r.sm.Unlock()
+
+	if r.subscribers == nil {
+		r.subscribers = make(map[uint64]func(ketama.TopologyChange))
+	}
+	id := r.next
+	r.next++
+	r.subscribers[id] = fn
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.sm.Lock()
+			delete(r.subscribers, id)
+			r.sm.Unlock()
+		})
+	}
+}
+
+func (r *Router) table() *table {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return r.t
+}
+
+// Pool returns Ketama of pool named name, for inspection. Changes made to it
+// directly are lost on the next SetPools.
+func (r *Router) Pool(name string) (*ketama.Ketama, bool) {
+	t := r.table()
+	if t == nil {
+		return nil, false
+	}
+
+	k, ok := t.pools[name]
+	return k, ok
+}
+
+// pool returns pool of key.
+func (t *table) pool(key string) (*ketama.Ketama, error) {
+	for _, route := range t.routes {
+		if strings.HasPrefix(key, route.prefix) {
+			return route.k, nil
+		}
+	}
+	if t.def == nil {
+		return nil, ErrNoPool
+	}
+	return t.def, nil
+}
+
+// PickServer returns address onto which the key should go, picked by Ketama of
+// the key's pool.
+func (r *Router) PickServer(key string) (net.Addr, error) {
+	t := r.table()
+	if t == nil {
+		return nil, memcache.ErrNoServers
+	}
+
+	k, err := t.pool(key)
+	if err != nil {
+		return nil, err
+	}
+	return k.PickServer(key)
+}
+
+// GroupKeys returns keys grouped by the address they should go to, as chosen by
+// PickServer. All keys are routed by the same configuration.
+func (r *Router) GroupKeys(keys []string) (map[net.Addr][]string, error) {
+	t := r.table()
+	if t == nil {
+		return nil, memcache.ErrNoServers
+	}
+
+	byPool := make(map[*ketama.Ketama][]string)
+	for _, key := range keys {
+		k, err := t.pool(key)
+		if err != nil {
+			return nil, err
+		}
+		byPool[k] = append(byPool[k], key)
+	}
+
+	groups := make(map[net.Addr][]string)
+	for k, keys := range byPool {
+		g, err := k.GroupKeys(keys)
+		if err != nil {
+			return nil, err
+		}
+		for addr, keys := range g {
+			groups[addr] = append(groups[addr], keys...)
+		}
+	}
+	return groups, nil
+}
+
+// Each calls fn with every address of every pool. Address present in multiple
+// pools is passed only once.
+func (r *Router) Each(fn func(net.Addr) error) error {
+	t := r.table()
+	if t == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range t.names {
+		err := t.pools[name].Each(func(addr net.Addr) error {
+			key := serverlist.Label(addr)
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+
+			return fn(addr)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupServer returns the server with address addr from the first pool, in
+// order of their names, which has it. Only Weight may differ between the
+// pools.
+func (r *Router) LookupServer(addr net.Addr) (ketama.Server, bool) {
+	t := r.table()
+	if t == nil {
+		return ketama.Server{}, false
+	}
+
+	for _, name := range t.names {
+		if server, ok := t.pools[name].LookupServer(addr); ok {
+			return server, true
+		}
+	}
+	return ketama.Server{}, false
+}
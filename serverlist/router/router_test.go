@@ -0,0 +1,312 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"git.sr.ht/~graywolf/gomemcache/serverlist/ketama"
+)
+
+func server(i int) ketama.Server {
+	return ketama.Server{
+		Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 11211},
+	}
+}
+
+func newRouter(t *testing.T) *Router {
+	r := &Router{}
+	err := r.SetPools([]Pool{{
+		Name:     "sessions",
+		Prefixes: []string{"sess:"},
+		Servers:  []ketama.Server{server(1)},
+	}, {
+		Name:     "flags",
+		Prefixes: []string{"flag:"},
+		Servers:  []ketama.Server{server(2)},
+	}, {
+		Name:     "beta",
+		Prefixes: []string{"flag:beta:"},
+		Servers:  []ketama.Server{server(3)},
+	}, {
+		Name:    "fragments",
+		Servers: []ketama.Server{server(4), server(1)},
+	}}, "fragments")
+	if err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	return r
+}
+
+func TestRouting(t *testing.T) {
+	r := newRouter(t)
+
+	tests := []struct {
+		key  string
+		pool string
+	}{
+		{"sess:42", "sessions"},
+		{"flag:dark-mode", "flags"},
+		{"flag:beta:dark-mode", "beta"},
+		{"flag:bet", "flags"},
+		{"page:/index", "fragments"},
+		{"sess", "fragments"},
+	}
+	for _, test := range tests {
+		addr, err := r.PickServer(test.key)
+		if err != nil {
+			t.Fatalf("PickServer(%q): %s", test.key, err)
+		}
+
+		k, _ := r.Pool(test.pool)
+		want, _ := k.PickServer(test.key)
+		if addr.String() != want.String() {
+			t.Errorf("PickServer(%q) = %s, want %s of pool %s",
+				test.key, addr, want, test.pool)
+		}
+	}
+}
+
+func TestNoDefault(t *testing.T) {
+	r := &Router{}
+	if _, err := r.PickServer("foo"); err != memcache.ErrNoServers {
+		t.Errorf("PickServer = %v, want %v", err, memcache.ErrNoServers)
+	}
+
+	err := r.SetPools([]Pool{{
+		Name:     "sessions",
+		Prefixes: []string{"sess:"},
+		Servers:  []ketama.Server{server(1)},
+	}}, "")
+	if err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	if _, err := r.PickServer("foo"); err != ErrNoPool {
+		t.Errorf("PickServer = %v, want %v", err, ErrNoPool)
+	}
+	if _, err := r.GroupKeys([]string{"sess:1", "foo"}); err != ErrNoPool {
+		t.Errorf("GroupKeys = %v, want %v", err, ErrNoPool)
+	}
+}
+
+func TestInvalidPools(t *testing.T) {
+	tests := []struct {
+		pools []Pool
+		def   string
+		err   error
+	}{{
+		pools: []Pool{{Name: "a"}, {Name: "a"}},
+		err:   ErrDuplicatePool,
+	}, {
+		pools: []Pool{
+			{Name: "a", Prefixes: []string{"x"}},
+			{Name: "b", Prefixes: []string{"x"}},
+		},
+		err: ErrDuplicatePrefix,
+	}, {
+		pools: []Pool{{Name: "a"}},
+		def:   "b",
+		err:   ErrUnknownPool,
+	}, {
+		pools: []Pool{{
+			Name:    "a",
+			Servers: []ketama.Server{{Addr: server(1).Addr, Weight: -1}},
+		}},
+		err: ketama.ErrNegativeWeight,
+	}, {
+		pools: []Pool{{
+			Name:    "a",
+			Servers: []ketama.Server{server(1)},
+		}, {
+			Name: "b",
+			Servers: []ketama.Server{{
+				Addr:     server(1).Addr,
+				Username: "user",
+			}},
+		}},
+		err: ErrConflictingServer,
+	}}
+
+	for _, test := range tests {
+		r := newRouter(t)
+		if err := r.SetPools(test.pools, test.def); !errors.Is(err, test.err) {
+			t.Errorf("SetPools = %v, want %v", err, test.err)
+		}
+		if _, ok := r.Pool("sessions"); !ok {
+			t.Errorf("Invalid pools changed the configuration")
+		}
+	}
+}
+
+func TestEach(t *testing.T) {
+	r := newRouter(t)
+
+	seen := make(map[string]int)
+	r.Each(func(addr net.Addr) error {
+		seen[addr.String()]++
+		return nil
+	})
+
+	if len(seen) != 4 {
+		t.Errorf("Each visited %d servers, want 4", len(seen))
+	}
+	for addr, n := range seen {
+		if n != 1 {
+			t.Errorf("Each visited %s %d times, want once", addr, n)
+		}
+	}
+}
+
+func TestLookupServer(t *testing.T) {
+	r := &Router{}
+	heavy := server(1)
+	heavy.Weight = 5
+	err := r.SetPools([]Pool{
+		{Name: "b", Servers: []ketama.Server{heavy}},
+		{Name: "a", Servers: []ketama.Server{server(1)}},
+		{Name: "c", Servers: []ketama.Server{server(2)}},
+	}, "a")
+	if err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		s, ok := r.LookupServer(server(1).Addr)
+		if !ok || s.Weight != 0 {
+			t.Fatalf("LookupServer = %+v, %v, want the server of pool a",
+				s, ok)
+		}
+	}
+	if _, ok := r.LookupServer(server(3).Addr); ok {
+		t.Errorf("LookupServer found unknown address")
+	}
+}
+
+func TestGroupKeys(t *testing.T) {
+	r := newRouter(t)
+
+	keys := []string{"sess:1", "sess:2", "flag:a", "flag:beta:b"}
+	groups, err := r.GroupKeys(keys)
+	if err != nil {
+		t.Fatalf("GroupKeys: %s", err)
+	}
+
+	n := 0
+	for addr, keys := range groups {
+		for _, key := range keys {
+			n++
+			if want, _ := r.PickServer(key); want != addr {
+				t.Errorf("Key %q grouped under %s, want %s",
+					key, addr, want)
+			}
+		}
+	}
+	if n != len(keys) {
+		t.Errorf("GroupKeys returned %d keys, want %d", n, len(keys))
+	}
+}
+
+func TestAtomicReload(t *testing.T) {
+	configs := [][]Pool{{
+		{Name: "a", Prefixes: []string{"k"}, Servers: []ketama.Server{server(1)}},
+		{Name: "b", Servers: []ketama.Server{server(2)}},
+	}, {
+		{Name: "a", Prefixes: []string{"k"}, Servers: []ketama.Server{server(3)}},
+		{Name: "b", Servers: []ketama.Server{server(4)}},
+	}}
+
+	r := &Router{}
+	r.SetPools(configs[0], "b")
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			r.SetPools(configs[i%2], "b")
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		groups, err := r.GroupKeys(keys)
+		if err != nil {
+			t.Fatalf("GroupKeys: %s", err)
+		}
+		if len(groups) != 1 {
+			t.Fatalf("Keys were split over %d servers by reload",
+				len(groups))
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestSubscribe(t *testing.T) {
+	r := &Router{}
+	var changes []ketama.TopologyChange
+	unsubscribe := r.Subscribe(func(change ketama.TopologyChange) {
+		changes = append(changes, change)
+	})
+
+	set := func(a []ketama.Server, b []ketama.Server) {
+		err := r.SetPools([]Pool{
+			{Name: "a", Servers: a},
+			{Name: "b", Servers: b},
+		}, "a")
+		if err != nil {
+			t.Fatalf("SetPools: %s", err)
+		}
+	}
+
+	set([]ketama.Server{server(1)}, []ketama.Server{server(2)})
+	// Moves between pools and weights are not reported.
+	heavy := server(1)
+	heavy.Weight = 3
+	set([]ketama.Server{server(2)}, []ketama.Server{heavy})
+	set([]ketama.Server{server(1)}, nil)
+	changed := server(1)
+	changed.Username = "user"
+	set([]ketama.Server{changed}, nil)
+
+	if len(changes) != 3 {
+		t.Fatalf("Got %d changes, want 3", len(changes))
+	}
+	if c := changes[0]; c.Generation != 1 || len(c.Old) != 0 ||
+		len(c.New) != 2 {
+
+		t.Errorf("First change = %+v, want 2 servers added", c)
+	}
+	if c := changes[1]; c.OldGeneration != 1 || c.Generation != 2 ||
+		len(c.Old) != 2 || len(c.New) != 1 {
+
+		t.Errorf("Second change = %+v, want server removed", c)
+	}
+	if c := changes[2]; len(c.Changed) != 1 ||
+		c.Changed[0].String() != server(1).Addr.String() {
+
+		t.Errorf("Third change = %+v, want server 1 changed", c)
+	}
+
+	unsubscribe()
+	set(nil, nil)
+	if len(changes) != 3 {
+		t.Errorf("Unsubscribed function was called")
+	}
+}